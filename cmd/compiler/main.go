@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hculpan/kabkey/pkg/compiler"
+	"github.com/hculpan/kabkey/pkg/diagnostic"
+	"github.com/hculpan/kabkey/pkg/lexer"
+	"github.com/hculpan/kabkey/pkg/optimizer"
+	"github.com/hculpan/kabkey/pkg/parser"
+)
+
+// ExecutableExt is the extension given to compiled programs when no output
+// file is named.
+const ExecutableExt = ".kbx"
+
+func main() {
+	output := flag.String("o", "", "name of the executable to write")
+	disassemble := flag.Bool("S", false, "print the compiled bytecode instead of writing an executable")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: kabc [-S] [-o output] <source file>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Println("Missing file parameter")
+		os.Exit(1)
+	}
+
+	filename := flag.Arg(0)
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	l := lexer.NewLexer(string(content))
+	l.SetFilename(filename)
+	p := parser.NewParser(l)
+	program := p.ParseProgram()
+	if len(l.Errors()) > 0 {
+		printDiagnostics(os.Stdout, string(content), l.Diagnostics())
+		os.Exit(1)
+	} else if len(p.Errors()) > 0 {
+		printDiagnostics(os.Stdout, string(content), p.Diagnostics())
+		os.Exit(1)
+	}
+
+	opt := optimizer.New()
+	opt.Optimize(program)
+	if len(opt.Errors()) > 0 {
+		printDiagnostics(os.Stdout, string(content), opt.Diagnostics())
+		os.Exit(1)
+	}
+
+	comp := compiler.New()
+	if err := comp.Compile(program); err != nil {
+		printErrors(os.Stdout, []string{err.Error()})
+		os.Exit(1)
+	}
+
+	bytecode := comp.Bytecode()
+	bytecode.Filename = filename
+
+	if *disassemble {
+		fmt.Print(bytecode.Disassemble())
+		return
+	}
+
+	if *output == "" {
+		*output = strings.TrimSuffix(filename, filepath.Ext(filename)) + ExecutableExt
+	}
+
+	if err := writeExecutable(*output, bytecode); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func writeExecutable(filename string, bytecode *compiler.Bytecode) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := compiler.WriteExecutable(f, bytecode); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func printErrors(out io.Writer, errors []string) {
+	for _, msg := range errors {
+		io.WriteString(out, "\t"+msg+"\n")
+	}
+}
+
+func printDiagnostics(out io.Writer, source string, diagnostics []diagnostic.Diagnostic) {
+	for _, d := range diagnostics {
+		io.WriteString(out, d.Render(source))
+	}
+}
@@ -5,10 +5,13 @@ import (
 	"io"
 	"os"
 
+	"github.com/hculpan/kabkey/pkg/diagnostic"
 	"github.com/hculpan/kabkey/pkg/evaluator"
 	"github.com/hculpan/kabkey/pkg/lexer"
 	"github.com/hculpan/kabkey/pkg/object"
+	"github.com/hculpan/kabkey/pkg/optimizer"
 	"github.com/hculpan/kabkey/pkg/parser"
+	"github.com/hculpan/kabkey/pkg/resolver"
 )
 
 func main() {
@@ -24,24 +27,37 @@ func main() {
 	}
 
 	l := lexer.NewLexer(input)
+	l.SetFilename(os.Args[1])
 	p := parser.NewParser(l)
 	program := p.ParseProgram()
 	if len(l.Errors()) > 0 {
-		printErrors(os.Stdout, l.Errors())
+		printDiagnostics(os.Stdout, input, l.Diagnostics())
 		os.Exit(1)
 	} else if len(p.Errors()) > 0 {
-		printErrors(os.Stdout, p.Errors())
+		printDiagnostics(os.Stdout, input, p.Diagnostics())
 		os.Exit(1)
 	}
 
+	opt := optimizer.New()
+	opt.Optimize(program)
+	if len(opt.Errors()) > 0 {
+		printDiagnostics(os.Stdout, input, opt.Diagnostics())
+		os.Exit(1)
+	}
+
+	resolver.Resolve(program)
+
 	env := object.NewEnvironment()
 	evaluator.LoadBuiltins(env)
-	evaluator.Eval(program, env)
+	if errObj, ok := evaluator.Eval(program, env).(*object.Error); ok {
+		fmt.Print(errObj.Render(input))
+		os.Exit(1)
+	}
 }
 
-func printErrors(out io.Writer, errors []string) {
-	for _, msg := range errors {
-		io.WriteString(out, "\t"+msg+"\n")
+func printDiagnostics(out io.Writer, source string, diagnostics []diagnostic.Diagnostic) {
+	for _, d := range diagnostics {
+		io.WriteString(out, d.Render(source))
 	}
 }
 
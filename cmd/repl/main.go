@@ -1,13 +1,20 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
+	"github.com/hculpan/kabkey/pkg/object"
 	"github.com/hculpan/kabkey/pkg/repl"
 )
 
 func main() {
+	brief := flag.Bool("brief", false, "show errors without their positions and call stack traces")
+	flag.Parse()
+
+	object.SetExtendedErrorOutput(!*brief)
+
 	fmt.Printf("Type in commands\n")
 	repl.Start(os.Stdin, os.Stdout)
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/hculpan/kabkey/pkg/compiler"
+	"github.com/hculpan/kabkey/pkg/object"
+	"github.com/hculpan/kabkey/pkg/vm"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Println("Missing file parameter")
+		os.Exit(1)
+	}
+
+	bytecode, err := loadExecutable(os.Args[1])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	machine := vm.New(bytecode)
+	if err := machine.Run(); err != nil {
+		if errObj, ok := err.(*object.Error); ok {
+			fmt.Print(errObj.Render(loadSource(bytecode.Filename)))
+		} else {
+			fmt.Println(err)
+		}
+		os.Exit(1)
+	}
+}
+
+func loadExecutable(filename string) (*compiler.Bytecode, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	bytecode, err := compiler.ReadExecutable(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	return bytecode, nil
+}
+
+// loadSource returns the source the executable was compiled from, for
+// showing errors in context. Errors are shown without it if it has gone.
+func loadSource(filename string) string {
+	if filename == "" {
+		return ""
+	}
+
+	source, err := os.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+
+	return string(source)
+}
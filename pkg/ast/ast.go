@@ -27,6 +27,13 @@ type Program struct {
 	Statements []Statement
 }
 
+// Scope describes the environment created for a function call or a for
+// loop: the slot assigned to each variable declared in it. It is filled in
+// by the resolver.
+type Scope struct {
+	Slots map[string]int
+}
+
 func (p *Program) TokenLiteral() string {
 	if len(p.Statements) > 0 {
 		return p.Statements[0].TokenLiteral()
@@ -47,6 +54,8 @@ func (p *Program) NodeToken() token.Token {
 	return token.Token{Literal: "", LineNo: 1, Position: 1}
 }
 
+// LetStatement binds Name to Value. A function declaration, fn name(...)
+// { ... }, is a let statement whose token is fn.
 type LetStatement struct {
 	Token token.Token
 	Name  *Identifier
@@ -66,6 +75,12 @@ func (ls *LetStatement) NodeToken() token.Token {
 func (ls *LetStatement) String() string {
 	var out bytes.Buffer
 
+	if fl, ok := ls.Value.(*FunctionLiteral); ok && ls.Token.Type == token.FUNCTION {
+		out.WriteString(fl.TokenLiteral() + " " + ls.Name.String())
+		fl.writeSignatureAndBody(&out)
+		return out.String()
+	}
+
 	out.WriteString(ls.TokenLiteral() + " ")
 	out.WriteString(ls.Name.String())
 	out.WriteString(" = ")
@@ -79,9 +94,104 @@ func (ls *LetStatement) String() string {
 	return out.String()
 }
 
+type AssignExpression struct {
+	Token token.Token
+	Name  *Identifier
+	Value Expression
+}
+
+func (ae *AssignExpression) expressionNode() {}
+
+func (ae *AssignExpression) TokenLiteral() string {
+	return ae.Token.Literal
+}
+
+func (ae *AssignExpression) NodeToken() token.Token {
+	return ae.Token
+}
+
+func (ae *AssignExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("(")
+	out.WriteString(ae.Name.String())
+	out.WriteString(" = ")
+	out.WriteString(ae.Value.String())
+	out.WriteString(")")
+
+	return out.String()
+}
+
+// CompoundAssignExpression is "name op= value". Operator holds the binary
+// operator without the trailing '=', e.g. "+" for "+=".
+type CompoundAssignExpression struct {
+	Token    token.Token
+	Name     *Identifier
+	Operator string
+	Value    Expression
+}
+
+func (ce *CompoundAssignExpression) expressionNode() {}
+
+func (ce *CompoundAssignExpression) TokenLiteral() string {
+	return ce.Token.Literal
+}
+
+func (ce *CompoundAssignExpression) NodeToken() token.Token {
+	return ce.Token
+}
+
+func (ce *CompoundAssignExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("(")
+	out.WriteString(ce.Name.String())
+	out.WriteString(" " + ce.Operator + "= ")
+	out.WriteString(ce.Value.String())
+	out.WriteString(")")
+
+	return out.String()
+}
+
+// IncrementExpression is "++name", "name++", "--name" or "name--". The
+// prefix form evaluates to the updated value, the postfix form to the
+// value before the update.
+type IncrementExpression struct {
+	Token    token.Token
+	Name     *Identifier
+	Operator string
+	Prefix   bool
+}
+
+func (ie *IncrementExpression) expressionNode() {}
+
+func (ie *IncrementExpression) TokenLiteral() string {
+	return ie.Token.Literal
+}
+
+func (ie *IncrementExpression) NodeToken() token.Token {
+	return ie.Token
+}
+
+func (ie *IncrementExpression) String() string {
+	if ie.Prefix {
+		return "(" + ie.Operator + ie.Name.String() + ")"
+	}
+
+	return "(" + ie.Name.String() + ie.Operator + ")"
+}
+
 type Identifier struct {
 	Token token.Token
 	Value string
+
+	// Resolved, Depth and Slot are filled in by the resolver. Depth counts
+	// environments outward from the one the identifier is evaluated in and
+	// Slot indexes that environment's slots, or is -1 when the variable
+	// lives in the global environment, which is looked up by name.
+	Resolved bool
+	Depth    int
+	Slot     int
 }
 
 func (i *Identifier) expressionNode() {}
@@ -125,6 +235,42 @@ func (rs *ReturnStatement) String() string {
 	return out.String()
 }
 
+type BreakStatement struct {
+	Token token.Token
+}
+
+func (bs *BreakStatement) statementNode() {}
+
+func (bs *BreakStatement) TokenLiteral() string {
+	return bs.Token.Literal
+}
+
+func (bs *BreakStatement) NodeToken() token.Token {
+	return bs.Token
+}
+
+func (bs *BreakStatement) String() string {
+	return bs.TokenLiteral() + ";"
+}
+
+type ContinueStatement struct {
+	Token token.Token
+}
+
+func (cs *ContinueStatement) statementNode() {}
+
+func (cs *ContinueStatement) TokenLiteral() string {
+	return cs.Token.Literal
+}
+
+func (cs *ContinueStatement) NodeToken() token.Token {
+	return cs.Token
+}
+
+func (cs *ContinueStatement) String() string {
+	return cs.TokenLiteral() + ";"
+}
+
 type ExpressionStatement struct {
 	Token      token.Token
 	Expression Expression
@@ -192,6 +338,25 @@ func (il *IntegerLiteral) String() string {
 	return il.Token.Literal
 }
 
+type FloatLiteral struct {
+	Token token.Token
+	Value float64
+}
+
+func (fl *FloatLiteral) expressionNode() {}
+
+func (fl *FloatLiteral) TokenLiteral() string {
+	return fl.Token.Literal
+}
+
+func (fl *FloatLiteral) NodeToken() token.Token {
+	return fl.Token
+}
+
+func (fl *FloatLiteral) String() string {
+	return fl.Token.Literal
+}
+
 type PrefixExpression struct {
 	Token    token.Token
 	Operator string
@@ -294,6 +459,80 @@ func (we *WhileExpression) String() string {
 	return out.String()
 }
 
+// ForExpression is the C-style loop "for (init; condition; post) { }".
+// Any of Init, Condition and Post may be nil.
+type ForExpression struct {
+	Token     token.Token
+	Init      Statement
+	Condition Expression
+	Post      Expression
+	Block     *BlockStatement
+	Scope     *Scope
+}
+
+func (fe *ForExpression) expressionNode() {}
+
+func (fe *ForExpression) TokenLiteral() string {
+	return fe.Token.Literal
+}
+
+func (fe *ForExpression) NodeToken() token.Token {
+	return fe.Token
+}
+
+func (fe *ForExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("for (")
+	if fe.Init != nil {
+		out.WriteString(strings.TrimSuffix(fe.Init.String(), ";"))
+	}
+	out.WriteString("; ")
+	if fe.Condition != nil {
+		out.WriteString(fe.Condition.String())
+	}
+	out.WriteString("; ")
+	if fe.Post != nil {
+		out.WriteString(fe.Post.String())
+	}
+	out.WriteString(") ")
+	out.WriteString(fe.Block.String())
+
+	return out.String()
+}
+
+// ForInExpression is "for (variable in iterable) { }".
+type ForInExpression struct {
+	Token    token.Token
+	Variable *Identifier
+	Iterable Expression
+	Block    *BlockStatement
+	Scope    *Scope
+}
+
+func (fi *ForInExpression) expressionNode() {}
+
+func (fi *ForInExpression) TokenLiteral() string {
+	return fi.Token.Literal
+}
+
+func (fi *ForInExpression) NodeToken() token.Token {
+	return fi.Token
+}
+
+func (fi *ForInExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("for (")
+	out.WriteString(fi.Variable.String())
+	out.WriteString(" in ")
+	out.WriteString(fi.Iterable.String())
+	out.WriteString(") ")
+	out.WriteString(fi.Block.String())
+
+	return out.String()
+}
+
 type IfExpression struct {
 	Token       token.Token
 	Condition   Expression
@@ -327,6 +566,58 @@ func (ie *IfExpression) String() string {
 	return out.String()
 }
 
+// MatchExpression evaluates to the body of the first arm with a pattern
+// equal to Subject, or null if no arm matches.
+type MatchExpression struct {
+	Token   token.Token
+	Subject Expression
+	Arms    []MatchArm
+}
+
+// MatchArm is an arm of a match expression. The default arm, written _,
+// has no patterns and matches any value. An arm whose body is a single
+// expression gets a block holding just that expression.
+type MatchArm struct {
+	Token    token.Token
+	Patterns []Expression
+	Body     *BlockStatement
+}
+
+func (me *MatchExpression) expressionNode() {}
+
+func (me *MatchExpression) TokenLiteral() string {
+	return me.Token.Literal
+}
+
+func (me *MatchExpression) NodeToken() token.Token {
+	return me.Token
+}
+
+func (me *MatchExpression) String() string {
+	var out bytes.Buffer
+
+	arms := []string{}
+	for _, arm := range me.Arms {
+		patterns := []string{}
+		for _, p := range arm.Patterns {
+			patterns = append(patterns, p.String())
+		}
+		if len(patterns) == 0 {
+			patterns = append(patterns, "_")
+		}
+
+		arms = append(arms, strings.Join(patterns, ", ")+" => "+arm.Body.String())
+	}
+
+	out.WriteString("match ")
+	out.WriteString(me.Subject.String())
+	out.WriteString(" {")
+	out.WriteString(strings.Join(arms, ", "))
+	out.WriteString("}")
+
+	return out.String()
+}
+
 type BlockStatement struct {
 	Token      token.Token
 	Statements []Statement
@@ -352,10 +643,14 @@ func (bs *BlockStatement) String() string {
 	return out.String()
 }
 
+// FunctionLiteral is a fn expression. Name is the name it is declared or
+// bound by let with, if any.
 type FunctionLiteral struct {
 	Token      token.Token
+	Name       string
 	Parameters []*Identifier
 	Body       *BlockStatement
+	Scope      *Scope
 }
 
 func (fl *FunctionLiteral) expressionNode() {}
@@ -371,18 +666,22 @@ func (fl *FunctionLiteral) NodeToken() token.Token {
 func (fl *FunctionLiteral) String() string {
 	var out bytes.Buffer
 
+	out.WriteString(fl.TokenLiteral())
+	fl.writeSignatureAndBody(&out)
+
+	return out.String()
+}
+
+func (fl *FunctionLiteral) writeSignatureAndBody(out *bytes.Buffer) {
 	params := []string{}
 	for _, p := range fl.Parameters {
 		params = append(params, p.String())
 	}
 
-	out.WriteString(fl.TokenLiteral())
 	out.WriteString("(")
 	out.WriteString(strings.Join(params, ", "))
 	out.WriteString(") ")
 	out.WriteString(fl.Body.String())
-
-	return out.String()
 }
 
 type CallExpression struct {
@@ -417,3 +716,96 @@ func (ce *CallExpression) String() string {
 
 	return out.String()
 }
+
+type ArrayLiteral struct {
+	Token    token.Token
+	Elements []Expression
+}
+
+func (al *ArrayLiteral) expressionNode() {}
+
+func (al *ArrayLiteral) TokenLiteral() string {
+	return al.Token.Literal
+}
+
+func (al *ArrayLiteral) NodeToken() token.Token {
+	return al.Token
+}
+
+func (al *ArrayLiteral) String() string {
+	var out bytes.Buffer
+
+	elements := []string{}
+	for _, el := range al.Elements {
+		elements = append(elements, el.String())
+	}
+
+	out.WriteString("[")
+	out.WriteString(strings.Join(elements, ", "))
+	out.WriteString("]")
+
+	return out.String()
+}
+
+type IndexExpression struct {
+	Token token.Token
+	Left  Expression
+	Index Expression
+}
+
+func (ie *IndexExpression) expressionNode() {}
+
+func (ie *IndexExpression) TokenLiteral() string {
+	return ie.Token.Literal
+}
+
+func (ie *IndexExpression) NodeToken() token.Token {
+	return ie.Token
+}
+
+func (ie *IndexExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("(")
+	out.WriteString(ie.Left.String())
+	out.WriteString("[")
+	out.WriteString(ie.Index.String())
+	out.WriteString("])")
+
+	return out.String()
+}
+
+type HashPair struct {
+	Key   Expression
+	Value Expression
+}
+
+type HashLiteral struct {
+	Token token.Token
+	Pairs []HashPair
+}
+
+func (hl *HashLiteral) expressionNode() {}
+
+func (hl *HashLiteral) TokenLiteral() string {
+	return hl.Token.Literal
+}
+
+func (hl *HashLiteral) NodeToken() token.Token {
+	return hl.Token
+}
+
+func (hl *HashLiteral) String() string {
+	var out bytes.Buffer
+
+	pairs := []string{}
+	for _, pair := range hl.Pairs {
+		pairs = append(pairs, pair.Key.String()+": "+pair.Value.String())
+	}
+
+	out.WriteString("{")
+	out.WriteString(strings.Join(pairs, ", "))
+	out.WriteString("}")
+
+	return out.String()
+}
@@ -0,0 +1,348 @@
+package code
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+type Instructions []byte
+
+type Opcode byte
+
+const (
+	OpConstant Opcode = iota
+	OpPop
+	OpTrue
+	OpFalse
+	OpNull
+
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpMod
+	OpEqual
+	OpNotEqual
+	OpLessThan
+	OpLessEqual
+	OpGreaterThan
+	OpGreaterEqual
+	OpMinus
+	OpBang
+
+	OpJump
+	OpJumpNotTruthy
+	OpJumpTruthy
+
+	OpGetGlobal
+	OpSetGlobal
+	OpAssignGlobal
+	OpGetLocal
+	OpSetLocal
+	OpGetFree
+	OpSetFree
+	OpGetBuiltin
+
+	OpArray
+	OpHash
+	OpIndex
+
+	OpClosure
+	OpCall
+	OpReturnValue
+	OpReturn
+
+	OpSwap
+	OpIter
+	OpIterNext
+	OpDup
+	OpTailCall
+)
+
+type Definition struct {
+	Name          string
+	OperandWidths []int
+}
+
+var definitions = map[Opcode]*Definition{
+	OpConstant: {"OpConstant", []int{2}},
+	OpPop:      {"OpPop", []int{}},
+	OpTrue:     {"OpTrue", []int{}},
+	OpFalse:    {"OpFalse", []int{}},
+	OpNull:     {"OpNull", []int{}},
+
+	OpAdd:          {"OpAdd", []int{}},
+	OpSub:          {"OpSub", []int{}},
+	OpMul:          {"OpMul", []int{}},
+	OpDiv:          {"OpDiv", []int{}},
+	OpMod:          {"OpMod", []int{}},
+	OpEqual:        {"OpEqual", []int{}},
+	OpNotEqual:     {"OpNotEqual", []int{}},
+	OpLessThan:     {"OpLessThan", []int{}},
+	OpLessEqual:    {"OpLessEqual", []int{}},
+	OpGreaterThan:  {"OpGreaterThan", []int{}},
+	OpGreaterEqual: {"OpGreaterEqual", []int{}},
+	OpMinus:        {"OpMinus", []int{}},
+	OpBang:         {"OpBang", []int{}},
+
+	OpJump:          {"OpJump", []int{2}},
+	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}},
+	OpJumpTruthy:    {"OpJumpTruthy", []int{2}},
+
+	OpGetGlobal:    {"OpGetGlobal", []int{2}},
+	OpSetGlobal:    {"OpSetGlobal", []int{2}},
+	OpAssignGlobal: {"OpAssignGlobal", []int{2}},
+	OpGetLocal:     {"OpGetLocal", []int{1}},
+	OpSetLocal:     {"OpSetLocal", []int{1}},
+	OpGetFree:      {"OpGetFree", []int{1}},
+	OpSetFree:      {"OpSetFree", []int{1}},
+	OpGetBuiltin:   {"OpGetBuiltin", []int{1}},
+
+	OpArray: {"OpArray", []int{2}},
+	OpHash:  {"OpHash", []int{2}},
+	OpIndex: {"OpIndex", []int{}},
+
+	OpClosure:     {"OpClosure", []int{2}},
+	OpCall:        {"OpCall", []int{1}},
+	OpReturnValue: {"OpReturnValue", []int{}},
+	OpReturn:      {"OpReturn", []int{}},
+
+	OpSwap:     {"OpSwap", []int{}},
+	OpIter:     {"OpIter", []int{}},
+	OpIterNext: {"OpIterNext", []int{2}},
+	OpDup:      {"OpDup", []int{}},
+	OpTailCall: {"OpTailCall", []int{1}},
+}
+
+func Lookup(op byte) (*Definition, error) {
+	def, ok := definitions[Opcode(op)]
+	if !ok {
+		return nil, fmt.Errorf("opcode %d undefined", op)
+	}
+
+	return def, nil
+}
+
+// Make encodes a single instruction. Operands are written big-endian using
+// the widths from the opcode's definition.
+func Make(op Opcode, operands ...int) []byte {
+	def, ok := definitions[op]
+	if !ok {
+		return []byte{}
+	}
+
+	instructionLen := 1
+	for _, w := range def.OperandWidths {
+		instructionLen += w
+	}
+
+	instruction := make([]byte, instructionLen)
+	instruction[0] = byte(op)
+
+	offset := 1
+	for i, o := range operands {
+		width := def.OperandWidths[i]
+		switch width {
+		case 2:
+			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
+		case 1:
+			instruction[offset] = byte(o)
+		}
+		offset += width
+	}
+
+	return instruction
+}
+
+// MaxOperand is the largest operand that fits in width bytes.
+func MaxOperand(width int) int {
+	return 1<<(8*width) - 1
+}
+
+// ReadOperands decodes the operands of an instruction whose opcode has
+// already been read, returning them and the number of bytes consumed.
+func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
+	operands := make([]int, len(def.OperandWidths))
+	offset := 0
+
+	for i, width := range def.OperandWidths {
+		switch width {
+		case 2:
+			operands[i] = int(ReadUint16(ins[offset:]))
+		case 1:
+			operands[i] = int(ReadUint8(ins[offset:]))
+		}
+		offset += width
+	}
+
+	return operands, offset
+}
+
+func ReadUint16(ins Instructions) uint16 {
+	return binary.BigEndian.Uint16(ins)
+}
+
+func ReadUint8(ins Instructions) uint8 {
+	return uint8(ins[0])
+}
+
+// String disassembles the instructions, one per line, with jump targets
+// shown as labels.
+func (ins Instructions) String() string {
+	return ins.Disassemble(nil)
+}
+
+// Symbols supplies what a disassembly needs beyond the instructions
+// themselves to describe operands: the rendered constant pool, the names
+// of variables by slot and the source positions of the instructions. Any
+// of them may be nil.
+type Symbols struct {
+	Constants []string
+	Globals   []string
+	Locals    []string
+	Free      []string
+	Builtins  []string
+	Positions PositionTable
+}
+
+// Disassemble renders the instructions like String, adding the value or
+// name each operand refers to and, when positions are known, the source
+// line each instruction came from. The line is printed in the first column
+// whenever it changes.
+func (ins Instructions) Disassemble(symbols *Symbols) string {
+	if symbols == nil {
+		symbols = &Symbols{}
+	}
+
+	var out bytes.Buffer
+
+	labels := ins.jumpLabels()
+	lastLine := -1
+
+	i := 0
+	for i < len(ins) {
+		def, err := Lookup(ins[i])
+		if err != nil {
+			fmt.Fprintf(&out, "ERROR: %s\n", err)
+			i++
+			continue
+		}
+
+		operands, read := ReadOperands(def, ins[i+1:])
+
+		if label, ok := labels[i]; ok {
+			fmt.Fprintf(&out, "%s:\n", label)
+		}
+
+		if symbols.Positions != nil {
+			lineNo, _ := symbols.Positions.Lookup(i)
+			if lineNo != lastLine {
+				fmt.Fprintf(&out, "%4d ", lineNo)
+				lastLine = lineNo
+			} else {
+				out.WriteString("     ")
+			}
+		}
+
+		fmt.Fprintf(&out, "%04d %s\n", i, fmtInstruction(Opcode(ins[i]), def, operands, labels, symbols))
+
+		i += 1 + read
+	}
+
+	return out.String()
+}
+
+func isJump(op Opcode) bool {
+	switch op {
+	case OpJump, OpJumpNotTruthy, OpJumpTruthy, OpIterNext:
+		return true
+	}
+
+	return false
+}
+
+// jumpLabels names every jump target L1, L2, ... in order of offset.
+func (ins Instructions) jumpLabels() map[int]string {
+	targets := map[int]bool{}
+
+	i := 0
+	for i < len(ins) {
+		def, err := Lookup(ins[i])
+		if err != nil {
+			i++
+			continue
+		}
+
+		operands, read := ReadOperands(def, ins[i+1:])
+		if isJump(Opcode(ins[i])) {
+			targets[operands[0]] = true
+		}
+
+		i += 1 + read
+	}
+
+	offsets := make([]int, 0, len(targets))
+	for offset := range targets {
+		offsets = append(offsets, offset)
+	}
+	sort.Ints(offsets)
+
+	labels := make(map[int]string, len(offsets))
+	for n, offset := range offsets {
+		labels[offset] = fmt.Sprintf("L%d", n+1)
+	}
+
+	return labels
+}
+
+func fmtInstruction(op Opcode, def *Definition, operands []int, labels map[int]string, symbols *Symbols) string {
+	operandCount := len(def.OperandWidths)
+
+	if len(operands) != operandCount {
+		return fmt.Sprintf("ERROR: operand len %d does not match defined %d\n", len(operands), operandCount)
+	}
+
+	switch operandCount {
+	case 0:
+		return def.Name
+	case 1:
+		if isJump(op) {
+			return fmt.Sprintf("%s %s", def.Name, labels[operands[0]])
+		}
+
+		if name := operandName(op, operands[0], symbols); name != "" {
+			return fmt.Sprintf("%s %d (%s)", def.Name, operands[0], name)
+		}
+
+		return fmt.Sprintf("%s %d", def.Name, operands[0])
+	}
+
+	return fmt.Sprintf("ERROR: unhandled operandCount for %s\n", def.Name)
+}
+
+// operandName returns what the operand of op refers to, or "" if that is
+// not known.
+func operandName(op Opcode, operand int, symbols *Symbols) string {
+	var names []string
+
+	switch op {
+	case OpConstant, OpClosure:
+		names = symbols.Constants
+	case OpGetGlobal, OpSetGlobal, OpAssignGlobal:
+		names = symbols.Globals
+	case OpGetLocal, OpSetLocal:
+		names = symbols.Locals
+	case OpGetFree, OpSetFree:
+		names = symbols.Free
+	case OpGetBuiltin:
+		names = symbols.Builtins
+	}
+
+	if operand < len(names) {
+		return names[operand]
+	}
+
+	return ""
+}
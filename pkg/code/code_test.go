@@ -0,0 +1,141 @@
+package code
+
+import "testing"
+
+func TestMake(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+		expected []byte
+	}{
+		{OpConstant, []int{65534}, []byte{byte(OpConstant), 255, 254}},
+		{OpAdd, []int{}, []byte{byte(OpAdd)}},
+		{OpGetLocal, []int{255}, []byte{byte(OpGetLocal), 255}},
+	}
+
+	for _, tt := range tests {
+		instruction := Make(tt.op, tt.operands...)
+
+		if len(instruction) != len(tt.expected) {
+			t.Errorf("instruction has wrong length. want=%d, got=%d", len(tt.expected), len(instruction))
+		}
+
+		for i, b := range tt.expected {
+			if instruction[i] != tt.expected[i] {
+				t.Errorf("wrong byte at pos %d. want=%d, got=%d", i, b, instruction[i])
+			}
+		}
+	}
+}
+
+func TestInstructionsString(t *testing.T) {
+	instructions := []Instructions{
+		Make(OpAdd),
+		Make(OpGetLocal, 1),
+		Make(OpConstant, 2),
+		Make(OpConstant, 65535),
+		Make(OpClosure, 65535),
+	}
+
+	expected := `0000 OpAdd
+0001 OpGetLocal 1
+0003 OpConstant 2
+0006 OpConstant 65535
+0009 OpClosure 65535
+`
+
+	concatted := Instructions{}
+	for _, ins := range instructions {
+		concatted = append(concatted, ins...)
+	}
+
+	if concatted.String() != expected {
+		t.Errorf("instructions wrongly formatted.\nwant=%q\ngot=%q", expected, concatted.String())
+	}
+}
+
+func TestInstructionsStringLabels(t *testing.T) {
+	instructions := []Instructions{
+		Make(OpTrue),
+		Make(OpJumpNotTruthy, 10),
+		Make(OpConstant, 0),
+		Make(OpJump, 0),
+		Make(OpNull),
+	}
+
+	expected := `L1:
+0000 OpTrue
+0001 OpJumpNotTruthy L2
+0004 OpConstant 0
+0007 OpJump L1
+L2:
+0010 OpNull
+`
+
+	concatted := Instructions{}
+	for _, ins := range instructions {
+		concatted = append(concatted, ins...)
+	}
+
+	if concatted.String() != expected {
+		t.Errorf("instructions wrongly formatted.\nwant=%q\ngot=%q", expected, concatted.String())
+	}
+}
+
+func TestReadOperands(t *testing.T) {
+	tests := []struct {
+		op        Opcode
+		operands  []int
+		bytesRead int
+	}{
+		{OpConstant, []int{65535}, 2},
+		{OpGetLocal, []int{255}, 1},
+	}
+
+	for _, tt := range tests {
+		instruction := Make(tt.op, tt.operands...)
+
+		def, err := Lookup(byte(tt.op))
+		if err != nil {
+			t.Fatalf("definition not found: %q\n", err)
+		}
+
+		operandsRead, n := ReadOperands(def, instruction[1:])
+		if n != tt.bytesRead {
+			t.Fatalf("n wrong. want=%d, got=%d", tt.bytesRead, n)
+		}
+
+		for i, want := range tt.operands {
+			if operandsRead[i] != want {
+				t.Errorf("operand wrong. want=%d, got=%d", want, operandsRead[i])
+			}
+		}
+	}
+}
+
+func TestPositionTableLookup(t *testing.T) {
+	pt := PositionTable{
+		{Offset: 0, LineNo: 1, Position: 1},
+		{Offset: 3, LineNo: 1, Position: 5},
+		{Offset: 4, LineNo: 2, Position: 3},
+	}
+
+	tests := []struct {
+		offset   int
+		lineNo   int
+		position int
+	}{
+		{0, 1, 1},
+		{2, 1, 1},
+		{3, 1, 5},
+		{9, 2, 3},
+	}
+
+	for _, tt := range tests {
+		lineNo, position := pt.Lookup(tt.offset)
+		if lineNo != tt.lineNo || position != tt.position {
+			t.Errorf("wrong position for offset %d. want=%d:%d, got=%d:%d",
+				tt.offset, tt.lineNo, tt.position, lineNo, position)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package code
+
+import "sort"
+
+// Position records where in the source the instruction starting at Offset
+// came from, and how many characters of its token to mark in diagnostics.
+type Position struct {
+	Offset   int
+	LineNo   int
+	Position int
+	Span     int
+}
+
+// PositionTable maps instruction offsets back to source positions. Entries
+// are kept in increasing offset order, one per emitted instruction.
+type PositionTable []Position
+
+// Lookup returns the source position of the instruction containing offset.
+func (pt PositionTable) Lookup(offset int) (lineNo, position int) {
+	entry := pt.Entry(offset)
+	return entry.LineNo, entry.Position
+}
+
+// Entry returns the entry for the instruction containing offset, or the
+// zero Position if there is none.
+func (pt PositionTable) Entry(offset int) Position {
+	i := sort.Search(len(pt), func(i int) bool { return pt[i].Offset > offset })
+	if i == 0 {
+		return Position{}
+	}
+
+	return pt[i-1]
+}
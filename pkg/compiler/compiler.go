@@ -0,0 +1,1014 @@
+package compiler
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/hculpan/kabkey/pkg/ast"
+	"github.com/hculpan/kabkey/pkg/code"
+	"github.com/hculpan/kabkey/pkg/evaluator"
+	"github.com/hculpan/kabkey/pkg/object"
+	"github.com/hculpan/kabkey/pkg/token"
+)
+
+// iteratorName is the hidden variable holding a for-in loop's iterator.
+// It cannot clash with user names since '$' is not a letter.
+const iteratorName = "$iter"
+
+type Bytecode struct {
+	Instructions code.Instructions
+	Positions    code.PositionTable
+	Constants    []object.Object
+	GlobalNames  []string
+	// BuiltinNames are the builtins that OpGetBuiltin operands index.
+	BuiltinNames []string
+	Filename     string
+}
+
+type EmittedInstruction struct {
+	Opcode   code.Opcode
+	Position int
+}
+
+type loopContext struct {
+	breaks    []int
+	continues []int
+	// depth is the number of operands on the stack inside the loop body,
+	// counting the loop value.
+	depth int
+}
+
+type CompilationScope struct {
+	instructions        code.Instructions
+	positions           code.PositionTable
+	lastInstruction     EmittedInstruction
+	previousInstruction EmittedInstruction
+	loops               []*loopContext
+	// operands counts the values pushed by enclosing expressions that are
+	// still being compiled, such as the left side of an infix expression
+	// while its right side is compiled.
+	operands int
+}
+
+type Compiler struct {
+	constants    []object.Object
+	symbolTable  *SymbolTable
+	builtinNames []string
+
+	scopes     []CompilationScope
+	scopeIndex int
+
+	// err is the first operand found not to fit its instruction. emit
+	// has no error to return, so Compile reports it.
+	err error
+}
+
+func New() *Compiler {
+	builtinNames := evaluator.BuiltinNames()
+
+	symbolTable := NewSymbolTable()
+	for i, name := range builtinNames {
+		symbolTable.DefineBuiltin(i, name)
+	}
+
+	return &Compiler{
+		constants:    []object.Object{},
+		symbolTable:  symbolTable,
+		builtinNames: builtinNames,
+		scopes:       []CompilationScope{{}},
+		scopeIndex:   0,
+	}
+}
+
+func (c *Compiler) Bytecode() *Bytecode {
+	return &Bytecode{
+		Instructions: c.currentInstructions(),
+		Positions:    c.scopes[c.scopeIndex].positions,
+		Constants:    c.constants,
+		GlobalNames:  c.symbolTable.Names(),
+		BuiltinNames: c.builtinNames,
+	}
+}
+
+func (c *Compiler) Compile(node ast.Node) error {
+	if err := c.compile(node); err != nil {
+		return err
+	}
+
+	return c.err
+}
+
+func (c *Compiler) compile(node ast.Node) error {
+	switch node := node.(type) {
+	case *ast.Program:
+		for _, s := range node.Statements {
+			if err := c.Compile(s); err != nil {
+				return err
+			}
+		}
+
+		// The program's value is the last value popped at the top level, so
+		// make sure a trailing let leaves null behind like the evaluator.
+		n := len(node.Statements)
+		if n == 0 || !isExpressionStatement(node.Statements[n-1]) {
+			c.emit(node.NodeToken(), code.OpNull)
+			c.emit(node.NodeToken(), code.OpPop)
+		}
+	case *ast.ExpressionStatement:
+		if err := c.Compile(node.Expression); err != nil {
+			return err
+		}
+		c.emit(node.Token, code.OpPop)
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			if err := c.Compile(s); err != nil {
+				return err
+			}
+		}
+	case *ast.LetStatement:
+		return c.compileLetStatement(node)
+	case *ast.ReturnStatement:
+		if node.ReturnValue == nil {
+			c.emit(node.Token, code.OpReturn)
+			return nil
+		}
+		if err := c.compileTailExpression(node.ReturnValue); err != nil {
+			return err
+		}
+		c.emit(node.Token, code.OpReturnValue)
+	case *ast.BreakStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return c.errorAt(node.Token, "'break' outside of loop")
+		}
+		c.popOperands(node.Token, loop)
+		loop.breaks = append(loop.breaks, c.emit(node.Token, code.OpJump, 9999))
+	case *ast.ContinueStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return c.errorAt(node.Token, "'continue' outside of loop")
+		}
+		c.popOperands(node.Token, loop)
+		loop.continues = append(loop.continues, c.emit(node.Token, code.OpJump, 9999))
+	case *ast.Identifier:
+		c.loadSymbol(node.Token, c.resolve(node.Value))
+	case *ast.AssignExpression:
+		return c.compileAssignExpression(node)
+	case *ast.CompoundAssignExpression:
+		return c.compileCompoundAssignExpression(node)
+	case *ast.IncrementExpression:
+		return c.compileIncrementExpression(node)
+	case *ast.PrefixExpression:
+		if err := c.Compile(node.Right); err != nil {
+			return err
+		}
+
+		switch node.Operator {
+		case "-":
+			c.emit(node.Right.NodeToken(), code.OpMinus)
+		case "!":
+			c.emit(node.Token, code.OpBang)
+		default:
+			return c.errorAt(node.Token, "unknown operator: %s", node.Operator)
+		}
+	case *ast.InfixExpression:
+		return c.compileInfixExpression(node)
+	case *ast.IfExpression:
+		return c.compileIfExpression(node, false)
+	case *ast.MatchExpression:
+		return c.compileMatchExpression(node, false)
+	case *ast.WhileExpression:
+		return c.compileWhileExpression(node)
+	case *ast.ForExpression:
+		return c.compileForExpression(node)
+	case *ast.ForInExpression:
+		return c.compileForInExpression(node)
+	case *ast.IntegerLiteral:
+		c.emit(node.Token, code.OpConstant, c.addConstant(&object.Integer{Value: node.Value}))
+	case *ast.FloatLiteral:
+		c.emit(node.Token, code.OpConstant, c.addConstant(&object.Float{Value: node.Value}))
+	case *ast.StringLiteral:
+		c.emit(node.Token, code.OpConstant, c.addConstant(&object.String{Value: node.Value}))
+	case *ast.Boolean:
+		if node.Value {
+			c.emit(node.Token, code.OpTrue)
+		} else {
+			c.emit(node.Token, code.OpFalse)
+		}
+	case *ast.ArrayLiteral:
+		for i, el := range node.Elements {
+			if err := c.compileOperand(el, i); err != nil {
+				return err
+			}
+		}
+		c.emit(node.Token, code.OpArray, len(node.Elements))
+	case *ast.HashLiteral:
+		for i, pair := range node.Pairs {
+			if err := c.compileOperand(pair.Key, 2*i); err != nil {
+				return err
+			}
+			if err := c.compileOperand(pair.Value, 2*i+1); err != nil {
+				return err
+			}
+		}
+		c.emit(node.Token, code.OpHash, len(node.Pairs)*2)
+	case *ast.IndexExpression:
+		if err := c.Compile(node.Left); err != nil {
+			return err
+		}
+		if err := c.compileOperand(node.Index, 1); err != nil {
+			return err
+		}
+		c.emit(node.Index.NodeToken(), code.OpIndex)
+	case *ast.FunctionLiteral:
+		return c.compileFunctionLiteral(node, node.Name)
+	case *ast.CallExpression:
+		return c.compileCallExpression(node, false)
+	default:
+		return fmt.Errorf("unable to compile node of type %T", node)
+	}
+
+	return nil
+}
+
+func (c *Compiler) compileLetStatement(node *ast.LetStatement) error {
+	var symbol Symbol
+
+	// A function is bound before its body is compiled so that it can refer
+	// to itself; any other value is compiled first so that "let a = a + 1"
+	// still reads the outer a.
+	if fn, ok := node.Value.(*ast.FunctionLiteral); ok {
+		symbol = c.symbolTable.Define(node.Name.Value)
+		if err := c.compileFunctionLiteral(fn, node.Name.Value); err != nil {
+			return err
+		}
+	} else {
+		if err := c.Compile(node.Value); err != nil {
+			return err
+		}
+		symbol = c.symbolTable.Define(node.Name.Value)
+	}
+
+	c.storeSymbol(node.Name.Token, symbol)
+
+	return nil
+}
+
+func (c *Compiler) compileAssignExpression(node *ast.AssignExpression) error {
+	if err := c.Compile(node.Value); err != nil {
+		return err
+	}
+
+	symbol, ok := c.symbolTable.Resolve(node.Name.Value)
+	switch {
+	case !ok:
+		symbol = c.symbolTable.DefineGlobal(node.Name.Value)
+		c.emit(node.Name.Token, code.OpAssignGlobal, symbol.Index)
+	case symbol.Scope == BuiltinScope:
+		symbol = c.symbolTable.DefineGlobal(node.Name.Value)
+		c.storeSymbol(node.Name.Token, symbol)
+	case symbol.Scope == GlobalScope:
+		c.emit(node.Name.Token, code.OpAssignGlobal, symbol.Index)
+	default:
+		c.storeSymbol(node.Name.Token, symbol)
+	}
+
+	c.loadSymbol(node.Name.Token, symbol)
+
+	return nil
+}
+
+func (c *Compiler) compileCompoundAssignExpression(node *ast.CompoundAssignExpression) error {
+	symbol := c.resolve(node.Name.Value)
+	c.loadSymbol(node.Name.Token, symbol)
+
+	if err := c.compileOperand(node.Value, 1); err != nil {
+		return err
+	}
+
+	op, ok := arithmeticOpcodes[node.Operator]
+	if !ok {
+		return c.errorAt(node.Token, "unknown operator: %s=", node.Operator)
+	}
+	c.emit(node.Token, op)
+
+	c.storeSymbol(node.Name.Token, symbol)
+	c.loadSymbol(node.Name.Token, symbol)
+
+	return nil
+}
+
+func (c *Compiler) compileIncrementExpression(node *ast.IncrementExpression) error {
+	symbol := c.resolve(node.Name.Value)
+
+	op := code.OpAdd
+	if node.Operator == "--" {
+		op = code.OpSub
+	}
+
+	// The postfix form leaves the original value underneath the update.
+	c.loadSymbol(node.Name.Token, symbol)
+	if !node.Prefix {
+		c.loadSymbol(node.Name.Token, symbol)
+	}
+
+	c.emit(node.Token, code.OpConstant, c.addConstant(&object.Integer{Value: 1}))
+	c.emit(node.Token, op)
+	c.storeSymbol(node.Name.Token, symbol)
+
+	if node.Prefix {
+		c.loadSymbol(node.Name.Token, symbol)
+	}
+
+	return nil
+}
+
+var arithmeticOpcodes = map[string]code.Opcode{
+	"+": code.OpAdd,
+	"-": code.OpSub,
+	"*": code.OpMul,
+	"/": code.OpDiv,
+	"%": code.OpMod,
+}
+
+var comparisonOpcodes = map[string]code.Opcode{
+	"==": code.OpEqual,
+	"!=": code.OpNotEqual,
+	"<":  code.OpLessThan,
+	"<=": code.OpLessEqual,
+	">":  code.OpGreaterThan,
+	">=": code.OpGreaterEqual,
+}
+
+func (c *Compiler) compileInfixExpression(node *ast.InfixExpression) error {
+	if node.Operator == "&&" || node.Operator == "||" {
+		return c.compileLogicalExpression(node)
+	}
+
+	if err := c.Compile(node.Left); err != nil {
+		return err
+	}
+
+	if err := c.compileOperand(node.Right, 1); err != nil {
+		return err
+	}
+
+	op, ok := arithmeticOpcodes[node.Operator]
+	if !ok {
+		op, ok = comparisonOpcodes[node.Operator]
+	}
+	if !ok {
+		return c.errorAt(node.Token, "unknown operator: %s", node.Operator)
+	}
+
+	c.emit(node.Token, op)
+
+	return nil
+}
+
+// compileLogicalExpression emits short-circuit code for && and ||. As in
+// the evaluator the result is always a Boolean: when the right operand
+// decides, it is normalised with two OpBang instructions.
+func (c *Compiler) compileLogicalExpression(node *ast.InfixExpression) error {
+	if err := c.Compile(node.Left); err != nil {
+		return err
+	}
+
+	shortCircuit, decided := code.OpJumpNotTruthy, code.OpFalse
+	if node.Operator == "||" {
+		shortCircuit, decided = code.OpJumpTruthy, code.OpTrue
+	}
+
+	jumpShort := c.emit(node.Token, shortCircuit, 9999)
+
+	if err := c.Compile(node.Right); err != nil {
+		return err
+	}
+	c.emit(node.Token, code.OpBang)
+	c.emit(node.Token, code.OpBang)
+
+	jumpEnd := c.emit(node.Token, code.OpJump, 9999)
+
+	c.changeOperand(jumpShort, len(c.currentInstructions()))
+	c.emit(node.Token, decided)
+
+	c.changeOperand(jumpEnd, len(c.currentInstructions()))
+
+	return nil
+}
+
+// compileCallExpression compiles a call, as a tail call if it is in tail
+// position.
+func (c *Compiler) compileCallExpression(node *ast.CallExpression, tail bool) error {
+	if err := c.Compile(node.Function); err != nil {
+		return err
+	}
+
+	for i, a := range node.Arguments {
+		if err := c.compileOperand(a, i+1); err != nil {
+			return err
+		}
+	}
+
+	op := code.OpCall
+	if tail {
+		op = code.OpTailCall
+	}
+	c.emit(node.Token, op, len(node.Arguments))
+
+	return nil
+}
+
+// compileTailExpression compiles an expression whose value is the value of
+// the function it is in. As in the evaluator, calls there, including those
+// ending a branch of an if or match expression, are tail calls that do not
+// nest. A return at the top level ends the program rather than a call, so
+// it makes ordinary calls.
+func (c *Compiler) compileTailExpression(node ast.Expression) error {
+	if c.scopeIndex == 0 {
+		return c.Compile(node)
+	}
+
+	switch node := node.(type) {
+	case *ast.CallExpression:
+		return c.compileCallExpression(node, true)
+	case *ast.IfExpression:
+		return c.compileIfExpression(node, true)
+	case *ast.MatchExpression:
+		return c.compileMatchExpression(node, true)
+	}
+
+	return c.Compile(node)
+}
+
+func (c *Compiler) compileIfExpression(node *ast.IfExpression, tail bool) error {
+	if err := c.Compile(node.Condition); err != nil {
+		return err
+	}
+
+	jumpNotTruthy := c.emit(node.Token, code.OpJumpNotTruthy, 9999)
+
+	if err := c.compileBlockValue(node.Consequence, tail); err != nil {
+		return err
+	}
+
+	jump := c.emit(node.Token, code.OpJump, 9999)
+
+	c.changeOperand(jumpNotTruthy, len(c.currentInstructions()))
+
+	if node.Alternative == nil {
+		c.emit(node.Token, code.OpNull)
+	} else if err := c.compileBlockValue(node.Alternative, tail); err != nil {
+		return err
+	}
+
+	c.changeOperand(jump, len(c.currentInstructions()))
+
+	return nil
+}
+
+// compileMatchExpression keeps the subject on the stack while the patterns
+// are compared with it, each against a copy made by OpDup. The subject is
+// popped before the body of the matching arm runs, or before null is
+// pushed if no arm matches.
+func (c *Compiler) compileMatchExpression(node *ast.MatchExpression, tail bool) error {
+	if err := c.Compile(node.Subject); err != nil {
+		return err
+	}
+
+	ends := []int{}
+	for _, arm := range node.Arms {
+		matched := []int{}
+		for _, pattern := range arm.Patterns {
+			c.emit(pattern.NodeToken(), code.OpDup)
+			if err := c.compileOperand(pattern, 2); err != nil {
+				return err
+			}
+			c.emit(pattern.NodeToken(), code.OpEqual)
+			matched = append(matched, c.emit(pattern.NodeToken(), code.OpJumpTruthy, 9999))
+		}
+
+		next := -1
+		if len(arm.Patterns) > 0 {
+			next = c.emit(arm.Token, code.OpJump, 9999)
+		}
+
+		for _, pos := range matched {
+			c.changeOperand(pos, len(c.currentInstructions()))
+		}
+
+		c.emit(arm.Token, code.OpPop)
+		if err := c.compileBlockValue(arm.Body, tail); err != nil {
+			return err
+		}
+		ends = append(ends, c.emit(arm.Token, code.OpJump, 9999))
+
+		if next >= 0 {
+			c.changeOperand(next, len(c.currentInstructions()))
+		}
+	}
+
+	c.emit(node.Token, code.OpPop)
+	c.emit(node.Token, code.OpNull)
+
+	for _, pos := range ends {
+		c.changeOperand(pos, len(c.currentInstructions()))
+	}
+
+	return nil
+}
+
+// Loops are expressions whose value is that of the last completed
+// iteration, or null if the body never ran. The value is kept on the stack
+// while the loop runs: each iteration pushes the body's value, then OpSwap
+// and OpPop discard the previous one. break and continue may come from
+// inside an expression, as in f(x, if (c) { continue }), so they first pop
+// any operands above the loop value.
+
+func (c *Compiler) compileWhileExpression(node *ast.WhileExpression) error {
+	c.emit(node.Token, code.OpNull)
+
+	conditionPos := len(c.currentInstructions())
+	if err := c.compileOperand(node.Condition, 1); err != nil {
+		return err
+	}
+
+	jumpNotTruthy := c.emit(node.Token, code.OpJumpNotTruthy, 9999)
+
+	loop := c.enterLoop()
+	if err := c.compileLoopBody(node.Block); err != nil {
+		return err
+	}
+	c.emit(node.Token, code.OpJump, conditionPos)
+	c.leaveLoop()
+
+	end := len(c.currentInstructions())
+	c.changeOperand(jumpNotTruthy, end)
+	c.patchLoop(loop, conditionPos, end)
+
+	return nil
+}
+
+func (c *Compiler) compileForExpression(node *ast.ForExpression) error {
+	c.enterBlockScope()
+	defer c.leaveBlockScope()
+
+	if node.Init != nil {
+		if err := c.Compile(node.Init); err != nil {
+			return err
+		}
+	}
+
+	c.emit(node.Token, code.OpNull)
+
+	conditionPos := len(c.currentInstructions())
+	jumpNotTruthy := -1
+	if node.Condition != nil {
+		if err := c.compileOperand(node.Condition, 1); err != nil {
+			return err
+		}
+		jumpNotTruthy = c.emit(node.Token, code.OpJumpNotTruthy, 9999)
+	}
+
+	c.declareLets(node.Block.Statements)
+
+	loop := c.enterLoop()
+	if err := c.compileLoopBody(node.Block); err != nil {
+		return err
+	}
+
+	postPos := len(c.currentInstructions())
+	if node.Post != nil {
+		if err := c.Compile(node.Post); err != nil {
+			return err
+		}
+		c.emit(node.Token, code.OpPop)
+	}
+	c.emit(node.Token, code.OpJump, conditionPos)
+	c.leaveLoop()
+
+	end := len(c.currentInstructions())
+	if jumpNotTruthy >= 0 {
+		c.changeOperand(jumpNotTruthy, end)
+	}
+	c.patchLoop(loop, postPos, end)
+
+	return nil
+}
+
+func (c *Compiler) compileForInExpression(node *ast.ForInExpression) error {
+	if err := c.Compile(node.Iterable); err != nil {
+		return err
+	}
+	c.emit(node.Iterable.NodeToken(), code.OpIter)
+
+	c.enterBlockScope()
+	defer c.leaveBlockScope()
+
+	iterator := c.symbolTable.Define(iteratorName)
+	c.storeSymbol(node.Token, iterator)
+
+	variable := c.symbolTable.Define(node.Variable.Value)
+	c.declareLets(node.Block.Statements)
+
+	c.emit(node.Token, code.OpNull)
+
+	nextPos := len(c.currentInstructions())
+	c.loadSymbol(node.Token, iterator)
+	iterNext := c.emit(node.Token, code.OpIterNext, 9999)
+	c.storeSymbol(node.Variable.Token, variable)
+
+	loop := c.enterLoop()
+	if err := c.compileLoopBody(node.Block); err != nil {
+		return err
+	}
+	c.emit(node.Token, code.OpJump, nextPos)
+	c.leaveLoop()
+
+	end := len(c.currentInstructions())
+	c.changeOperand(iterNext, end)
+	c.patchLoop(loop, nextPos, end)
+
+	return nil
+}
+
+func (c *Compiler) compileLoopBody(block *ast.BlockStatement) error {
+	if err := c.compileBlockValue(block, false); err != nil {
+		return err
+	}
+
+	c.emit(block.Token, code.OpSwap)
+	c.emit(block.Token, code.OpPop)
+
+	return nil
+}
+
+// compileBlockValue compiles a block so that it leaves its value on the
+// stack: the value of its final expression statement, or null. With tail
+// set, that expression is in tail position.
+func (c *Compiler) compileBlockValue(block *ast.BlockStatement, tail bool) error {
+	if err := c.compileStatements(block, tail); err != nil {
+		return err
+	}
+
+	n := len(block.Statements)
+	if n > 0 && isExpressionStatement(block.Statements[n-1]) && c.lastInstructionIs(code.OpPop) {
+		c.removeLastPop()
+	} else {
+		c.emit(block.Token, code.OpNull)
+	}
+
+	return nil
+}
+
+// compileStatements compiles the statements of block, with the final one in
+// tail position if tail is set and it is an expression statement.
+func (c *Compiler) compileStatements(block *ast.BlockStatement, tail bool) error {
+	for i, stmt := range block.Statements {
+		es, ok := stmt.(*ast.ExpressionStatement)
+		if !tail || !ok || i < len(block.Statements)-1 {
+			if err := c.Compile(stmt); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := c.compileTailExpression(es.Expression); err != nil {
+			return err
+		}
+		c.emit(es.Token, code.OpPop)
+	}
+
+	return nil
+}
+
+func (c *Compiler) compileFunctionLiteral(node *ast.FunctionLiteral, name string) error {
+	c.enterScope()
+
+	for _, p := range node.Parameters {
+		c.symbolTable.Define(p.Value)
+	}
+	c.declareLets(node.Body.Statements)
+
+	if err := c.compileStatements(node.Body, true); err != nil {
+		return err
+	}
+
+	n := len(node.Body.Statements)
+	if n > 0 && isExpressionStatement(node.Body.Statements[n-1]) && c.lastInstructionIs(code.OpPop) {
+		c.replaceLastPopWithReturn()
+	}
+	if !c.lastInstructionIs(code.OpReturnValue) {
+		c.emit(node.Body.Token, code.OpReturn)
+	}
+
+	freeSymbols := c.symbolTable.FreeSymbols
+	numLocals := c.symbolTable.NumDefinitions()
+	localNames := c.symbolTable.Names()
+	positions := c.scopes[c.scopeIndex].positions
+	instructions := c.leaveScope()
+
+	captures := make([]object.Capture, len(freeSymbols))
+	freeNames := make([]string, len(freeSymbols))
+	for i, s := range freeSymbols {
+		captures[i] = object.Capture{Local: s.Scope == LocalScope, Index: s.Index}
+		freeNames[i] = s.Name
+	}
+
+	compiledFn := &object.CompiledFunction{
+		Name:          name,
+		Instructions:  instructions,
+		Positions:     positions,
+		NumLocals:     numLocals,
+		NumParameters: len(node.Parameters),
+		Captures:      captures,
+		LocalNames:    localNames,
+		FreeNames:     freeNames,
+		Body:          node.Body.String(),
+	}
+
+	c.emit(node.Token, code.OpClosure, c.addConstant(compiledFn))
+
+	return nil
+}
+
+// declareLets declares the names bound by let statements in stmts with the
+// current symbol table. The blocks of if, match and while expressions share
+// their enclosing scope, so their let statements are included too.
+func (c *Compiler) declareLets(stmts []ast.Statement) {
+	for _, stmt := range stmts {
+		var expr ast.Expression
+
+		switch stmt := stmt.(type) {
+		case *ast.LetStatement:
+			c.symbolTable.Declare(stmt.Name.Value)
+			expr = stmt.Value
+		case *ast.ExpressionStatement:
+			expr = stmt.Expression
+		case *ast.ReturnStatement:
+			expr = stmt.ReturnValue
+		}
+
+		switch expr := expr.(type) {
+		case *ast.IfExpression:
+			c.declareLets(expr.Consequence.Statements)
+			if expr.Alternative != nil {
+				c.declareLets(expr.Alternative.Statements)
+			}
+		case *ast.MatchExpression:
+			for _, arm := range expr.Arms {
+				c.declareLets(arm.Body.Statements)
+			}
+		case *ast.WhileExpression:
+			c.declareLets(expr.Block.Statements)
+		}
+	}
+}
+
+// resolve looks up name, binding it as a global if it is not visible yet.
+// This mirrors the evaluator's late binding: a function may use a global
+// that is only defined after the function itself, and reading it before
+// it is set is a runtime error.
+func (c *Compiler) resolve(name string) Symbol {
+	symbol, ok := c.symbolTable.Resolve(name)
+	if !ok {
+		symbol = c.symbolTable.DefineGlobal(name)
+	}
+
+	return symbol
+}
+
+func (c *Compiler) loadSymbol(tok token.Token, s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(tok, code.OpGetGlobal, s.Index)
+	case LocalScope:
+		c.emit(tok, code.OpGetLocal, s.Index)
+	case BuiltinScope:
+		c.emit(tok, code.OpGetBuiltin, s.Index)
+	case FreeScope:
+		c.emit(tok, code.OpGetFree, s.Index)
+	}
+}
+
+func (c *Compiler) storeSymbol(tok token.Token, s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(tok, code.OpSetGlobal, s.Index)
+	case LocalScope:
+		c.emit(tok, code.OpSetLocal, s.Index)
+	case FreeScope:
+		c.emit(tok, code.OpSetFree, s.Index)
+	}
+}
+
+func (c *Compiler) addConstant(obj object.Object) int {
+	c.constants = append(c.constants, obj)
+	return len(c.constants) - 1
+}
+
+// emit appends an instruction, recording tok as its source position, and
+// returns the instruction's offset.
+func (c *Compiler) emit(tok token.Token, op code.Opcode, operands ...int) int {
+	c.checkOperands(tok, op, operands)
+
+	ins := code.Make(op, operands...)
+	pos := c.addInstruction(ins)
+
+	scope := &c.scopes[c.scopeIndex]
+	scope.positions = append(scope.positions, code.Position{
+		Offset:   pos,
+		LineNo:   tok.LineNo,
+		Position: tok.Position,
+		Span:     utf8.RuneCountInString(tok.Literal),
+	})
+
+	c.setLastInstruction(op, pos)
+
+	return pos
+}
+
+// operandLimits describes what an operand too large for its instruction
+// stands for, by opcode.
+var operandLimits = map[code.Opcode]string{
+	code.OpConstant:      "too many constants",
+	code.OpClosure:       "too many constants",
+	code.OpJump:          "too much code to jump over",
+	code.OpJumpNotTruthy: "too much code to jump over",
+	code.OpJumpTruthy:    "too much code to jump over",
+	code.OpIterNext:      "too much code to jump over",
+	code.OpGetGlobal:     "too many global variables",
+	code.OpSetGlobal:     "too many global variables",
+	code.OpAssignGlobal:  "too many global variables",
+	code.OpGetLocal:      "too many local variables in function",
+	code.OpSetLocal:      "too many local variables in function",
+	code.OpGetFree:       "too many captured variables in function",
+	code.OpSetFree:       "too many captured variables in function",
+	code.OpGetBuiltin:    "too many builtins",
+	code.OpArray:         "too many elements in array literal",
+	code.OpHash:          "too many pairs in hash literal",
+	code.OpCall:          "too many arguments in call",
+	code.OpTailCall:      "too many arguments in call",
+}
+
+// checkOperands records an error if an operand does not fit the width
+// its instruction gives it, rather than letting code.Make cut it short.
+func (c *Compiler) checkOperands(tok token.Token, op code.Opcode, operands []int) {
+	def, err := code.Lookup(byte(op))
+	if err != nil || c.err != nil {
+		return
+	}
+
+	for i, operand := range operands {
+		if operand > code.MaxOperand(def.OperandWidths[i]) {
+			c.err = c.errorAt(tok, "%s", operandLimits[op])
+			return
+		}
+	}
+}
+
+func (c *Compiler) addInstruction(ins []byte) int {
+	posNewInstruction := len(c.currentInstructions())
+	c.scopes[c.scopeIndex].instructions = append(c.currentInstructions(), ins...)
+	return posNewInstruction
+}
+
+func (c *Compiler) setLastInstruction(op code.Opcode, pos int) {
+	previous := c.scopes[c.scopeIndex].lastInstruction
+	last := EmittedInstruction{Opcode: op, Position: pos}
+
+	c.scopes[c.scopeIndex].previousInstruction = previous
+	c.scopes[c.scopeIndex].lastInstruction = last
+}
+
+func (c *Compiler) currentInstructions() code.Instructions {
+	return c.scopes[c.scopeIndex].instructions
+}
+
+func (c *Compiler) lastInstructionIs(op code.Opcode) bool {
+	if len(c.currentInstructions()) == 0 {
+		return false
+	}
+
+	return c.scopes[c.scopeIndex].lastInstruction.Opcode == op
+}
+
+func (c *Compiler) removeLastPop() {
+	scope := &c.scopes[c.scopeIndex]
+
+	scope.instructions = scope.instructions[:scope.lastInstruction.Position]
+	scope.positions = scope.positions[:len(scope.positions)-1]
+	scope.lastInstruction = scope.previousInstruction
+}
+
+func (c *Compiler) replaceLastPopWithReturn() {
+	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
+	c.replaceInstruction(lastPos, code.Make(code.OpReturnValue))
+
+	c.scopes[c.scopeIndex].lastInstruction.Opcode = code.OpReturnValue
+}
+
+func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
+	ins := c.currentInstructions()
+
+	for i := 0; i < len(newInstruction); i++ {
+		ins[pos+i] = newInstruction[i]
+	}
+}
+
+func (c *Compiler) changeOperand(opPos int, operand int) {
+	op := code.Opcode(c.currentInstructions()[opPos])
+	lineNo, position := c.scopes[c.scopeIndex].positions.Lookup(opPos)
+	c.checkOperands(token.Token{LineNo: lineNo, Position: position}, op, []int{operand})
+
+	newInstruction := code.Make(op, operand)
+
+	c.replaceInstruction(opPos, newInstruction)
+}
+
+func (c *Compiler) enterScope() {
+	c.scopes = append(c.scopes, CompilationScope{})
+	c.scopeIndex++
+
+	c.symbolTable = NewEnclosedSymbolTable(c.symbolTable)
+}
+
+func (c *Compiler) leaveScope() code.Instructions {
+	instructions := c.currentInstructions()
+
+	c.scopes = c.scopes[:len(c.scopes)-1]
+	c.scopeIndex--
+
+	c.symbolTable = c.symbolTable.Outer
+
+	return instructions
+}
+
+func (c *Compiler) enterBlockScope() {
+	c.symbolTable = NewBlockSymbolTable(c.symbolTable)
+}
+
+func (c *Compiler) leaveBlockScope() {
+	c.symbolTable = c.symbolTable.Outer
+}
+
+// enterLoop is called once the loop value has been pushed, and counts it
+// as an operand until leaveLoop.
+func (c *Compiler) enterLoop() *loopContext {
+	scope := &c.scopes[c.scopeIndex]
+	scope.operands++
+	loop := &loopContext{depth: scope.operands}
+	scope.loops = append(scope.loops, loop)
+	return loop
+}
+
+func (c *Compiler) leaveLoop() {
+	scope := &c.scopes[c.scopeIndex]
+	scope.operands--
+	scope.loops = scope.loops[:len(scope.loops)-1]
+}
+
+// compileOperand compiles node while held values pushed by the enclosing
+// expression wait on the stack beneath it.
+func (c *Compiler) compileOperand(node ast.Node, held int) error {
+	c.scopes[c.scopeIndex].operands += held
+	err := c.Compile(node)
+	c.scopes[c.scopeIndex].operands -= held
+	return err
+}
+
+// popOperands emits the pops that bring the stack down to loop's value
+// before a break or continue jumps out of the expression it is in.
+func (c *Compiler) popOperands(tok token.Token, loop *loopContext) {
+	for i := loop.depth; i < c.scopes[c.scopeIndex].operands; i++ {
+		c.emit(tok, code.OpPop)
+	}
+}
+
+func (c *Compiler) currentLoop() *loopContext {
+	loops := c.scopes[c.scopeIndex].loops
+	if len(loops) == 0 {
+		return nil
+	}
+
+	return loops[len(loops)-1]
+}
+
+func (c *Compiler) patchLoop(loop *loopContext, continueTarget, breakTarget int) {
+	for _, pos := range loop.continues {
+		c.changeOperand(pos, continueTarget)
+	}
+
+	for _, pos := range loop.breaks {
+		c.changeOperand(pos, breakTarget)
+	}
+}
+
+func (c *Compiler) errorAt(tok token.Token, format string, a ...interface{}) error {
+	return fmt.Errorf("[%3d:%3d] %s", tok.LineNo, tok.Position, fmt.Sprintf(format, a...))
+}
+
+func isExpressionStatement(stmt ast.Statement) bool {
+	_, ok := stmt.(*ast.ExpressionStatement)
+	return ok
+}
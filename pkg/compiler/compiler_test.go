@@ -0,0 +1,695 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hculpan/kabkey/pkg/ast"
+	"github.com/hculpan/kabkey/pkg/code"
+	"github.com/hculpan/kabkey/pkg/lexer"
+	"github.com/hculpan/kabkey/pkg/object"
+	"github.com/hculpan/kabkey/pkg/parser"
+)
+
+type compilerTestCase struct {
+	input                string
+	expectedConstants    []interface{}
+	expectedInstructions []code.Instructions
+}
+
+func TestIntegerArithmetic(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1 + 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1; 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "7 % 2.5",
+			expectedConstants: []interface{}{7, 2.5},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMod),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "-1",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpMinus),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestBooleanExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1 <= 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpLessEqual),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "!true",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpBang),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "true && false",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),              // 0000
+				code.Make(code.OpJumpNotTruthy, 10), // 0001
+				code.Make(code.OpFalse),             // 0004
+				code.Make(code.OpBang),              // 0005
+				code.Make(code.OpBang),              // 0006
+				code.Make(code.OpJump, 11),          // 0007
+				code.Make(code.OpFalse),             // 0010
+				code.Make(code.OpPop),               // 0011
+			},
+		},
+		{
+			input:             "false || true",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpFalse),          // 0000
+				code.Make(code.OpJumpTruthy, 10), // 0001
+				code.Make(code.OpTrue),           // 0004
+				code.Make(code.OpBang),           // 0005
+				code.Make(code.OpBang),           // 0006
+				code.Make(code.OpJump, 11),       // 0007
+				code.Make(code.OpTrue),           // 0010
+				code.Make(code.OpPop),            // 0011
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestConditionals(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "if (true) { 10 }; 3333;",
+			expectedConstants: []interface{}{10, 3333},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),              // 0000
+				code.Make(code.OpJumpNotTruthy, 10), // 0001
+				code.Make(code.OpConstant, 0),       // 0004
+				code.Make(code.OpJump, 11),          // 0007
+				code.Make(code.OpNull),              // 0010
+				code.Make(code.OpPop),               // 0011
+				code.Make(code.OpConstant, 1),       // 0012
+				code.Make(code.OpPop),               // 0015
+			},
+		},
+		{
+			input:             "if (true) { let a = 1; } else { 20 }",
+			expectedConstants: []interface{}{1, 20},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),              // 0000
+				code.Make(code.OpJumpNotTruthy, 14), // 0001
+				code.Make(code.OpConstant, 0),       // 0004
+				code.Make(code.OpSetGlobal, 0),      // 0007
+				code.Make(code.OpNull),              // 0010
+				code.Make(code.OpJump, 17),          // 0011
+				code.Make(code.OpConstant, 1),       // 0014
+				code.Make(code.OpPop),               // 0017
+			},
+		},
+		{
+			input:             "match (1) { 2 => 3, _ => 4 }",
+			expectedConstants: []interface{}{1, 2, 3, 4},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),    // 0000
+				code.Make(code.OpDup),            // 0003
+				code.Make(code.OpConstant, 1),    // 0004
+				code.Make(code.OpEqual),          // 0007
+				code.Make(code.OpJumpTruthy, 14), // 0008
+				code.Make(code.OpJump, 21),       // 0011
+				code.Make(code.OpPop),            // 0014
+				code.Make(code.OpConstant, 2),    // 0015
+				code.Make(code.OpJump, 30),       // 0018
+				code.Make(code.OpPop),            // 0021
+				code.Make(code.OpConstant, 3),    // 0022
+				code.Make(code.OpJump, 30),       // 0025
+				code.Make(code.OpPop),            // 0028
+				code.Make(code.OpNull),           // 0029
+				code.Make(code.OpPop),            // 0030
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestLoops(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "while (true) { 1 }",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpNull),              // 0000
+				code.Make(code.OpTrue),              // 0001
+				code.Make(code.OpJumpNotTruthy, 13), // 0002
+				code.Make(code.OpConstant, 0),       // 0005
+				code.Make(code.OpSwap),              // 0008
+				code.Make(code.OpPop),               // 0009
+				code.Make(code.OpJump, 1),           // 0010
+				code.Make(code.OpPop),               // 0013
+			},
+		},
+		{
+			input:             "while (true) { break; continue; }",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpNull),              // 0000
+				code.Make(code.OpTrue),              // 0001
+				code.Make(code.OpJumpNotTruthy, 17), // 0002
+				code.Make(code.OpJump, 17),          // 0005
+				code.Make(code.OpJump, 1),           // 0008
+				code.Make(code.OpNull),              // 0011
+				code.Make(code.OpSwap),              // 0012
+				code.Make(code.OpPop),               // 0013
+				code.Make(code.OpJump, 1),           // 0014
+				code.Make(code.OpPop),               // 0017
+			},
+		},
+		{
+			input:             "for (let i = 0; i < 1; i++) { i }",
+			expectedConstants: []interface{}{0, 1, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),       // 0000
+				code.Make(code.OpSetGlobal, 0),      // 0003
+				code.Make(code.OpNull),              // 0006
+				code.Make(code.OpGetGlobal, 0),      // 0007
+				code.Make(code.OpConstant, 1),       // 0010
+				code.Make(code.OpLessThan),          // 0013
+				code.Make(code.OpJumpNotTruthy, 39), // 0014
+				code.Make(code.OpGetGlobal, 0),      // 0017
+				code.Make(code.OpSwap),              // 0020
+				code.Make(code.OpPop),               // 0021
+				code.Make(code.OpGetGlobal, 0),      // 0022
+				code.Make(code.OpGetGlobal, 0),      // 0025
+				code.Make(code.OpConstant, 2),       // 0028
+				code.Make(code.OpAdd),               // 0031
+				code.Make(code.OpSetGlobal, 0),      // 0032
+				code.Make(code.OpPop),               // 0035
+				code.Make(code.OpJump, 7),           // 0036
+				code.Make(code.OpPop),               // 0039
+			},
+		},
+		{
+			input:             "for (x in [1]) { x }",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),  // 0000
+				code.Make(code.OpArray, 1),     // 0003
+				code.Make(code.OpIter),         // 0006
+				code.Make(code.OpSetGlobal, 0), // 0007
+				code.Make(code.OpNull),         // 0010
+				code.Make(code.OpGetGlobal, 0), // 0011
+				code.Make(code.OpIterNext, 28), // 0014
+				code.Make(code.OpSetGlobal, 1), // 0017
+				code.Make(code.OpGetGlobal, 1), // 0020
+				code.Make(code.OpSwap),         // 0023
+				code.Make(code.OpPop),          // 0024
+				code.Make(code.OpJump, 11),     // 0025
+				code.Make(code.OpPop),          // 0028
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestGlobalStatements(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "let one = 1; let two = one;",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let a = 1; a = 2; a += 3; a--",
+			expectedConstants: []interface{}{1, 2, 3, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAssignGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpAdd),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpSub),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestCollections(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `{"a": 1}["a"]`,
+			expectedConstants: []interface{}{"a", 1, "a"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpHash, 2),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpIndex),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestFunctions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "fn() { return 5 + 10 }",
+			expectedConstants: []interface{}{
+				5,
+				10,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "let f = fn(a) { f(a) }; f(1)",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+				1,
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "let f = fn(a) { if (a) { return f(a) } else { f(a) + 1 } }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),       // 0000
+					code.Make(code.OpJumpNotTruthy, 17), // 0002
+					code.Make(code.OpGetGlobal, 0),      // 0005
+					code.Make(code.OpGetLocal, 0),       // 0008
+					code.Make(code.OpTailCall, 1),       // 0010
+					code.Make(code.OpReturnValue),       // 0012
+					code.Make(code.OpNull),              // 0013
+					code.Make(code.OpJump, 28),          // 0014
+					code.Make(code.OpGetGlobal, 0),      // 0017
+					code.Make(code.OpGetLocal, 0),       // 0020
+					code.Make(code.OpCall, 1),           // 0022
+					code.Make(code.OpConstant, 0),       // 0024
+					code.Make(code.OpAdd),               // 0027
+					code.Make(code.OpReturnValue),       // 0028
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestClosures(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "fn(a) { fn() { a = a + 1 } }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpSetFree, 0),
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpClosure, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+
+	program := parse("fn(a) { let b = 1; fn() { fn() { a + b } } }")
+	compiler := New()
+	if err := compiler.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	constants := compiler.Bytecode().Constants
+	inner := constants[1].(*object.CompiledFunction)
+	middle := constants[2].(*object.CompiledFunction)
+
+	expectedMiddle := []object.Capture{{Local: true, Index: 0}, {Local: true, Index: 1}}
+	expectedInner := []object.Capture{{Local: false, Index: 0}, {Local: false, Index: 1}}
+	if fmt.Sprint(middle.Captures) != fmt.Sprint(expectedMiddle) {
+		t.Errorf("wrong captures for middle function. want=%v, got=%v", expectedMiddle, middle.Captures)
+	}
+	if fmt.Sprint(inner.Captures) != fmt.Sprint(expectedInner) {
+		t.Errorf("wrong captures for inner function. want=%v, got=%v", expectedInner, inner.Captures)
+	}
+}
+
+func TestBuiltins(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `len("a")`,
+			expectedConstants: []interface{}{"a"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpGetBuiltin, builtinIndex("len")),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestPositions(t *testing.T) {
+	program := parse("let a = 1;\na / 0")
+	compiler := New()
+	if err := compiler.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+
+	// OpConstant, OpSetGlobal, OpGetGlobal, OpConstant, then OpDiv
+	lineNo, position := bytecode.Positions.Lookup(12)
+	if lineNo != 2 || position != 3 {
+		t.Errorf("wrong position for OpDiv. want=2:3, got=%d:%d", lineNo, position)
+	}
+}
+
+func builtinIndex(name string) int {
+	symbol, _ := New().symbolTable.Resolve(name)
+	return symbol.Index
+}
+
+func TestOperandLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"256 locals", "fn() { " + lets("v", 256) + " }", ""},
+		{"257 locals", "fn() { " + lets("v", 257) + " }", "too many local variables in function"},
+		{"255 arguments", "len(" + repeat("1", 255, ", ") + ")", ""},
+		{"256 arguments", "len(" + repeat("1", 256, ", ") + ")", "too many arguments in call"},
+		{"65536 constants", repeat("1", 65536, ";"), ""},
+		{"65537 constants", repeat("1", 65537, ";"), "too many constants"},
+		{"65536 globals", lets("v", 65536), ""},
+		{"65537 globals", lets("v", 65537), "too many global variables"},
+		{"65535 elements", "[" + repeat("true", 65535, ", ") + "]", ""},
+		{"65536 elements", "[" + repeat("true", 65536, ", ") + "]", "too many elements in array literal"},
+		{"32767 pairs", "{" + repeat("true: true", 32767, ", ") + "}", ""},
+		{"32768 pairs", "{" + repeat("true: true", 32768, ", ") + "}", "too many pairs in hash literal"},
+		{"256 captures", "fn() { " + lets("a", 200) + " fn() { " + lets("b", 56) + " fn() { " + names("a", 200, ";") + ";" + names("b", 56, ";") + " } } }", ""},
+		{"257 captures", "fn() { " + lets("a", 200) + " fn() { " + lets("b", 57) + " fn() { " + names("a", 200, ";") + ";" + names("b", 57, ";") + " } } }", "too many captured variables in function"},
+		// A while loop ends in a jump back over its body, which is four
+		// bytes a statement here.
+		{"short jump", "let a = 1; while (a) { " + repeat("a", 16000, ";") + " }", ""},
+		{"long jump", "let a = 1; while (a) { " + repeat("a", 17000, ";") + " }", "too much code to jump over"},
+	}
+
+	for _, tt := range tests {
+		err := New().Compile(parse(tt.input))
+		switch {
+		case tt.expected == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+		case tt.expected != "" && err == nil:
+			t.Errorf("%s: expected error %q", tt.name, tt.expected)
+		case tt.expected != "" && !strings.Contains(err.Error(), tt.expected):
+			t.Errorf("%s: wrong error. want=%q, got=%q", tt.name, tt.expected, err)
+		}
+	}
+}
+
+// names returns n distinct identifiers starting with prefix, separated by
+// sep.
+func names(prefix string, n int, sep string) string {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = prefix
+		for j := i + 1; j > 0; j = (j - 1) / 26 {
+			out[i] += string(rune('a' + (j-1)%26))
+		}
+	}
+
+	return strings.Join(out, sep)
+}
+
+// lets returns n let statements binding the names from names.
+func lets(prefix string, n int) string {
+	out := []string{}
+	for _, name := range strings.Split(names(prefix, n, " "), " ") {
+		out = append(out, "let "+name+" = true;")
+	}
+
+	return strings.Join(out, " ")
+}
+
+func repeat(s string, n int, sep string) string {
+	return strings.TrimSuffix(strings.Repeat(s+sep, n), sep)
+}
+
+func parse(input string) *ast.Program {
+	l := lexer.NewLexer(input)
+	p := parser.NewParser(l)
+	return p.ParseProgram()
+}
+
+func runCompilerTests(t *testing.T, tests []compilerTestCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		compiler := New()
+		err := compiler.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := compiler.Bytecode()
+
+		err = testInstructions(tt.expectedInstructions, bytecode.Instructions)
+		if err != nil {
+			t.Fatalf("%s: testInstructions failed: %s", tt.input, err)
+		}
+
+		err = testConstants(tt.expectedConstants, bytecode.Constants)
+		if err != nil {
+			t.Fatalf("%s: testConstants failed: %s", tt.input, err)
+		}
+	}
+}
+
+func concatInstructions(s []code.Instructions) code.Instructions {
+	out := code.Instructions{}
+
+	for _, ins := range s {
+		out = append(out, ins...)
+	}
+
+	return out
+}
+
+func testInstructions(expected []code.Instructions, actual code.Instructions) error {
+	concatted := concatInstructions(expected)
+
+	if len(actual) != len(concatted) {
+		return fmt.Errorf("wrong instructions length.\nwant=\n%s\ngot=\n%s", concatted, actual)
+	}
+
+	for i, ins := range concatted {
+		if actual[i] != ins {
+			return fmt.Errorf("wrong instruction at %d.\nwant=\n%s\ngot=\n%s", i, concatted, actual)
+		}
+	}
+
+	return nil
+}
+
+func testConstants(expected []interface{}, actual []object.Object) error {
+	if len(expected) != len(actual) {
+		return fmt.Errorf("wrong number of constants. got=%d, want=%d", len(actual), len(expected))
+	}
+
+	for i, constant := range expected {
+		switch constant := constant.(type) {
+		case int:
+			result, ok := actual[i].(*object.Integer)
+			if !ok || result.Value != int64(constant) {
+				return fmt.Errorf("constant %d - wrong integer. want=%d, got=%s", i, constant, actual[i].Inspect())
+			}
+		case float64:
+			result, ok := actual[i].(*object.Float)
+			if !ok || result.Value != constant {
+				return fmt.Errorf("constant %d - wrong float. want=%f, got=%s", i, constant, actual[i].Inspect())
+			}
+		case string:
+			result, ok := actual[i].(*object.String)
+			if !ok || result.Value != constant {
+				return fmt.Errorf("constant %d - wrong string. want=%q, got=%s", i, constant, actual[i].Inspect())
+			}
+		case []code.Instructions:
+			fn, ok := actual[i].(*object.CompiledFunction)
+			if !ok {
+				return fmt.Errorf("constant %d - not a function: %T", i, actual[i])
+			}
+
+			if err := testInstructions(constant, fn.Instructions); err != nil {
+				return fmt.Errorf("constant %d - testInstructions failed: %s", i, strings.TrimSpace(err.Error()))
+			}
+		}
+	}
+
+	return nil
+}
+
+func TestDisassemble(t *testing.T) {
+	input := `let total = 0;
+let add = fn(x) {
+  total += len(x)
+};
+if (total > 1.5) { add("ab") }`
+
+	compiler := New()
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := `main:
+   1 0000 OpConstant 0 (0)
+     0003 OpSetGlobal 0 (total)
+   2 0006 OpClosure 1 (fn add)
+     0009 OpSetGlobal 1 (add)
+   5 0012 OpGetGlobal 0 (total)
+     0015 OpConstant 2 (1.5)
+     0018 OpGreaterThan
+     0019 OpJumpNotTruthy L1
+     0022 OpGetGlobal 1 (add)
+     0025 OpConstant 3 ("ab")
+     0028 OpCall 1
+     0030 OpJump L2
+L1:
+     0033 OpNull
+L2:
+     0034 OpPop
+
+fn add (constant 1, 1 params, 1 locals):
+   3 0000 OpGetGlobal 0 (total)
+     0003 OpGetBuiltin ` + fmt.Sprintf("%d", builtinIndex("len")) + ` (len)
+     0005 OpGetLocal 0 (x)
+     0007 OpCall 1
+     0009 OpAdd
+     0010 OpSetGlobal 0 (total)
+     0013 OpGetGlobal 0 (total)
+     0016 OpReturnValue
+`
+
+	if actual := compiler.Bytecode().Disassemble(); actual != expected {
+		t.Errorf("wrong disassembly.\nwant=\n%s\ngot=\n%s", expected, actual)
+	}
+}
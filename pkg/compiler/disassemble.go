@@ -0,0 +1,65 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/hculpan/kabkey/pkg/code"
+	"github.com/hculpan/kabkey/pkg/object"
+)
+
+// Disassemble renders the program's top-level code followed by every
+// compiled function in the constant pool. Each listing shows source lines,
+// jump labels and the constants and variables that operands refer to.
+func (b *Bytecode) Disassemble() string {
+	var out bytes.Buffer
+
+	constants := make([]string, len(b.Constants))
+	for i, c := range b.Constants {
+		constants[i] = describeConstant(c)
+	}
+
+	builtins := b.BuiltinNames
+
+	out.WriteString("main:\n")
+	out.WriteString(b.Instructions.Disassemble(&code.Symbols{
+		Constants: constants,
+		Globals:   b.GlobalNames,
+		Builtins:  builtins,
+		Positions: b.Positions,
+	}))
+
+	for i, c := range b.Constants {
+		fn, ok := c.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+
+		fmt.Fprintf(&out, "\n%s (constant %d, %d params, %d locals):\n", constants[i], i, fn.NumParameters, fn.NumLocals)
+		out.WriteString(fn.Instructions.Disassemble(&code.Symbols{
+			Constants: constants,
+			Globals:   b.GlobalNames,
+			Locals:    fn.LocalNames,
+			Free:      fn.FreeNames,
+			Builtins:  builtins,
+			Positions: fn.Positions,
+		}))
+	}
+
+	return out.String()
+}
+
+func describeConstant(c object.Object) string {
+	switch c := c.(type) {
+	case *object.String:
+		return strconv.Quote(c.Value)
+	case *object.CompiledFunction:
+		if c.Name == "" {
+			return "fn <anonymous>"
+		}
+		return "fn " + c.Name
+	default:
+		return c.Inspect()
+	}
+}
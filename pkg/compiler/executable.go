@@ -0,0 +1,489 @@
+package compiler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/hculpan/kabkey/pkg/code"
+	"github.com/hculpan/kabkey/pkg/evaluator"
+	"github.com/hculpan/kabkey/pkg/object"
+)
+
+// Executable files written by kabc and loaded by kabv are laid out as
+// follows. All integers are big-endian, strings and byte sequences are
+// prefixed with their length as a uint32.
+//
+//	magic         "KABX"
+//	version       uint16
+//	filename      string, empty if unknown
+//	globals       uint32 count, then one name per global slot
+//	builtins      uint32 count, then the name of each builtin by index
+//	functions     uint32 count, then one function record each
+//	constants     uint32 count, then one tagged constant each
+//	main          instructions and line table of the top-level code
+//
+// A function record holds its name, parameter and local counts, captures,
+// local and free variable names, body source, instructions and line table. Function
+// constants refer to a function record by index. A line table is a uint32
+// count followed by (offset, line, position, span) entries.
+
+var magic = []byte("KABX")
+
+// FormatVersion is the version of the executable format written by
+// WriteExecutable. Files of any other version are rejected. The format is
+// free to change until a release ships with it, after which any change
+// needs a new version.
+const FormatVersion = 1
+
+var ErrNotExecutable = errors.New("not a kabkey executable")
+
+const (
+	constInteger byte = iota + 1
+	constFloat
+	constString
+	constFunction
+)
+
+func WriteExecutable(out io.Writer, bytecode *Bytecode) error {
+	w := &writer{w: bufio.NewWriter(out)}
+
+	functions := []*object.CompiledFunction{}
+	functionIndex := map[*object.CompiledFunction]int{}
+	for _, c := range bytecode.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			functionIndex[fn] = len(functions)
+			functions = append(functions, fn)
+		}
+	}
+
+	w.bytes(magic)
+	w.uint16(FormatVersion)
+	w.string(bytecode.Filename)
+	w.strings(bytecode.GlobalNames)
+	w.strings(bytecode.BuiltinNames)
+
+	w.uint32(len(functions))
+	for _, fn := range functions {
+		w.function(fn)
+	}
+
+	w.uint32(len(bytecode.Constants))
+	for _, c := range bytecode.Constants {
+		switch c := c.(type) {
+		case *object.Integer:
+			w.byte(constInteger)
+			w.uint64(uint64(c.Value))
+		case *object.Float:
+			w.byte(constFloat)
+			w.uint64(math.Float64bits(c.Value))
+		case *object.String:
+			w.byte(constString)
+			w.string(c.Value)
+		case *object.CompiledFunction:
+			w.byte(constFunction)
+			w.uint32(functionIndex[c])
+		default:
+			return fmt.Errorf("cannot write constant of type %s", c.Type())
+		}
+	}
+
+	w.instructions(bytecode.Instructions, bytecode.Positions)
+
+	if w.err != nil {
+		return w.err
+	}
+
+	return w.w.Flush()
+}
+
+func ReadExecutable(in io.Reader) (*Bytecode, error) {
+	r := &reader{r: bufio.NewReader(in)}
+
+	header := r.bytes(len(magic))
+	if r.err != nil || !bytes.Equal(header, magic) {
+		return nil, ErrNotExecutable
+	}
+
+	if version := r.uint16(); r.err == nil && version != FormatVersion {
+		return nil, fmt.Errorf("incompatible executable version %d: this build of kabkey reads version %d, recompile the source with kabc", version, FormatVersion)
+	}
+
+	bytecode := &Bytecode{}
+	bytecode.Filename = r.string()
+	bytecode.GlobalNames = r.strings()
+	bytecode.BuiltinNames = r.strings()
+
+	// Builtins are looked up by name when the program is run, so an
+	// executable keeps working as builtins are added, but not once one it
+	// uses is gone.
+	for _, name := range bytecode.BuiltinNames {
+		if _, ok := evaluator.GetBuiltin(name); r.err == nil && !ok {
+			return nil, fmt.Errorf("executable uses builtin %q, which this build of kabkey does not have", name)
+		}
+	}
+
+	functions := make([]*object.CompiledFunction, r.count())
+	for i := range functions {
+		functions[i] = r.function()
+	}
+
+	bytecode.Constants = make([]object.Object, r.count())
+	for i := range bytecode.Constants {
+		switch tag := r.byte(); tag {
+		case constInteger:
+			bytecode.Constants[i] = &object.Integer{Value: int64(r.uint64())}
+		case constFloat:
+			bytecode.Constants[i] = &object.Float{Value: math.Float64frombits(r.uint64())}
+		case constString:
+			bytecode.Constants[i] = &object.String{Value: r.string()}
+		case constFunction:
+			index := r.count()
+			if r.err == nil && index >= len(functions) {
+				return nil, fmt.Errorf("corrupt executable: function %d out of range", index)
+			}
+			if r.err == nil {
+				bytecode.Constants[i] = functions[index]
+			}
+		default:
+			if r.err == nil {
+				return nil, fmt.Errorf("corrupt executable: unknown constant type %d", tag)
+			}
+		}
+	}
+
+	bytecode.Instructions, bytecode.Positions = r.instructions()
+
+	if r.err != nil {
+		return nil, fmt.Errorf("corrupt executable: %w", r.err)
+	}
+
+	if err := checkBytecode(bytecode); err != nil {
+		return nil, fmt.Errorf("corrupt executable: %w", err)
+	}
+
+	return bytecode, nil
+}
+
+// checkBytecode makes sure that a loaded program only refers to constants,
+// variables and code that exist. The VM trusts its bytecode, which the
+// compiler's always satisfies but a damaged file need not.
+func checkBytecode(bytecode *Bytecode) error {
+	main := &object.CompiledFunction{Instructions: bytecode.Instructions}
+	if err := checkInstructions(bytecode, main); err != nil {
+		return fmt.Errorf("main program: %w", err)
+	}
+
+	for i, c := range bytecode.Constants {
+		fn, ok := c.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+
+		if err := checkFunction(bytecode, fn); err != nil {
+			return fmt.Errorf("constant %d: function %s: %w", i, fn.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func checkFunction(bytecode *Bytecode, fn *object.CompiledFunction) error {
+	switch {
+	case fn.NumLocals > code.MaxOperand(1)+1:
+		return fmt.Errorf("%d locals, at most %d allowed", fn.NumLocals, code.MaxOperand(1)+1)
+	case fn.NumParameters > fn.NumLocals:
+		return fmt.Errorf("%d parameters but %d locals", fn.NumParameters, fn.NumLocals)
+	case fn.NumLocals > len(fn.LocalNames):
+		return fmt.Errorf("%d locals but %d local names", fn.NumLocals, len(fn.LocalNames))
+	case len(fn.Captures) > len(fn.FreeNames):
+		return fmt.Errorf("%d captures but %d free names", len(fn.Captures), len(fn.FreeNames))
+	}
+
+	return checkInstructions(bytecode, fn)
+}
+
+// checkInstructions checks that fn's instructions are whole, that their
+// operands are in range and that jumps land on an instruction.
+func checkInstructions(bytecode *Bytecode, fn *object.CompiledFunction) error {
+	ins := fn.Instructions
+	starts := map[int]bool{len(ins): true}
+	jumps := map[int]int{}
+
+	for i := 0; i < len(ins); {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			return fmt.Errorf("offset %d: %w", i, err)
+		}
+
+		width := 0
+		for _, w := range def.OperandWidths {
+			width += w
+		}
+		if i+1+width > len(ins) {
+			return fmt.Errorf("offset %d: %s is cut short", i, def.Name)
+		}
+
+		operands, read := code.ReadOperands(def, ins[i+1:])
+		if err := checkOperands(bytecode, fn, code.Opcode(ins[i]), operands); err != nil {
+			return fmt.Errorf("offset %d: %s: %w", i, def.Name, err)
+		}
+
+		switch code.Opcode(ins[i]) {
+		case code.OpJump, code.OpJumpNotTruthy, code.OpJumpTruthy, code.OpIterNext:
+			jumps[i] = operands[0]
+		}
+
+		starts[i] = true
+		i += 1 + read
+	}
+
+	for offset, target := range jumps {
+		if !starts[target] {
+			return fmt.Errorf("offset %d: jump to %d, which is not an instruction", offset, target)
+		}
+	}
+
+	return nil
+}
+
+func checkOperands(bytecode *Bytecode, fn *object.CompiledFunction, op code.Opcode, operands []int) error {
+	inRange := func(what string, index, count int) error {
+		if index >= count {
+			return fmt.Errorf("%s %d out of range", what, index)
+		}
+		return nil
+	}
+
+	switch op {
+	case code.OpConstant:
+		return inRange("constant", operands[0], len(bytecode.Constants))
+	case code.OpGetGlobal, code.OpSetGlobal, code.OpAssignGlobal:
+		return inRange("global", operands[0], len(bytecode.GlobalNames))
+	case code.OpGetLocal, code.OpSetLocal:
+		return inRange("local", operands[0], fn.NumLocals)
+	case code.OpGetFree, code.OpSetFree:
+		return inRange("free variable", operands[0], len(fn.Captures))
+	case code.OpGetBuiltin:
+		return inRange("builtin", operands[0], len(bytecode.BuiltinNames))
+	case code.OpClosure:
+		if err := inRange("constant", operands[0], len(bytecode.Constants)); err != nil {
+			return err
+		}
+
+		closure, ok := bytecode.Constants[operands[0]].(*object.CompiledFunction)
+		if !ok {
+			return fmt.Errorf("constant %d is not a function", operands[0])
+		}
+
+		// A closure captures from the function creating it.
+		for _, capture := range closure.Captures {
+			var err error
+			if capture.Local {
+				err = inRange("captured local", capture.Index, fn.NumLocals)
+			} else {
+				err = inRange("captured free variable", capture.Index, len(fn.Captures))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// writer writes the primitives of the executable format. The first error
+// is kept and later writes are skipped.
+type writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (w *writer) bytes(b []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(b)
+	}
+}
+
+func (w *writer) byte(b byte) {
+	w.bytes([]byte{b})
+}
+
+func (w *writer) uint16(v int) {
+	w.bytes(binary.BigEndian.AppendUint16(nil, uint16(v)))
+}
+
+func (w *writer) uint32(v int) {
+	w.bytes(binary.BigEndian.AppendUint32(nil, uint32(v)))
+}
+
+func (w *writer) uint64(v uint64) {
+	w.bytes(binary.BigEndian.AppendUint64(nil, v))
+}
+
+func (w *writer) string(s string) {
+	w.uint32(len(s))
+	w.bytes([]byte(s))
+}
+
+func (w *writer) strings(s []string) {
+	w.uint32(len(s))
+	for _, str := range s {
+		w.string(str)
+	}
+}
+
+func (w *writer) instructions(ins code.Instructions, positions code.PositionTable) {
+	w.uint32(len(ins))
+	w.bytes(ins)
+
+	w.uint32(len(positions))
+	for _, p := range positions {
+		w.uint32(p.Offset)
+		w.uint32(p.LineNo)
+		w.uint32(p.Position)
+		w.uint32(p.Span)
+	}
+}
+
+func (w *writer) function(fn *object.CompiledFunction) {
+	w.string(fn.Name)
+	w.uint32(fn.NumParameters)
+	w.uint32(fn.NumLocals)
+
+	w.uint32(len(fn.Captures))
+	for _, c := range fn.Captures {
+		if c.Local {
+			w.byte(1)
+		} else {
+			w.byte(0)
+		}
+		w.uint32(c.Index)
+	}
+
+	w.strings(fn.LocalNames)
+	w.strings(fn.FreeNames)
+	w.string(fn.Body)
+	w.instructions(fn.Instructions, fn.Positions)
+}
+
+// reader is the counterpart of writer. After the first error every read
+// returns a zero value.
+type reader struct {
+	r   *bufio.Reader
+	err error
+}
+
+// maxCount bounds counts and lengths read from a file, so that a corrupt
+// file fails cleanly instead of exhausting memory.
+const maxCount = 1 << 28
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		r.err = err
+		return nil
+	}
+
+	return b
+}
+
+func (r *reader) byte() byte {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+
+	return b[0]
+}
+
+func (r *reader) uint16() int {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+
+	return int(binary.BigEndian.Uint16(b))
+}
+
+func (r *reader) uint32() int {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+
+	return int(binary.BigEndian.Uint32(b))
+}
+
+func (r *reader) uint64() uint64 {
+	b := r.bytes(8)
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *reader) count() int {
+	n := r.uint32()
+	if n > maxCount {
+		if r.err == nil {
+			r.err = fmt.Errorf("length %d too large", n)
+		}
+		return 0
+	}
+
+	return n
+}
+
+func (r *reader) string() string {
+	return string(r.bytes(r.count()))
+}
+
+func (r *reader) strings() []string {
+	result := make([]string, r.count())
+	for i := range result {
+		result[i] = r.string()
+	}
+
+	return result
+}
+
+func (r *reader) instructions() (code.Instructions, code.PositionTable) {
+	ins := code.Instructions(r.bytes(r.count()))
+
+	positions := make(code.PositionTable, r.count())
+	for i := range positions {
+		positions[i] = code.Position{Offset: r.uint32(), LineNo: r.uint32(), Position: r.uint32(), Span: r.uint32()}
+	}
+
+	return ins, positions
+}
+
+func (r *reader) function() *object.CompiledFunction {
+	fn := &object.CompiledFunction{}
+	fn.Name = r.string()
+	fn.NumParameters = r.uint32()
+	fn.NumLocals = r.uint32()
+
+	fn.Captures = make([]object.Capture, r.count())
+	for i := range fn.Captures {
+		fn.Captures[i] = object.Capture{Local: r.byte() == 1, Index: r.uint32()}
+	}
+
+	fn.LocalNames = r.strings()
+	fn.FreeNames = r.strings()
+	fn.Body = r.string()
+	fn.Instructions, fn.Positions = r.instructions()
+
+	return fn
+}
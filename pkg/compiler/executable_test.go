@@ -0,0 +1,230 @@
+package compiler
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hculpan/kabkey/pkg/code"
+	"github.com/hculpan/kabkey/pkg/object"
+)
+
+func TestExecutableRoundTrip(t *testing.T) {
+	input := `
+	let greeting = "hello";
+	let ratio = 2.5;
+	let adder = fn(a) { fn(b) { a + b } };
+	adder(1)(2) * ratio
+	`
+
+	compiler := New()
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := compiler.Bytecode()
+	expected.Filename = "adder.mky"
+
+	var buf bytes.Buffer
+	if err := WriteExecutable(&buf, expected); err != nil {
+		t.Fatalf("WriteExecutable failed: %s", err)
+	}
+
+	actual, err := ReadExecutable(&buf)
+	if err != nil {
+		t.Fatalf("ReadExecutable failed: %s", err)
+	}
+
+	if !reflect.DeepEqual(expected.Instructions, actual.Instructions) {
+		t.Errorf("wrong instructions.\nwant=\n%s\ngot=\n%s", expected.Instructions, actual.Instructions)
+	}
+
+	if !reflect.DeepEqual(expected.Positions, actual.Positions) {
+		t.Errorf("wrong positions. want=%v, got=%v", expected.Positions, actual.Positions)
+	}
+
+	if !reflect.DeepEqual(expected.GlobalNames, actual.GlobalNames) {
+		t.Errorf("wrong global names. want=%v, got=%v", expected.GlobalNames, actual.GlobalNames)
+	}
+
+	if !reflect.DeepEqual(expected.BuiltinNames, actual.BuiltinNames) {
+		t.Errorf("wrong builtin names. want=%v, got=%v", expected.BuiltinNames, actual.BuiltinNames)
+	}
+
+	if actual.Filename != "adder.mky" {
+		t.Errorf("wrong filename. got=%q", actual.Filename)
+	}
+
+	if len(actual.Constants) != len(expected.Constants) {
+		t.Fatalf("wrong number of constants. want=%d, got=%d", len(expected.Constants), len(actual.Constants))
+	}
+
+	for i, want := range expected.Constants {
+		got := actual.Constants[i]
+
+		if fn, ok := want.(*object.CompiledFunction); ok {
+			if !reflect.DeepEqual(fn, got) {
+				t.Errorf("constant %d - wrong function.\nwant=%+v\ngot=%+v", i, fn, got)
+			}
+			continue
+		}
+
+		if got.Type() != want.Type() || got.Inspect() != want.Inspect() {
+			t.Errorf("constant %d - want=%s %s, got=%s %s", i, want.Type(), want.Inspect(), got.Type(), got.Inspect())
+		}
+	}
+}
+
+func TestReadExecutableErrors(t *testing.T) {
+	tests := []struct {
+		input    []byte
+		expected string
+	}{
+		{[]byte("let a = 1;"), "not a kabkey executable"},
+		{[]byte("KA"), "not a kabkey executable"},
+		{[]byte("KABX\x00\x63"), "incompatible executable version 99"},
+		{[]byte("KABX\x00\x02"), "incompatible executable version 2"},
+		{[]byte("KABX\x00\x01\x00\x00"), "corrupt executable"},
+	}
+
+	for _, tt := range tests {
+		_, err := ReadExecutable(bytes.NewReader(tt.input))
+		if err == nil {
+			t.Errorf("%q: expected error", tt.input)
+			continue
+		}
+
+		if !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%q: wrong error. want=%q, got=%q", tt.input, tt.expected, err)
+		}
+	}
+
+	_, err := ReadExecutable(bytes.NewReader([]byte("nope")))
+	if !errors.Is(err, ErrNotExecutable) {
+		t.Errorf("expected ErrNotExecutable, got=%v", err)
+	}
+}
+
+func TestReadExecutableWithUnknownBuiltin(t *testing.T) {
+	bytecode := &Bytecode{BuiltinNames: []string{"len", "nosuch"}}
+
+	var buf bytes.Buffer
+	if err := WriteExecutable(&buf, bytecode); err != nil {
+		t.Fatalf("WriteExecutable failed: %s", err)
+	}
+
+	_, err := ReadExecutable(&buf)
+	expected := `executable uses builtin "nosuch", which this build of kabkey does not have`
+	if err == nil || err.Error() != expected {
+		t.Errorf("wrong error. want=%q, got=%v", expected, err)
+	}
+}
+
+func TestReadCorruptExecutable(t *testing.T) {
+	input := `
+	let g = 1;
+	let f = fn(a) { let b = a; fn() { a + b + g } };
+	len([f(1)()])
+	`
+
+	// function returns the function of the program above with the given
+	// name, which is empty for the inner one.
+	function := func(b *Bytecode, name string) *object.CompiledFunction {
+		for _, c := range b.Constants {
+			if fn, ok := c.(*object.CompiledFunction); ok && fn.Name == name {
+				return fn
+			}
+		}
+		t.Fatalf("function %q not found", name)
+		return nil
+	}
+
+	tests := []struct {
+		corrupt  func(b *Bytecode)
+		expected string
+	}{
+		{
+			func(b *Bytecode) { b.Instructions = code.Instructions{255} },
+			"main program: offset 0: opcode 255 undefined",
+		},
+		{
+			func(b *Bytecode) { b.Instructions = code.Make(code.OpConstant, 0)[:2] },
+			"main program: offset 0: OpConstant is cut short",
+		},
+		{
+			func(b *Bytecode) { b.Instructions = code.Make(code.OpConstant, 99) },
+			"main program: offset 0: OpConstant: constant 99 out of range",
+		},
+		{
+			func(b *Bytecode) { b.Instructions = code.Make(code.OpGetGlobal, 2) },
+			"main program: offset 0: OpGetGlobal: global 2 out of range",
+		},
+		{
+			func(b *Bytecode) { b.Instructions = code.Make(code.OpGetBuiltin, 200) },
+			"main program: offset 0: OpGetBuiltin: builtin 200 out of range",
+		},
+		{
+			func(b *Bytecode) { b.Instructions = code.Make(code.OpGetLocal, 0) },
+			"main program: offset 0: OpGetLocal: local 0 out of range",
+		},
+		{
+			func(b *Bytecode) { b.Instructions = code.Make(code.OpJump, 1) },
+			"main program: offset 0: jump to 1, which is not an instruction",
+		},
+		{
+			func(b *Bytecode) { b.Instructions = code.Make(code.OpClosure, 0) },
+			"main program: offset 0: OpClosure: constant 0 is not a function",
+		},
+		{
+			func(b *Bytecode) { function(b, "f").NumParameters = 5 },
+			"function f: 5 parameters but 2 locals",
+		},
+		{
+			func(b *Bytecode) { function(b, "f").LocalNames = []string{"a"} },
+			"function f: 2 locals but 1 local names",
+		},
+		{
+			func(b *Bytecode) { function(b, "f").NumLocals = 1000 },
+			"function f: 1000 locals, at most 256 allowed",
+		},
+		{
+			func(b *Bytecode) { function(b, "f").Instructions = code.Make(code.OpGetLocal, 2) },
+			"function f: offset 0: OpGetLocal: local 2 out of range",
+		},
+		{
+			func(b *Bytecode) { function(b, "f").Instructions = code.Make(code.OpGetFree, 0) },
+			"function f: offset 0: OpGetFree: free variable 0 out of range",
+		},
+		{
+			func(b *Bytecode) { function(b, "").Captures[0].Index = 5 },
+			"function f: offset 4: OpClosure: captured local 5 out of range",
+		},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		if err := compiler.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := compiler.Bytecode()
+		tt.corrupt(bytecode)
+
+		var buf bytes.Buffer
+		if err := WriteExecutable(&buf, bytecode); err != nil {
+			t.Fatalf("WriteExecutable failed: %s", err)
+		}
+
+		_, err := ReadExecutable(&buf)
+		if err == nil {
+			t.Errorf("%s: expected error", tt.expected)
+			continue
+		}
+
+		if !strings.HasPrefix(err.Error(), "corrupt executable: ") || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package compiler
+
+type SymbolScope string
+
+const (
+	GlobalScope  SymbolScope = "GLOBAL"
+	LocalScope   SymbolScope = "LOCAL"
+	BuiltinScope SymbolScope = "BUILTIN"
+	FreeScope    SymbolScope = "FREE"
+)
+
+type Symbol struct {
+	Name  string
+	Scope SymbolScope
+	Index int
+}
+
+// SymbolTable maps names to storage slots. There is one table for the
+// program's globals, one per function, and one per block scope (for and
+// for-in loops). A block table hands out slots from the table that owns
+// its storage, so block variables live in the same frame as the function
+// or program around them but can shadow outer names.
+type SymbolTable struct {
+	Outer *SymbolTable
+
+	store          map[string]Symbol
+	numDefinitions int
+	names          []string
+	block          bool
+	declared       map[string]bool
+
+	FreeSymbols []Symbol
+}
+
+func NewSymbolTable() *SymbolTable {
+	s := make(map[string]Symbol)
+	free := []Symbol{}
+	return &SymbolTable{store: s, FreeSymbols: free}
+}
+
+func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := NewSymbolTable()
+	s.Outer = outer
+	return s
+}
+
+func NewBlockSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := NewEnclosedSymbolTable(outer)
+	s.block = true
+	return s
+}
+
+// owner returns the table whose slots this table allocates from.
+func (s *SymbolTable) owner() *SymbolTable {
+	for s.block {
+		s = s.Outer
+	}
+
+	return s
+}
+
+func (s *SymbolTable) storageScope() SymbolScope {
+	if s.owner().Outer == nil {
+		return GlobalScope
+	}
+
+	return LocalScope
+}
+
+// Define binds name in this table. Redefining a name in the same scope
+// reuses its slot, matching the evaluator where a second let overwrites the
+// existing binding.
+func (s *SymbolTable) Define(name string) Symbol {
+	scope := s.storageScope()
+	if existing, ok := s.store[name]; ok && existing.Scope == scope {
+		return existing
+	}
+
+	owner := s.owner()
+	symbol := Symbol{Name: name, Scope: scope, Index: owner.numDefinitions}
+	owner.numDefinitions++
+	owner.names = append(owner.names, name)
+
+	s.store[name] = symbol
+	return symbol
+}
+
+// DefineGlobal binds name in the outermost table. The compiler uses it for
+// names that are referenced before any definition is visible, which lets
+// functions refer to globals that are defined later in the program.
+func (s *SymbolTable) DefineGlobal(name string) Symbol {
+	for s.Outer != nil {
+		s = s.Outer
+	}
+
+	return s.Define(name)
+}
+
+func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
+	symbol := Symbol{Name: name, Scope: BuiltinScope, Index: index}
+	s.store[name] = symbol
+	return symbol
+}
+
+func (s *SymbolTable) defineFree(original Symbol) Symbol {
+	s.FreeSymbols = append(s.FreeSymbols, original)
+
+	symbol := Symbol{Name: original.Name, Scope: FreeScope, Index: len(s.FreeSymbols) - 1}
+	s.store[original.Name] = symbol
+	return symbol
+}
+
+// Declare announces that name will be defined later in this table. A
+// nested function that refers to it before then, such as one of a pair of
+// mutually recursive local functions, captures the slot the definition
+// will use instead of falling back to a global.
+func (s *SymbolTable) Declare(name string) {
+	if s.declared == nil {
+		s.declared = make(map[string]bool)
+	}
+
+	s.declared[name] = true
+}
+
+func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
+	return s.resolve(name, false)
+}
+
+// resolve looks name up through the enclosing tables. nested reports
+// whether the lookup started in a function nested inside this table, which
+// is when declared but not yet defined names become visible.
+func (s *SymbolTable) resolve(name string, nested bool) (Symbol, bool) {
+	obj, ok := s.store[name]
+	if !ok && nested && s.declared[name] {
+		obj, ok = s.Define(name), true
+	}
+
+	if ok || s.Outer == nil {
+		return obj, ok
+	}
+
+	obj, ok = s.Outer.resolve(name, nested || !s.block)
+	if !ok || s.block {
+		return obj, ok
+	}
+
+	if obj.Scope == GlobalScope || obj.Scope == BuiltinScope {
+		return obj, ok
+	}
+
+	return s.defineFree(obj), true
+}
+
+// NumDefinitions returns the number of slots allocated from this table,
+// including those handed out to its block scopes.
+func (s *SymbolTable) NumDefinitions() int {
+	return s.owner().numDefinitions
+}
+
+// Names returns the names bound to each slot of this table, indexed by
+// slot. Block scopes that shadow a name contribute their own entries.
+func (s *SymbolTable) Names() []string {
+	return s.owner().names
+}
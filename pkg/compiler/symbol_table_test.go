@@ -0,0 +1,64 @@
+package compiler
+
+import "testing"
+
+func TestResolveScopes(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+
+	local := NewEnclosedSymbolTable(global)
+	local.Define("b")
+
+	block := NewBlockSymbolTable(local)
+	block.Define("c")
+	block.Define("b")
+
+	nested := NewEnclosedSymbolTable(block)
+
+	tests := []struct {
+		table    *SymbolTable
+		name     string
+		expected Symbol
+	}{
+		{global, "a", Symbol{Name: "a", Scope: GlobalScope, Index: 0}},
+		{local, "a", Symbol{Name: "a", Scope: GlobalScope, Index: 0}},
+		{local, "b", Symbol{Name: "b", Scope: LocalScope, Index: 0}},
+		{block, "c", Symbol{Name: "c", Scope: LocalScope, Index: 1}},
+		{block, "b", Symbol{Name: "b", Scope: LocalScope, Index: 2}},
+		{nested, "b", Symbol{Name: "b", Scope: FreeScope, Index: 0}},
+		{nested, "c", Symbol{Name: "c", Scope: FreeScope, Index: 1}},
+	}
+
+	for _, tt := range tests {
+		result, ok := tt.table.Resolve(tt.name)
+		if !ok {
+			t.Errorf("name %s not resolvable", tt.name)
+			continue
+		}
+		if result != tt.expected {
+			t.Errorf("expected %s to resolve to %+v, got=%+v", tt.name, tt.expected, result)
+		}
+	}
+
+	if local.NumDefinitions() != 3 {
+		t.Errorf("block definitions not allocated from function. got=%d", local.NumDefinitions())
+	}
+
+	if nested.FreeSymbols[0].Index != 2 {
+		t.Errorf("free symbol should capture the shadowing b. got=%+v", nested.FreeSymbols[0])
+	}
+}
+
+func TestDefineGlobalFromNestedScope(t *testing.T) {
+	global := NewSymbolTable()
+	local := NewEnclosedSymbolTable(global)
+
+	symbol := local.DefineGlobal("later")
+	if symbol.Scope != GlobalScope || symbol.Index != 0 {
+		t.Fatalf("wrong symbol for late global. got=%+v", symbol)
+	}
+
+	if result, ok := local.Resolve("later"); !ok || result != symbol {
+		t.Errorf("late global not resolvable from local scope. got=%+v", result)
+	}
+}
@@ -0,0 +1,105 @@
+// Package diagnostic describes problems found in a program, by the lexer,
+// the parser or at run time, in a form that can be shown together with the
+// source they refer to.
+package diagnostic
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+type Severity int
+
+const (
+	Error Severity = iota
+	Warning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Warning:
+		return "warning"
+	default:
+		return "error"
+	}
+}
+
+// Diagnostic is a problem at a place in a source file. Line and Column
+// count from 1, and Column and Span count characters, not bytes. Span is
+// how many characters the problem covers, of which at least one is always
+// underlined. Hint, if not empty, suggests a fix.
+type Diagnostic struct {
+	Severity Severity
+	File     string
+	Line     int
+	Column   int
+	Span     int
+	Message  string
+	Hint     string
+}
+
+// String describes the diagnostic on one line, without the source.
+func (d Diagnostic) String() string {
+	location := fmt.Sprintf("%d:%d", d.Line, d.Column)
+	if d.File != "" {
+		location = d.File + ":" + location
+	}
+
+	return fmt.Sprintf("%s: %s: %s", location, d.Severity, d.Message)
+}
+
+// Render describes the diagnostic followed by the line of source it refers
+// to, with the offending characters underlined, and the hint, if any. The
+// source line is left out if source does not have it.
+func (d Diagnostic) Render(source string) string {
+	var out bytes.Buffer
+
+	out.WriteString(d.String())
+	out.WriteString("\n")
+
+	lines := strings.Split(source, "\n")
+	if d.Line >= 1 && d.Line <= len(lines) {
+		line := []rune(strings.TrimRight(lines[d.Line-1], "\r"))
+		gutter := fmt.Sprintf("%5d | ", d.Line)
+		margin := strings.Repeat(" ", len(gutter)-2) + "| "
+
+		out.WriteString(gutter)
+		out.WriteString(string(line))
+		out.WriteString("\n")
+		out.WriteString(margin)
+		out.WriteString(underline(line, d.Column, d.Span))
+		out.WriteString("\n")
+	}
+
+	if d.Hint != "" {
+		out.WriteString(fmt.Sprintf("%5s = hint: %s\n", "", d.Hint))
+	}
+
+	return out.String()
+}
+
+// underline returns carets under span characters of line starting at
+// column, indented with the same tabs as the line so that they line up.
+func underline(line []rune, column, span int) string {
+	var out strings.Builder
+
+	for i := 0; i < column-1; i++ {
+		if i < len(line) && line[i] == '\t' {
+			out.WriteRune('\t')
+		} else {
+			out.WriteRune(' ')
+		}
+	}
+
+	if column-1+span > len(line) {
+		span = len(line) - (column - 1)
+	}
+	if span < 1 {
+		span = 1
+	}
+
+	out.WriteString(strings.Repeat("^", span))
+
+	return out.String()
+}
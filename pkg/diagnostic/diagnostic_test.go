@@ -0,0 +1,68 @@
+package diagnostic
+
+import "testing"
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		diagnostic Diagnostic
+		expected   string
+	}{
+		{Diagnostic{Line: 3, Column: 7, Message: "oops"}, "3:7: error: oops"},
+		{Diagnostic{Severity: Warning, File: "a.mky", Line: 1, Column: 2, Message: "hmm"}, "a.mky:1:2: warning: hmm"},
+	}
+
+	for _, tt := range tests {
+		if tt.diagnostic.String() != tt.expected {
+			t.Errorf("wrong string. want=%q, got=%q", tt.expected, tt.diagnostic.String())
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	source := "let a = 1;\n\tlet b = a + zz;\nlet c = \"x\""
+
+	tests := []struct {
+		diagnostic Diagnostic
+		expected   string
+	}{
+		{
+			Diagnostic{File: "a.mky", Line: 1, Column: 5, Span: 1, Message: "oops"},
+			"a.mky:1:5: error: oops\n" +
+				"    1 | let a = 1;\n" +
+				"      |     ^\n",
+		},
+		{
+			Diagnostic{Line: 2, Column: 14, Span: 2, Message: "identifier not found: zz", Hint: "declare it"},
+			"2:14: error: identifier not found: zz\n" +
+				"    2 | \tlet b = a + zz;\n" +
+				"      | \t            ^^\n" +
+				"      = hint: declare it\n",
+		},
+		{
+			// The span is cut short at the end of the line.
+			Diagnostic{Line: 3, Column: 9, Span: 10, Message: "m"},
+			"3:9: error: m\n" +
+				"    3 | let c = \"x\"\n" +
+				"      |         ^^^\n",
+		},
+		{
+			// An empty span still underlines one character.
+			Diagnostic{Line: 3, Column: 12, Message: "m"},
+			"3:12: error: m\n" +
+				"    3 | let c = \"x\"\n" +
+				"      |            ^\n",
+		},
+		{
+			// Lines outside the source are not shown.
+			Diagnostic{Line: 9, Column: 1, Message: "m", Hint: "h"},
+			"9:1: error: m\n" +
+				"      = hint: h\n",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.diagnostic.Render(source); got != tt.expected {
+			t.Errorf("wrong rendering. want=\n%s\ngot=\n%s", tt.expected, got)
+		}
+	}
+}
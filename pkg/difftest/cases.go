@@ -0,0 +1,120 @@
+package difftest
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Case is a program taken from a Go test file.
+type Case struct {
+	Name  string
+	Input string
+}
+
+// ExtractCases extracts the programs of the tests in a Go test file, so
+// that they can be run through both engines without keeping copies of them
+// that would drift. Programs are found the ways the evaluator's tests hold
+// them: as the first field of the entries of a table of test cases, as a
+// string assigned to a variable named input, and as a string passed
+// straight to testEval.
+func ExtractCases(filename string) ([]Case, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	cases := []Case{}
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || !strings.HasPrefix(fn.Name.Name, "Test") || fn.Body == nil {
+			continue
+		}
+
+		inputs := []string{}
+		ast.Inspect(fn.Body, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CompositeLit:
+				if table, ok := n.Type.(*ast.ArrayType); ok {
+					if _, ok := table.Elt.(*ast.StructType); ok {
+						for _, entry := range n.Elts {
+							if input, ok := firstString(entry); ok {
+								inputs = append(inputs, input)
+							}
+						}
+						return false
+					}
+				}
+			case *ast.CallExpr:
+				if ident, ok := n.Fun.(*ast.Ident); ok && ident.Name == "testEval" && len(n.Args) == 1 {
+					if input, ok := stringLiteral(n.Args[0]); ok {
+						inputs = append(inputs, input)
+					}
+				}
+			case *ast.AssignStmt:
+				if len(n.Lhs) == 1 && len(n.Rhs) == 1 {
+					if ident, ok := n.Lhs[0].(*ast.Ident); ok && ident.Name == "input" {
+						if input, ok := stringLiteral(n.Rhs[0]); ok {
+							inputs = append(inputs, input)
+						}
+					}
+				}
+			}
+			return true
+		})
+
+		name := snakeCase(strings.TrimPrefix(fn.Name.Name, "Test"))
+		for i, input := range inputs {
+			cases = append(cases, Case{Name: fmt.Sprintf("%s_%02d", name, i+1), Input: input})
+		}
+	}
+
+	return cases, nil
+}
+
+// firstString returns the first field of a test case if it is a string.
+func firstString(entry ast.Expr) (string, bool) {
+	lit, ok := entry.(*ast.CompositeLit)
+	if !ok || len(lit.Elts) == 0 {
+		return "", false
+	}
+
+	first := lit.Elts[0]
+	if kv, ok := first.(*ast.KeyValueExpr); ok {
+		first = kv.Value
+	}
+
+	return stringLiteral(first)
+}
+
+func stringLiteral(expr ast.Expr) (string, bool) {
+	lit, ok := expr.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false
+	}
+
+	s, err := strconv.Unquote(lit.Value)
+	return s, err == nil
+}
+
+// snakeCase turns a Go name such as EvalIntegerExpression into
+// eval_integer_expression.
+func snakeCase(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
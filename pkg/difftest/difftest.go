@@ -0,0 +1,186 @@
+// Package difftest runs programs through both the tree-walking evaluator
+// and the bytecode VM and reports where their behaviour differs.
+package difftest
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hculpan/kabkey/pkg/ast"
+	"github.com/hculpan/kabkey/pkg/compiler"
+	"github.com/hculpan/kabkey/pkg/evaluator"
+	"github.com/hculpan/kabkey/pkg/lexer"
+	"github.com/hculpan/kabkey/pkg/object"
+	"github.com/hculpan/kabkey/pkg/parser"
+	"github.com/hculpan/kabkey/pkg/resolver"
+	"github.com/hculpan/kabkey/pkg/vm"
+)
+
+// Result is what running a program observably did.
+type Result struct {
+	Stdout string
+	Value  string
+	Error  string
+
+	// Err is the runtime error, if any, for comparing how it is shown.
+	Err *object.Error
+}
+
+// Parse parses a program, returning the lexer and parser errors as one
+// error if there are any.
+func Parse(input string) (*ast.Program, error) {
+	l := lexer.NewLexer(input)
+	p := parser.NewParser(l)
+	program := p.ParseProgram()
+
+	errors := append(l.Errors(), p.Errors()...)
+	if len(errors) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errors, "\n"))
+	}
+
+	return program, nil
+}
+
+func RunEvaluator(program *ast.Program) (result Result) {
+	var out bytes.Buffer
+	defer capture(&out, &result)()
+
+	resolver.Resolve(program)
+
+	env := object.NewEnvironment()
+	evaluator.LoadBuiltins(env)
+
+	value := evaluator.Eval(program, env)
+	if errObj, ok := value.(*object.Error); ok {
+		result.Error = errObj.Error()
+		result.Err = errObj
+	} else {
+		result.Value = describe(value)
+	}
+
+	return result
+}
+
+func RunVM(program *ast.Program) (result Result) {
+	var out bytes.Buffer
+	defer capture(&out, &result)()
+
+	comp := compiler.New()
+	if err := comp.Compile(program); err != nil {
+		result.Error = "compile error: " + err.Error()
+		return result
+	}
+
+	machine := vm.New(comp.Bytecode())
+	if err := machine.Run(); err != nil {
+		result.Error = err.Error()
+		result.Err, _ = err.(*object.Error)
+	} else {
+		result.Value = describe(machine.LastPoppedStackElem())
+	}
+
+	return result
+}
+
+// capture sends builtin output to out until the returned function is
+// called. That function also turns a Go panic into the result's error, so
+// that an engine crashing is reported like any other difference.
+func capture(out *bytes.Buffer, result *Result) func() {
+	evaluator.SetOutput(out)
+
+	return func() {
+		if r := recover(); r != nil {
+			result.Error = fmt.Sprintf("panic: %v", r)
+		}
+
+		evaluator.SetOutput(os.Stdout)
+		result.Stdout = out.String()
+	}
+}
+
+// describe renders a program's final value. The evaluator yields nothing
+// for a program ending in a let statement where the VM yields null, so
+// that is normalised.
+func describe(value object.Object) string {
+	if value == nil {
+		return "null"
+	}
+
+	return value.Inspect()
+}
+
+// Diff returns a readable report of how two results differ, or "" if they
+// are the same.
+func Diff(evaluated, compiled Result) string {
+	var out bytes.Buffer
+
+	diffField(&out, "stdout", evaluated.Stdout, compiled.Stdout)
+	diffField(&out, "value", evaluated.Value, compiled.Value)
+	diffField(&out, "error", evaluated.Error, compiled.Error)
+
+	if out.Len() == 0 {
+		return ""
+	}
+
+	return "--- evaluator\n+++ vm\n" + out.String()
+}
+
+// DiffRendered returns a readable report of how the two results' errors
+// differ when shown with source, as the interpreter and kabv show them, or
+// "" if they are shown the same.
+func DiffRendered(source string, evaluated, compiled Result) string {
+	var out bytes.Buffer
+
+	diffField(&out, "rendered error", render(source, evaluated.Err), render(source, compiled.Err))
+
+	if out.Len() == 0 {
+		return ""
+	}
+
+	return "--- evaluator\n+++ vm\n" + out.String()
+}
+
+func render(source string, errObj *object.Error) string {
+	if errObj == nil {
+		return ""
+	}
+
+	return errObj.Render(source)
+}
+
+func diffField(out *bytes.Buffer, name, evaluated, compiled string) {
+	if evaluated == compiled {
+		return
+	}
+
+	fmt.Fprintf(out, "@@ %s @@\n", name)
+
+	a := splitLines(evaluated)
+	b := splitLines(compiled)
+
+	for i := 0; i < len(a) || i < len(b); i++ {
+		switch {
+		case i < len(a) && i < len(b) && a[i] == b[i]:
+			fmt.Fprintf(out, "  %s\n", a[i])
+		default:
+			if i < len(a) {
+				fmt.Fprintf(out, "- %s\n", a[i])
+			}
+			if i < len(b) {
+				fmt.Fprintf(out, "+ %s\n", b[i])
+			}
+		}
+	}
+}
+
+// splitLines splits s into lines, marking an empty value so that it shows
+// up in a diff.
+func splitLines(s string) []string {
+	if s == "" {
+		return []string{"(none)"}
+	}
+
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
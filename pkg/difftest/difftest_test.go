@@ -0,0 +1,143 @@
+package difftest
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var corpus = flag.String("corpus", "testdata", "directory of .mky programs to run through both engines")
+
+// extraPrograms are run in addition to the corpus.
+var extraPrograms = []string{"../../test.mky"}
+
+func TestEnginesAgree(t *testing.T) {
+	files := append([]string{}, extraPrograms...)
+
+	err := filepath.WalkDir(*corpus, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && filepath.Ext(path) == ".mky" {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("reading corpus: %s", err)
+	}
+
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Errorf("%s: %s", file, err)
+			continue
+		}
+
+		program, err := Parse(string(content))
+		if err != nil {
+			t.Errorf("%s: does not parse:\n%s", file, err)
+			continue
+		}
+
+		evaluated, compiled := RunEvaluator(program), RunVM(program)
+		if diff := Diff(evaluated, compiled); diff != "" {
+			t.Errorf("%s: engines disagree\n%s", file, diff)
+		} else if diff := DiffRendered(string(content), evaluated, compiled); diff != "" {
+			t.Errorf("%s: engines show the error differently\n%s", file, diff)
+		}
+	}
+}
+
+// evaluatorTests holds the evaluator's own tests, whose programs are run
+// through both engines as well.
+const evaluatorTests = "../evaluator/evaluator_test.go"
+
+func TestEvaluatorCasesAgree(t *testing.T) {
+	cases, err := ExtractCases(evaluatorTests)
+	if err != nil {
+		t.Fatalf("reading evaluator tests: %s", err)
+	}
+	if len(cases) == 0 {
+		t.Fatalf("no programs found in %s", evaluatorTests)
+	}
+
+	for _, c := range cases {
+		program, err := Parse(c.Input)
+		if err != nil {
+			t.Errorf("%s: does not parse:\n%s", c.Name, err)
+			continue
+		}
+
+		evaluated, compiled := RunEvaluator(program), RunVM(program)
+		if diff := Diff(evaluated, compiled); diff != "" {
+			t.Errorf("%s: %q: engines disagree\n%s", c.Name, c.Input, diff)
+		} else if diff := DiffRendered(c.Input, evaluated, compiled); diff != "" {
+			t.Errorf("%s: %q: engines show the error differently\n%s", c.Name, c.Input, diff)
+		}
+	}
+}
+
+func TestExtractCases(t *testing.T) {
+	source := "package p\n\n" +
+		"func TestSums(t *testing.T) {\n" +
+		"\ttests := []struct {\n\t\tinput string\n\t\twant  int\n\t}{\n" +
+		"\t\t{\"1 + 1\", 2},\n\t\t{input: `2 + 2`, want: 4},\n\t}\n" +
+		"\tinput := \"let a = 1;\"\n" +
+		"\ttestEval(\"3\")\n" +
+		"\tother := \"not a program\"\n" +
+		"}\n\n" +
+		"func helper() { testEval(\"4\") }\n"
+
+	filename := filepath.Join(t.TempDir(), "p_test.go")
+	if err := os.WriteFile(filename, []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases, err := ExtractCases(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Case{
+		{Name: "sums_01", Input: "1 + 1"},
+		{Name: "sums_02", Input: "2 + 2"},
+		{Name: "sums_03", Input: "let a = 1;"},
+		{Name: "sums_04", Input: "3"},
+	}
+
+	if len(cases) != len(expected) {
+		t.Fatalf("wrong cases. want=%+v, got=%+v", expected, cases)
+	}
+
+	for i, c := range expected {
+		if cases[i] != c {
+			t.Errorf("wrong case %d. want=%+v, got=%+v", i, c, cases[i])
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	evaluated := Result{Stdout: "a\nb\n", Value: "1"}
+	compiled := Result{Stdout: "a\nc\n", Error: "[1:2] oops"}
+
+	expected := `--- evaluator
++++ vm
+@@ stdout @@
+  a
+- b
++ c
+@@ value @@
+- 1
++ (none)
+@@ error @@
+- (none)
++ [1:2] oops
+`
+
+	if diff := Diff(evaluated, compiled); diff != expected {
+		t.Errorf("wrong diff.\nwant=\n%s\ngot=\n%s", expected, diff)
+	}
+
+	if diff := Diff(evaluated, evaluated); diff != "" {
+		t.Errorf("expected no diff for equal results. got=\n%s", diff)
+	}
+}
@@ -1,12 +1,24 @@
 package evaluator
 
 import (
-	"bytes"
 	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/hculpan/kabkey/pkg/object"
 )
 
+var output io.Writer = os.Stdout
+
+// SetOutput redirects what the print builtins write, which is standard
+// output by default.
+func SetOutput(w io.Writer) {
+	output = w
+}
+
 var builtins = map[string]object.BuiltinFunction{
 	"print":   print,
 	"println": println,
@@ -14,6 +26,14 @@ var builtins = map[string]object.BuiltinFunction{
 	"printf":  printf,
 	"inspect": inspect,
 	"type":    typeout,
+	"push":    push,
+	"first":   first,
+	"last":    last,
+	"rest":    rest,
+	"keys":    keys,
+	"values":  values,
+	"has":     has,
+	"delete":  deleteKey,
 }
 
 func typeout(env *object.Environment, args []object.Object) object.Object {
@@ -39,12 +59,21 @@ func printf(env *object.Environment, args []object.Object) object.Object {
 		return &object.Error{Message: fmt.Sprintf("first parameter to 'printf' must be %s, got %s", string(object.STRING_OBJ), args[0].Type())}
 	}
 
+	format := args[0].(*object.String).Value
+	verbs := formatVerbs(format)
+
 	params := []interface{}{}
 	for i, a := range args[1:] {
 		switch t := a.(type) {
 		case *object.Boolean:
 			params = append(params, t.Value)
 		case *object.Integer:
+			if i < len(verbs) && isFloatVerb(verbs[i]) {
+				params = append(params, float64(t.Value))
+			} else {
+				params = append(params, t.Value)
+			}
+		case *object.Float:
 			params = append(params, t.Value)
 		case *object.String:
 			params = append(params, t.Value)
@@ -53,40 +82,35 @@ func printf(env *object.Environment, args []object.Object) object.Object {
 		}
 	}
 
-	fmt.Printf(replaceEscapedChars(args[0].(*object.String).Value), params...)
+	fmt.Fprintf(output, format, params...)
 	return nil
 }
 
-// ReplaceEscapedChars replaces escaped characters with their ASCII values.
-func replaceEscapedChars(s string) string {
-	var buffer bytes.Buffer
-
-	for i := 0; i < len(s); i++ {
-		if s[i] == '\\' {
-			if i+1 < len(s) {
-				next := s[i+1]
-				switch next {
-				case 'n':
-					buffer.WriteByte('\n')
-				case 't':
-					buffer.WriteByte('\t')
-				case '\\':
-					buffer.WriteByte('\\')
-				// Add other escape sequences here as needed
-				default:
-					buffer.WriteByte('\\')
-					buffer.WriteByte(next)
-				}
-				i++ // Skip the next character as it is part of the escape sequence
-			} else {
-				buffer.WriteByte('\\')
-			}
-		} else {
-			buffer.WriteByte(s[i])
+// formatVerbs returns the verb character of each directive in a printf
+// format string, in order, ignoring literal percent signs.
+func formatVerbs(format string) []byte {
+	result := []byte{}
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+
+		i++
+		for i < len(format) && strings.IndexByte("+-# 0123456789.", format[i]) >= 0 {
+			i++
+		}
+
+		if i < len(format) && format[i] != '%' {
+			result = append(result, format[i])
 		}
 	}
 
-	return buffer.String()
+	return result
+}
+
+func isFloatVerb(verb byte) bool {
+	return verb == 'f' || verb == 'F' || verb == 'g' || verb == 'G' || verb == 'e' || verb == 'E'
 }
 
 func print(env *object.Environment, args []object.Object) object.Object {
@@ -96,14 +120,14 @@ func print(env *object.Environment, args []object.Object) object.Object {
 		result.Value += o.Inspect()
 	}
 
-	fmt.Print(result.Value)
+	fmt.Fprint(output, result.Value)
 
 	return nil
 }
 
 func println(env *object.Environment, args []object.Object) object.Object {
 	result := print(env, args)
-	fmt.Println()
+	fmt.Fprintln(output)
 	return result
 }
 
@@ -116,14 +140,192 @@ func length(env *object.Environment, args []object.Object) object.Object {
 
 	switch t := args[0].(type) {
 	case *object.String:
-		return &object.Integer{Value: int64(len(t.Value))}
+		return &object.Integer{Value: int64(utf8.RuneCountInString(t.Value))}
+	case *object.Array:
+		return &object.Integer{Value: int64(len(t.Elements))}
+	case *object.Hash:
+		return &object.Integer{Value: int64(len(t.Pairs))}
 	default:
 		return &object.Error{Message: fmt.Sprintf("type %s not support for 'length'", args[0].Type())}
 	}
 }
 
+func push(env *object.Environment, args []object.Object) object.Object {
+	if len(args) != 2 {
+		return &object.Error{Message: fmt.Sprintf("incorrect number of parameters to 'push': expected 2, got %d", len(args))}
+	}
+
+	array, ok := args[0].(*object.Array)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("first parameter to 'push' must be %s, got %s", string(object.ARRAY_OBJ), args[0].Type())}
+	}
+
+	elements := make([]object.Object, len(array.Elements), len(array.Elements)+1)
+	copy(elements, array.Elements)
+
+	return &object.Array{Elements: append(elements, args[1])}
+}
+
+func first(env *object.Environment, args []object.Object) object.Object {
+	array, err := singleArrayParameter("first", args)
+	if err != nil {
+		return err
+	}
+
+	if len(array.Elements) == 0 {
+		return NULL
+	}
+
+	return array.Elements[0]
+}
+
+func last(env *object.Environment, args []object.Object) object.Object {
+	array, err := singleArrayParameter("last", args)
+	if err != nil {
+		return err
+	}
+
+	if len(array.Elements) == 0 {
+		return NULL
+	}
+
+	return array.Elements[len(array.Elements)-1]
+}
+
+func rest(env *object.Environment, args []object.Object) object.Object {
+	array, err := singleArrayParameter("rest", args)
+	if err != nil {
+		return err
+	}
+
+	if len(array.Elements) == 0 {
+		return NULL
+	}
+
+	elements := make([]object.Object, len(array.Elements)-1)
+	copy(elements, array.Elements[1:])
+
+	return &object.Array{Elements: elements}
+}
+
+func singleArrayParameter(name string, args []object.Object) (*object.Array, *object.Error) {
+	if len(args) != 1 {
+		return nil, &object.Error{Message: fmt.Sprintf("incorrect number of parameters to '%s': expected 1, got %d", name, len(args))}
+	}
+
+	array, ok := args[0].(*object.Array)
+	if !ok {
+		return nil, &object.Error{Message: fmt.Sprintf("parameter to '%s' must be %s, got %s", name, string(object.ARRAY_OBJ), args[0].Type())}
+	}
+
+	return array, nil
+}
+
+func keys(env *object.Environment, args []object.Object) object.Object {
+	if len(args) != 1 {
+		return &object.Error{Message: fmt.Sprintf("incorrect number of parameters to 'keys': expected 1, got %d", len(args))}
+	}
+
+	hash, ok := args[0].(*object.Hash)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("parameter to 'keys' must be %s, got %s", string(object.HASH_OBJ), args[0].Type())}
+	}
+
+	result := &object.Array{Elements: []object.Object{}}
+	for _, pair := range hash.OrderedPairs() {
+		result.Elements = append(result.Elements, pair.Key)
+	}
+
+	return result
+}
+
+func values(env *object.Environment, args []object.Object) object.Object {
+	if len(args) != 1 {
+		return &object.Error{Message: fmt.Sprintf("incorrect number of parameters to 'values': expected 1, got %d", len(args))}
+	}
+
+	hash, ok := args[0].(*object.Hash)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("parameter to 'values' must be %s, got %s", string(object.HASH_OBJ), args[0].Type())}
+	}
+
+	result := &object.Array{Elements: []object.Object{}}
+	for _, pair := range hash.OrderedPairs() {
+		result.Elements = append(result.Elements, pair.Value)
+	}
+
+	return result
+}
+
+func has(env *object.Environment, args []object.Object) object.Object {
+	hash, key, err := hashAndKeyParameters("has", args)
+	if err != nil {
+		return err
+	}
+
+	_, ok := hash.Get(key)
+	return nativeBoolToBooleanObject(ok)
+}
+
+// deleteKey returns a copy of the hash without the given key, leaving the
+// original untouched in the same way push does for arrays.
+func deleteKey(env *object.Environment, args []object.Object) object.Object {
+	hash, key, err := hashAndKeyParameters("delete", args)
+	if err != nil {
+		return err
+	}
+
+	result := object.NewHash()
+	removed := key.HashKey()
+	for _, hashKey := range hash.Order {
+		if hashKey == removed {
+			continue
+		}
+
+		pair := hash.Pairs[hashKey]
+		result.Set(pair.Key.(object.Hashable), pair.Value)
+	}
+
+	return result
+}
+
+func hashAndKeyParameters(name string, args []object.Object) (*object.Hash, object.Hashable, *object.Error) {
+	if len(args) != 2 {
+		return nil, nil, &object.Error{Message: fmt.Sprintf("incorrect number of parameters to '%s': expected 2, got %d", name, len(args))}
+	}
+
+	hash, ok := args[0].(*object.Hash)
+	if !ok {
+		return nil, nil, &object.Error{Message: fmt.Sprintf("first parameter to '%s' must be %s, got %s", name, string(object.HASH_OBJ), args[0].Type())}
+	}
+
+	key, ok := args[1].(object.Hashable)
+	if !ok {
+		return nil, nil, &object.Error{Message: fmt.Sprintf("unusable as hash key: %s", args[1].Type())}
+	}
+
+	return hash, key, nil
+}
+
+// BuiltinNames returns the names of all builtin functions in sorted order.
+// The compiler and VM refer to builtins by their index in this list.
+func BuiltinNames() []string {
+	names := make([]string, 0, len(builtins))
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func GetBuiltin(name string) (object.BuiltinFunction, bool) {
+	fn, ok := builtins[name]
+	return fn, ok
+}
+
 func LoadBuiltins(env *object.Environment) {
 	for k, v := range builtins {
-		env.Set(k, &object.Function{Env: env, NativeImpl: v})
+		env.Set(k, &object.Function{Name: k, Env: env, NativeImpl: v})
 	}
 }
@@ -1,16 +1,235 @@
 package evaluator
 
 import (
+	"bytes"
+	"os"
 	"testing"
 
+	"github.com/hculpan/kabkey/pkg/diagnostic"
 	"github.com/hculpan/kabkey/pkg/lexer"
 	"github.com/hculpan/kabkey/pkg/object"
 	"github.com/hculpan/kabkey/pkg/parser"
+	"github.com/hculpan/kabkey/pkg/resolver"
 )
 
 func TestBuiltinFunctions(t *testing.T) {
 	input := `len("hello")`
 	testIntegerObject(t, testEval(input), 5)
+
+	testIntegerObject(t, testEval(`len("héllo")`), 5)
+	testIntegerObject(t, testEval(`len("a\tb\u{1F600}")`), 4)
+}
+
+func TestArrayBuiltinFunctions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`len([1, 2, 3])`, 3},
+		{`len([])`, 0},
+		{`first([1, 2, 3])`, 1},
+		{`first([])`, nil},
+		{`last([1, 2, 3])`, 3},
+		{`last([])`, nil},
+		{`rest([1, 2, 3])`, []int{2, 3}},
+		{`rest([])`, nil},
+		{`push([], 1)`, []int{1}},
+		{`let a = [1]; push(a, 2); a`, []int{1}},
+		{`first(1)`, "parameter to 'first' must be ARRAY, got INTEGER"},
+		{`push(1, 1)`, "first parameter to 'push' must be ARRAY, got INTEGER"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case nil:
+			testNullObject(t, evaluated)
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		case []int:
+			testIntegerArray(t, evaluated, expected)
+		}
+	}
+}
+
+func TestArrayLiterals(t *testing.T) {
+	input := "[1, 2 * 2, 3 + 3]"
+	testIntegerArray(t, testEval(input), []int{1, 4, 6})
+}
+
+func TestArrayIndexExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"[1, 2, 3][0]", 1},
+		{"[1, 2, 3][1]", 2},
+		{"[1, 2, 3][2]", 3},
+		{"let i = 0; [1][i];", 1},
+		{"[1, 2, 3][1 + 1];", 3},
+		{"let myArray = [1, 2, 3]; myArray[2];", 3},
+		{"let myArray = [1, 2, 3]; myArray[0] + myArray[1] + myArray[2];", 6},
+		{"let myArray = [1, 2, 3]; let i = myArray[0]; myArray[i]", 2},
+		{"[1, 2, 3][3]", "index out of bounds: 3 (length 3)"},
+		{"[1, 2, 3][-1]", "index out of bounds: -1 (length 3)"},
+		{"1[0]", "index operator not supported: INTEGER[INTEGER]"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestHashLiterals(t *testing.T) {
+	input := `let two = "two";
+	{
+		"one": 10 - 9,
+		two: 1 + 1,
+		"thr" + "ee": 6 / 2,
+		4: 4,
+		true: 5,
+		false: 6
+	}`
+
+	evaluated := testEval(input)
+	result, ok := evaluated.(*object.Hash)
+	if !ok {
+		t.Fatalf("Eval didn't return Hash. got=%T (%+v)", evaluated, evaluated)
+	}
+
+	expected := map[object.HashKey]int64{
+		(&object.String{Value: "one"}).HashKey():   1,
+		(&object.String{Value: "two"}).HashKey():   2,
+		(&object.String{Value: "three"}).HashKey(): 3,
+		(&object.Integer{Value: 4}).HashKey():      4,
+		TRUE.HashKey():                             5,
+		FALSE.HashKey():                            6,
+	}
+
+	if len(result.Pairs) != len(expected) {
+		t.Fatalf("Hash has wrong num of pairs. got=%d", len(result.Pairs))
+	}
+
+	for expectedKey, expectedValue := range expected {
+		pair, ok := result.Pairs[expectedKey]
+		if !ok {
+			t.Errorf("no pair for given key in Pairs")
+		}
+
+		testIntegerObject(t, pair.Value, expectedValue)
+	}
+
+	if result.Inspect() != "{one: 1, two: 2, three: 3, 4: 4, true: 5, false: 6}" {
+		t.Errorf("hash inspect wrong. got=%q", result.Inspect())
+	}
+}
+
+func TestHashIndexExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`{"foo": 5}["foo"]`, 5},
+		{`{"foo": 5}["bar"]`, nil},
+		{`let key = "foo"; {"foo": 5}[key]`, 5},
+		{`{}["foo"]`, nil},
+		{`{5: 5}[5]`, 5},
+		{`{true: 5}[true]`, 5},
+		{`{false: 5}[false]`, 5},
+		{`{"name": "kabkey"}[fn(x) { x }]`, "unusable as hash key: FUNCTION"},
+		{`{[1]: 2}`, "unusable as hash key: ARRAY"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case nil:
+			testNullObject(t, evaluated)
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestHashBuiltinFunctions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`len({"a": 1, "b": 2})`, 2},
+		{`keys({"a": 1, 2: 2})`, "[a, 2]"},
+		{`values({"a": 1, 2: true})`, "[1, true]"},
+		{`keys({})`, "[]"},
+		{`has({"a": 1}, "a")`, true},
+		{`has({"a": 1}, "b")`, false},
+		{`delete({"a": 1, "b": 2}, "a")`, "{b: 2}"},
+		{`let h = {"a": 1}; delete(h, "a"); h`, "{a: 1}"},
+		{`delete({"a": 1}, "z")`, "{a: 1}"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case string:
+			if evaluated == nil || evaluated.Inspect() != expected {
+				t.Errorf("wrong result for %q. expected=%q, got=%+v", tt.input, expected, evaluated)
+			}
+		}
+	}
+}
+
+func testIntegerArray(t *testing.T, obj object.Object, expected []int) bool {
+	array, ok := obj.(*object.Array)
+	if !ok {
+		t.Errorf("object is not Array. got=%T (%+v)", obj, obj)
+		return false
+	}
+	if len(array.Elements) != len(expected) {
+		t.Errorf("wrong number of elements. want=%d, got=%d", len(expected), len(array.Elements))
+		return false
+	}
+	for i, el := range expected {
+		if !testIntegerObject(t, array.Elements[i], int64(el)) {
+			return false
+		}
+	}
+	return true
 }
 
 func TestClosures(t *testing.T) {
@@ -64,6 +283,73 @@ func TestFunctionObject(t *testing.T) {
 	}
 }
 
+func TestFunctionDeclarations(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"fn add(a, b) { a + b }; add(1, 2)", 3},
+		{"fn fact(n) { if (n < 2) { 1 } else { n * fact(n - 1) } }\nfact(5)", 120},
+		{`fn isEven(n) { if (n == 0) { true } else { isOdd(n - 1) } }
+		  fn isOdd(n) { if (n == 0) { false } else { isEven(n - 1) } }
+		  if (isEven(10) && isOdd(7)) { 1 } else { 0 }`, 1},
+		{`let f = fn(n) {
+			fn even(n) { if (n == 0) { 1 } else { odd(n - 1) } }
+			fn odd(n) { if (n == 0) { 0 } else { even(n - 1) } }
+			even(n)
+		  };
+		  f(6) + f(3)`, 1},
+		{"let n = 1; fn f() { n }; let n = 2; f()", 2},
+		{"fn f() { 1 }; fn f() { 2 }; f()", 2},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+func TestFunctionInspect(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"fn(x) { x }", "fn(x) {\nx\n}"},
+		{"fn add(a, b) { a + b }; add", "fn add(a, b) {\n(a + b)\n}"},
+		{"let add = fn(a, b) { a + b }; add", "fn add(a, b) {\n(a + b)\n}"},
+		{"let add = fn(a, b) { a + b }; let plus = add; plus", "fn add(a, b) {\n(a + b)\n}"},
+		{"len", "builtin function len"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%q: wrong inspect. want=%q, got=%q", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestFunctionNamesInStackTraces(t *testing.T) {
+	input := `fn boom() { 1 / 0 }
+let apply = fn(f) { f() + 0 };
+apply(boom)`
+
+	errObj, ok := testEval(input).(*object.Error)
+	if !ok {
+		t.Fatalf("no error object returned")
+	}
+
+	expected := []string{"boom", "apply"}
+	if len(errObj.Stack) != len(expected) {
+		t.Fatalf("wrong stack. want=%v, got=%+v", expected, errObj.Stack)
+	}
+
+	for i, name := range expected {
+		if errObj.Stack[i].Function != name {
+			t.Errorf("wrong function in frame %d. want=%q, got=%q", i, name, errObj.Stack[i].Function)
+		}
+	}
+}
+
 func TestLetStatements(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -80,6 +366,109 @@ func TestLetStatements(t *testing.T) {
 	}
 }
 
+func TestAssignExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"let a = 5; a = 10; a;", 10},
+		{"let a = 5; a = a + 1;", 6},
+		{"let a = 1; let b = 2; a = b = 3; a + b;", 6},
+		{"let a = 1; let f = fn() { a = a + 1; }; f(); f(); a;", 3},
+		{"let a = 1; let f = fn() { let a = 10; a = 20; }; f(); a;", 1},
+		{"let a = 0; let f = fn() { fn() { a = 7; } }; f()(); a;", 7},
+		{"let i = 0; while (i < 5) { i = i + 1; }; i;", 5},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+func TestCompoundAssignExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let a = 5; a += 10; a;", 15},
+		{"let a = 5; a -= 10;", -5},
+		{"let a = 5; a *= 2; a;", 10},
+		{"let a = 5; a /= 2; a;", 2},
+		{"let a = 5; a %= 3; a;", 2},
+		{`let s = "a"; s += "b"; s;`, "ab"},
+		{"let a = 1; let f = fn() { a += 1; }; f(); a;", 2},
+		{"let i = 0; let total = 0; while (i < 4) { total += i; i++; }; total;", 6},
+		{"let i = 5; i++;", 5},
+		{"let i = 5; i++; i;", 6},
+		{"let i = 5; ++i;", 6},
+		{"let i = 5; i--;", 5},
+		{"let i = 5; --i;", 4},
+		{"7 % 3", 1},
+	}
+
+	for _, tt := range tests {
+		testLiteralObject(t, testEval(tt.input), tt.expected)
+	}
+
+	testFloatObject(t, testEval("let f = 1; f += 0.5; f"), 1.5)
+	testFloatObject(t, testEval("7.5 % 2"), 1.5)
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let count = fn(n) { if (n == 0) { return 0; } return count(n - 1); }; count(100000);", 0},
+		{"let count = fn(n) { if (n == 0) { 0 } else { count(n - 1) } }; count(100000);", 0},
+		{"let sum = fn(n, acc) { if (n == 0) { return acc; } sum(n - 1, acc + n) }; sum(100000, 0);", 5000050000},
+		{`
+		let isEven = fn(n) { if (n == 0) { true } else { isOdd(n - 1) } };
+		let isOdd = fn(n) { if (n == 0) { false } else { isEven(n - 1) } };
+		isEven(100001)`, false},
+		{"let loop = fn(n) { while (true) { if (n == 0) { return 1; } return loop(n - 1); } }; loop(100000);", 1},
+		{"let f = fn(x) { x * 2 }; return f(21);", 42},
+		{`let f = fn() { len("abc") }; f()`, 3},
+	}
+
+	for _, tt := range tests {
+		testLiteralObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+func TestMaxCallDepth(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let sum = fn(n) { if (n == 0) { return 0; } n + sum(n - 1) }; sum(99);", 4950},
+		{"let sum = fn(n) { if (n == 0) { return 0; } n + sum(n - 1) }; sum(100);", "stack overflow: more than 100 nested calls"},
+		{"let count = fn(n) { if (n == 0) { return 0; } count(n - 1) }; count(1000);", 0},
+		{"let f = fn(n) { if (n == 0) { return 0; } f(n - 1) + 1 }; f(1000); f(10)", "stack overflow: more than 100 nested calls"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEvalWithMaxCallDepth(tt.input, 100)
+		if msg, ok := tt.expected.(string); ok {
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("no error object returned. got=%T(%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != msg {
+				t.Errorf("wrong error message. expected=%q, got=%q", msg, errObj.Message)
+			}
+			continue
+		}
+
+		testLiteralObject(t, evaluated, tt.expected)
+	}
+
+	// Each evaluation counts its own calls, so one that overflowed leaves
+	// nothing behind.
+	testIntegerObject(t, testEvalWithMaxCallDepth("let f = fn(n) { if (n == 0) { return 0; } f(n - 1) + 1 }; f(50)", 100), 50)
+}
+
 func TestErrorHandling(t *testing.T) {
 	tests := []struct {
 		input           string
@@ -93,6 +482,18 @@ func TestErrorHandling(t *testing.T) {
 		{"if (10 > 1) { true + false; }", "unsupported operation: BOOLEAN + BOOLEAN"},
 		{`if (10 > 1) { if (10 > 1) { return true + false; } return 1; } `, "unsupported operation: BOOLEAN + BOOLEAN"},
 		{"foobar", "identifier not found: foobar"},
+		{"foobar = 1", "assignment to undeclared variable: foobar"},
+		{"let f = fn() { x = 1; }; f();", "assignment to undeclared variable: x"},
+		{"x += 1", "identifier not found: x"},
+		{"let b = true; b++", "unsupported operation: BOOLEAN + INTEGER"},
+		{`let s = "a"; s -= "b"`, "unknown operator: STRING - STRING"},
+		{"1 / 0", "division by zero"},
+		{"let z = 0; 5 % z", "division by zero"},
+		{"let f = fn(a, b) { a }; f(1)", "wrong number of arguments: want=2, got=1"},
+		{"let f = fn(a) { a }; f(1, 2)", "wrong number of arguments: want=1, got=2"},
+		{"let f = fn() { }; f() + 1", "unsupported operation: NULL + INTEGER"},
+		{`let v = println(""); -v`, "unknown operator: -NULL"},
+		{"let v = if (true) { let a = 1 }; v + 1", "unsupported operation: NULL + INTEGER"},
 	}
 
 	for _, tt := range tests {
@@ -108,6 +509,169 @@ func TestErrorHandling(t *testing.T) {
 	}
 }
 
+func TestBuiltinErrorPositions(t *testing.T) {
+	tests := []struct {
+		input    string
+		lineNo   int
+		position int
+	}{
+		{"len(1, 2)", 1, 4},
+		{"let a = [];\nlet b = 1 + push(a)", 2, 17},
+		{"let f = fn(x) { first(x) }; f(1)", 1, 22},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("%q: no error object returned. got=%T(%+v)", tt.input, evaluated, evaluated)
+			continue
+		}
+		if errObj.LineNo != tt.lineNo || errObj.Position != tt.position {
+			t.Errorf("%q: wrong position. want=%d:%d, got=%d:%d", tt.input, tt.lineNo, tt.position, errObj.LineNo, errObj.Position)
+		}
+	}
+}
+
+func TestErrorStackTraces(t *testing.T) {
+	input := `let divide = fn(a, b) {
+	a / b
+};
+let average = fn(items) {
+	divide(len(items), len(items)) + 1
+};
+let apply = fn(f, x) { f(x) + 0 };
+apply(average, []);`
+
+	evaluated := testEval(input)
+	errObj, ok := evaluated.(*object.Error)
+	if !ok {
+		t.Fatalf("no error object returned. got=%T(%+v)", evaluated, evaluated)
+	}
+
+	expected := []object.StackFrame{
+		{Function: "divide", LineNo: 5, Position: 8},
+		{Function: "average", LineNo: 7, Position: 25},
+		{Function: "apply", LineNo: 8, Position: 6},
+	}
+
+	if len(errObj.Stack) != len(expected) {
+		t.Fatalf("wrong stack. want=%+v, got=%+v", expected, errObj.Stack)
+	}
+
+	for i, frame := range expected {
+		if errObj.Stack[i] != frame {
+			t.Errorf("wrong frame %d. want=%+v, got=%+v", i, frame, errObj.Stack[i])
+		}
+	}
+
+	object.SetExtendedErrorOutput(true)
+	defer object.SetExtendedErrorOutput(false)
+
+	traceback := "[2:4] ERROR: division by zero\n" +
+		"\tin divide called from [5:8]\n" +
+		"\tin average called from [7:25]\n" +
+		"\tin apply called from [8:6]"
+	if errObj.Inspect() != traceback {
+		t.Errorf("wrong traceback. want=\n%s\ngot=\n%s", traceback, errObj.Inspect())
+	}
+}
+
+func TestRecursionStackTraceIsCollapsed(t *testing.T) {
+	evaluated := testEvalWithMaxCallDepth("let f = fn(n) { 1 + f(n + 1) };\nf(0)", 50)
+	errObj, ok := evaluated.(*object.Error)
+	if !ok {
+		t.Fatalf("no error object returned. got=%T(%+v)", evaluated, evaluated)
+	}
+
+	object.SetExtendedErrorOutput(true)
+	defer object.SetExtendedErrorOutput(false)
+
+	traceback := "[1:22] ERROR: stack overflow: more than 50 nested calls\n" +
+		"\tin f called from [1:22]\n" +
+		"\t... repeated 48 more times\n" +
+		"\tin f called from [2:2]"
+	if errObj.Inspect() != traceback {
+		t.Errorf("wrong traceback. want=\n%s\ngot=\n%s", traceback, errObj.Inspect())
+	}
+}
+
+func TestErrorDiagnostic(t *testing.T) {
+	l := lexer.NewLexer("let a = 1;\nlet b = a + missing;")
+	l.SetFilename("main.mky")
+	program := parser.NewParser(l).ParseProgram()
+	env := object.NewEnvironment()
+
+	errObj, ok := Eval(program, env).(*object.Error)
+	if !ok {
+		t.Fatalf("no error object returned")
+	}
+
+	expected := diagnostic.Diagnostic{
+		File:    "main.mky",
+		Line:    2,
+		Column:  13,
+		Span:    7,
+		Message: "identifier not found: missing",
+		Hint:    "declare it first with let missing = ...",
+	}
+	if errObj.Diagnostic() != expected {
+		t.Errorf("wrong diagnostic. expected=%+v, got=%+v", expected, errObj.Diagnostic())
+	}
+}
+
+func TestPanicsBecomeErrors(t *testing.T) {
+	object.SetExtendedErrorOutput(false)
+	program := parser.NewParser(lexer.NewLexer("let a = 1;\nlet f = fn() { boom() };\nf();")).ParseProgram()
+	env := object.NewEnvironment()
+	env.Set("boom", &object.Function{NativeImpl: func(env *object.Environment, args []object.Object) object.Object {
+		panic("boom")
+	}})
+
+	errObj, ok := Eval(program, env).(*object.Error)
+	if !ok {
+		t.Fatalf("no error object returned")
+	}
+
+	if errObj.Message != "internal error: boom" {
+		t.Errorf("wrong error message. expected=%q, got=%q", "internal error: boom", errObj.Message)
+	}
+
+	// The panic is reported at the statement that was running.
+	if errObj.LineNo != 2 || errObj.Position != 16 {
+		t.Errorf("wrong position. expected=[2:16], got=[%d:%d]", errObj.LineNo, errObj.Position)
+	}
+
+	if errObj.Hint != "this is a bug in kabkey, not in the program" {
+		t.Errorf("wrong hint. got=%q", errObj.Hint)
+	}
+}
+
+func TestEvaluationsDoNotShareState(t *testing.T) {
+	program := parser.NewParser(lexer.NewLexer("let f = fn() {\n  inner();\n  boom()\n};\nf();")).ParseProgram()
+	env := object.NewEnvironment()
+
+	// inner evaluates another program, which must not disturb the state of
+	// the evaluation calling it.
+	env.Set("inner", &object.Function{NativeImpl: func(env *object.Environment, args []object.Object) object.Object {
+		l := lexer.NewLexer("let g = fn(n) { if (n > 0) { g(n - 1) } }; g(5)")
+		return EvalWithMaxCallDepth(parser.NewParser(l).ParseProgram(), object.NewEnvironment(), 10)
+	}})
+	env.Set("boom", &object.Function{NativeImpl: func(env *object.Environment, args []object.Object) object.Object {
+		panic("boom")
+	}})
+
+	errObj, ok := EvalWithMaxCallDepth(program, env, 2).(*object.Error)
+	if !ok {
+		t.Fatalf("no error object returned")
+	}
+
+	if errObj.Message != "internal error: boom" || errObj.LineNo != 3 || errObj.Position != 3 {
+		t.Errorf("wrong error. expected=[3:3] internal error: boom, got=[%d:%d] %s",
+			errObj.LineNo, errObj.Position, errObj.Message)
+	}
+}
+
 func TestReturnStatements(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -137,6 +701,11 @@ func TestWhileExpression(t *testing.T) {
 		expected interface{}
 	}{
 		{"let a = 0; while (a < 10) { let a = a + 1; a; }", 10},
+		{"let a = 0; while (true) { a++; if (a == 5) { break; } }; a", 5},
+		{"let a = 0; let odd = 0; while (a < 10) { a++; if (a % 2 == 0) { continue; } odd++; }; odd", 5},
+		{"let i = 0; let n = 0; while (i < 3) { i++; let j = 0; while (true) { j++; if (j > 2) { break } n++ } }; n", 6},
+		{"let f = fn() { let i = 0; while (true) { i++; if (i == 3) { return i; } } }; f()", 3},
+		{"while (false) { 1 }", nil},
 	}
 
 	for _, tt := range tests {
@@ -151,6 +720,94 @@ func TestWhileExpression(t *testing.T) {
 
 }
 
+func TestForExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let sum = 0; for (let i = 0; i < 5; i += 1) { sum += i; }; sum", 10},
+		{"let sum = 0; for (let i = 0; i < 10; i++) { if (i % 2 == 0) { continue; } sum += i; }; sum", 25},
+		{"let n = 0; for (;;) { n++; if (n == 3) { break; } }; n", 3},
+		{"let i = 100; for (let i = 0; i < 3; i++) { i }; i", 100},
+		{"let i = 0; for (i = 0; i < 3; i++) { }; i", 3},
+		{"for (let i = 0; i < 3; i++) { i * 10 }", 20},
+		{"for (let i = 0; i < 0; i++) { i }", nil},
+		{"let f = fn() { for (let i = 0; true; i++) { if (i == 4) { return i } } }; f()", 4},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		integer, ok := tt.expected.(int)
+		if ok {
+			testIntegerObject(t, evaluated, int64(integer))
+		} else {
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestForInExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let sum = 0; for (x in [1, 2, 3]) { sum += x; }; sum", 6},
+		{`let s = ""; for (c in "abc") { s = c + s; }; s`, "cba"},
+		{`let s = ""; for (k in {"a": 1, "b": 2}) { s += k; }; s`, "ab"},
+		{"let n = 0; for (x in []) { n++ }; n", 0},
+		{"let n = 0; for (x in [1, 2, 3, 4]) { if (x == 3) { break } n += x }; n", 3},
+		{"let x = 9; for (x in [1, 2]) { }; x", 9},
+		{"for (x in 5) { }", "cannot iterate over INTEGER"},
+		{"for (x in [1]) { x }; x", "identifier not found: x"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			if errObj, ok := evaluated.(*object.Error); ok {
+				if errObj.Message != expected {
+					t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+				}
+				continue
+			}
+			testStringObject(t, evaluated, expected)
+		}
+	}
+}
+
+func TestLoopControlInExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		output   string
+		expected interface{}
+	}{
+		{"for (x in [1, 2, 3]) { let v = if (x == 2) { continue } else { x * 10 }; println(v) }", "10\n30\n", nil},
+		{"let c = true; for (x in [1, 2]) { println(x, if (c) { continue } else { 0 }) }", "", nil},
+		{"let r = while (true) { let a = 1 + if (true) { break } else { 0 } }; r", "", nil},
+		{"let n = 0; for (x in [1, 2, 3]) { n += [x, if (x == 2) { continue } else { x }][1] }; n", "", 4},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		SetOutput(&out)
+		evaluated := testEval(tt.input)
+		SetOutput(os.Stdout)
+
+		if out.String() != tt.output {
+			t.Errorf("%q: wrong output. expected=%q, got=%q", tt.input, tt.output, out.String())
+		}
+		integer, ok := tt.expected.(int)
+		if ok {
+			testIntegerObject(t, evaluated, int64(integer))
+		} else {
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
 func TestIfElseExpressions(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -164,6 +821,46 @@ func TestIfElseExpressions(t *testing.T) {
 		{"if (1 > 2) { 10 }", nil},
 		{"if (1 > 2) { 10 } else { 20 }", 20},
 		{"if (1 < 2) { 10 } else { 20 }", 10},
+		{"if (1 > 2) { 10 } else if (2 > 1) { 20 } else { 30 }", 20},
+		{"if (1 > 2) { 10 } else if (2 > 3) { 20 } else { 30 }", 30},
+		{"if (1 > 2) { 10 } else if (2 > 3) { 20 }", nil},
+		{"let x = 3; if (x == 1) { 10 } else if (x == 2) { 20 } else if (x == 3) { 30 } else { 40 }", 30},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		integer, ok := tt.expected.(int)
+		if ok {
+			testIntegerObject(t, evaluated, int64(integer))
+		} else {
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestMatchExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`match (1) { 1 => 10, 2 => 20 }`, 10},
+		{`match (2) { 1 => 10, 2 => 20 }`, 20},
+		{`match (3) { 1, 2 => 10, 3, 4 => 20 }`, 20},
+		{`match ("b") { "a" => 10, "b" => 20 }`, 20},
+		{`match (true) { 1 => 10, true => 20 }`, 20},
+		{`match (1.0) { 1 => 10 }`, 10},
+		{`match (5) { 1 => 10, _ => 20 }`, 20},
+		{`match (5) { 1 => 10, 2 => 20 }`, nil},
+		{`match (1) { 1 => { } }`, nil},
+		{`match (1) { }`, nil},
+		// The first matching arm wins and the others are not evaluated.
+		{`match (1) { 1 => 10, 1 => 20, _ => 30 }`, 10},
+		{`match (1) { _ => 10, 1 => 20 }`, 10},
+		{`let n = 0; let f = fn() { n = n + 1; 1 }; match (1) { 1 => 10, f() => 20 }; n`, 0},
+		{`let n = 0; let f = fn() { n = n + 1; 2 }; match (2) { f(), f() => 10 }; n`, 1},
+		{`let n = 0; let next = fn() { n = n + 1; n }; match (next()) { 1 => n, _ => 0 }`, 1},
+		{`let x = 3; match (x * 2) { x + x => { let y = x; y * 10 } }`, 30},
+		{`let f = fn(n) { match (n) { 0 => 0, _ => f(n - 1) } }; f(100000)`, 0},
 	}
 
 	for _, tt := range tests {
@@ -205,6 +902,53 @@ func TestBangOperator(t *testing.T) {
 	}
 }
 
+func TestShortCircuitEvaluation(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let x = 0; (x != 0) && (10 / x > 1)", false},
+		{"let x = 0; (x == 0) || (10 / x > 1)", true},
+		{"let x = 5; (x != 0) && (10 / x > 1)", true},
+		{"let x = 0; x != 0 && 10 / x > 1", false},
+		{"let x = 0; x == 0 || 10 / x > 1", true},
+		{"1 == 1 && 2 == 2", true},
+		{"1 == 2 || 2 == 2", true},
+		{"true || false && false", true},
+		{"false && true || true", true},
+		{"let n = 0; let f = fn() { n++; true }; false && f(); n", 0},
+		{"let n = 0; let f = fn() { n++; true }; true && f(); n", 1},
+		{"let n = 0; let f = fn() { n++; false }; true || f(); n", 0},
+		{"let n = 0; let f = fn() { n++; false }; false || f(); n", 1},
+		{"let n = 0; let f = fn() { n++; true }; f() && f() && f(); n", 3},
+		{"let n = 0; let f = fn() { n++; false }; f() && f() && f(); n", 1},
+		{"1 && 2", true},
+		{"0 || 0", false},
+		{`"" && 0`, false},
+		{"false || undefinedName", "identifier not found: undefinedName"},
+		{"true || undefinedName", true},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
 func TestEvalBooleanExpression(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -239,6 +983,11 @@ func TestEvalBooleanExpression(t *testing.T) {
 		{"true || false == true", true},
 		{"false || false == false", true},
 		{"(1 == 5) || (1 < 5)", true},
+		{`"a" == "a"`, true},
+		{`"a" != "a"`, false},
+		{`"a" != "b"`, true},
+		{`"a" != "ab"`, true},
+		{`"" != ""`, false},
 	}
 
 	for _, tt := range tests {
@@ -288,14 +1037,157 @@ func TestEvalIntegerExpression(t *testing.T) {
 	}
 }
 
+func TestEvalFloatExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"1.5", 1.5},
+		{"-2.5", -2.5},
+		{"1.5e-3", 0.0015},
+		{"1.5 + 1.5", 3},
+		{"1 + 0.5", 1.5},
+		{"0.5 + 1", 1.5},
+		{"7 / 2.0", 3.5},
+		{"7.0 / 2", 3.5},
+		{"2.5 * 2", 5},
+		{"10 - 0.25", 9.75},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testFloatObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestEvalMixedNumericComparisons(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"1 == 1.0", true},
+		{"1.0 != 1", false},
+		{"1 < 1.5", true},
+		{"1.5 <= 1", false},
+		{"2.5 > 2", true},
+		{"2 >= 2.0", true},
+		{"!0.0", true},
+		{"!0.1", false},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testBooleanObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestFloatInspect(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1.5", "1.5"},
+		{"3.0", "3.0"},
+		{"1 + 2.0", "3.0"},
+		{"1e21", "1e+21"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("wrong inspect for %q. expected=%q, got=%q", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestFormatVerbs(t *testing.T) {
+	verbs := formatVerbs("%d%% %5.2f %s %-8g\n")
+	if string(verbs) != "dfsg" {
+		t.Errorf("wrong verbs. expected=%q, got=%q", "dfsg", string(verbs))
+	}
+}
+
+func testFloatObject(t *testing.T, obj object.Object, expected float64) bool {
+	result, ok := obj.(*object.Float)
+	if !ok {
+		t.Errorf("object is not Float. got=%T (%+v)", obj, obj)
+		return false
+	}
+	if result.Value != expected {
+		t.Errorf("object has wrong value. got=%g, want=%g", result.Value, expected)
+		return false
+	}
+	return true
+}
+
 func testEval(input string) object.Object {
+	return testEvalWithMaxCallDepth(input, DefaultMaxCallDepth)
+}
+
+func testEvalWithMaxCallDepth(input string, depth int) object.Object {
 	object.SetExtendedErrorOutput(false)
 	l := lexer.NewLexer(input)
 	p := parser.NewParser(l)
 	program := p.ParseProgram()
+	resolver.Resolve(program)
 	env := object.NewEnvironment()
 	LoadBuiltins(env)
-	return Eval(program, env)
+	return EvalWithMaxCallDepth(program, env, depth)
+}
+
+const whileLoopBenchmark = `
+let count = fn(n) {
+	let i = 0;
+	let total = 0;
+	while (i < n) {
+		total += i % 7;
+		i++;
+	}
+	total
+};
+count(20000)
+`
+
+const recursionBenchmark = `
+let fib = fn(n) {
+	if (n < 2) { return n; }
+	fib(n - 1) + fib(n - 2)
+};
+fib(18)
+`
+
+func BenchmarkWhileLoop(b *testing.B) {
+	benchmarkProgram(b, whileLoopBenchmark)
+}
+
+func BenchmarkRecursion(b *testing.B) {
+	benchmarkProgram(b, recursionBenchmark)
+}
+
+// benchmarkProgram compares looking variables up by name with using the
+// slots assigned by the resolver.
+func benchmarkProgram(b *testing.B, input string) {
+	for _, resolve := range []bool{false, true} {
+		name := "by-name"
+		if resolve {
+			name = "resolved"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			program := parser.NewParser(lexer.NewLexer(input)).ParseProgram()
+			if resolve {
+				resolver.Resolve(program)
+			}
+
+			for i := 0; i < b.N; i++ {
+				env := object.NewEnvironment()
+				LoadBuiltins(env)
+				if result := Eval(program, env); IsError(result) {
+					b.Fatalf("benchmark failed: %s", result.Inspect())
+				}
+			}
+		})
+	}
 }
 
 func testLiteralObject(t *testing.T, obj object.Object, expected interface{}) bool {
@@ -2,8 +2,11 @@ package evaluator
 
 import (
 	"fmt"
+	"math"
+	"unicode/utf8"
 
 	"github.com/hculpan/kabkey/pkg/ast"
+	"github.com/hculpan/kabkey/pkg/token"
 
 	"github.com/hculpan/kabkey/pkg/object"
 )
@@ -14,90 +17,324 @@ var (
 	FALSE = &object.Boolean{Value: false}
 )
 
+// DefaultMaxCallDepth is how deeply calls may nest unless
+// EvalWithMaxCallDepth says otherwise.
+const DefaultMaxCallDepth = 10000
+
+// evaluation is the state of one call to Eval.
+type evaluation struct {
+	// callDepth is how deeply calls nest, at most maxCallDepth.
+	callDepth    int
+	maxCallDepth int
+
+	// statement is the statement being evaluated, which a panic is
+	// reported at.
+	statement ast.Statement
+}
+
+// Eval evaluates node in env, allowing calls to nest DefaultMaxCallDepth
+// deep.
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	return EvalWithMaxCallDepth(node, env, DefaultMaxCallDepth)
+}
+
+// EvalWithMaxCallDepth evaluates node in env as Eval does, failing with a
+// stack overflow error, rather than exhausting the Go stack, once calls nest
+// more than depth deep. Calls in tail position do not nest.
+//
+// This is the one place evaluation recovers from a Go panic, which can only
+// come from a bug in kabkey. The panic is returned as an internal error at
+// the statement being evaluated, so that it does not take the process down,
+// with a hint saying so that it is not mistaken for a fault in the program.
+func EvalWithMaxCallDepth(node ast.Node, env *object.Environment, depth int) (result object.Object) {
+	ev := &evaluation{maxCallDepth: depth}
+
+	defer func() {
+		if r := recover(); r != nil {
+			tok := node.NodeToken()
+			if ev.statement != nil {
+				tok = ev.statement.NodeToken()
+			}
+
+			err := newErrorAt(tok, "internal error: %v", r)
+			err.Hint = "this is a bug in kabkey, not in the program"
+			result = err
+		}
+	}()
+
+	return ev.eval(node, env)
+}
+
+func (ev *evaluation) eval(node ast.Node, env *object.Environment) object.Object {
 	switch node := node.(type) {
 	case *ast.Program:
-		return evalProgram(node, env)
+		return ev.evalProgram(node, env)
 	case *ast.ReturnStatement:
-		val := Eval(node.ReturnValue, env)
-		if IsError(val) {
+		if node.ReturnValue == nil {
+			return &object.ReturnValue{Value: NULL}
+		}
+		val := ev.evalTailExpression(node.ReturnValue, env)
+		if isAbrupt(val) {
 			return val
 		}
 		return &object.ReturnValue{Value: val}
 	case *ast.LetStatement:
-		val := Eval(node.Value, env)
-		if IsError(val) {
+		val := ev.eval(node.Value, env)
+		if isAbrupt(val) {
 			return val
 		}
-		env.Set(node.Name.Value, val)
+		defineVariable(env, node.Name, val)
+	case *ast.BreakStatement:
+		return &object.Break{LineNo: node.Token.LineNo, Position: node.Token.Position}
+	case *ast.ContinueStatement:
+		return &object.Continue{LineNo: node.Token.LineNo, Position: node.Token.Position}
 	case *ast.BlockStatement:
-		return evalBlockStatements(node, env)
+		return ev.evalBlockStatements(node, env)
 	case *ast.CallExpression:
-		function := Eval(node.Function, env)
-		if IsError(function) {
-			return function
-		}
-
-		args := evalExpressions(node.Arguments, env)
-		if len(args) == 1 && IsError(args[0]) {
-			return args[0]
-		}
-
-		return applyFunction(node, function, args)
+		return ev.completeCall(ev.evalTailCall(node, env))
 	case *ast.Identifier:
 		return evalIdentifier(node, env)
+	case *ast.AssignExpression:
+		return ev.evalAssignExpression(node, env)
+	case *ast.CompoundAssignExpression:
+		return ev.evalCompoundAssignExpression(node, env)
+	case *ast.IncrementExpression:
+		return evalIncrementExpression(node, env)
 	case *ast.IfExpression:
-		return evalIfExpression(node, env)
+		return ev.evalIfExpression(node, env)
+	case *ast.MatchExpression:
+		return ev.evalMatchExpression(node, env)
 	case *ast.WhileExpression:
-		return evalWhileExpression(node, env)
+		return ev.evalWhileExpression(node, env)
+	case *ast.ForExpression:
+		return ev.evalForExpression(node, env)
+	case *ast.ForInExpression:
+		return ev.evalForInExpression(node, env)
 	case *ast.ExpressionStatement:
-		return Eval(node.Expression, env)
+		return ev.eval(node.Expression, env)
 	case *ast.FunctionLiteral:
 		params := node.Parameters
 		body := node.Body
 
 		return &object.Function{
+			Name:       node.Name,
 			Parameters: params,
 			Env:        env,
 			Body:       body,
+			Scope:      node.Scope,
 		}
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
 	case *ast.IntegerLiteral:
 		return &object.Integer{Value: node.Value}
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}
 	case *ast.Boolean:
 		return nativeBoolToBooleanObject(node.Value)
+	case *ast.ArrayLiteral:
+		elements := ev.evalExpressions(node.Elements, env)
+		if len(elements) == 1 && isAbrupt(elements[0]) {
+			return elements[0]
+		}
+
+		return &object.Array{Elements: elements}
+	case *ast.HashLiteral:
+		return ev.evalHashLiteral(node, env)
+	case *ast.IndexExpression:
+		return ev.evalIndexExpression(node, env)
 	case *ast.PrefixExpression:
-		return evalPrefixExpression(node, env)
+		return ev.evalPrefixExpression(node, env)
 	case *ast.InfixExpression:
-		return evalInfixExpression(node, env)
+		return ev.evalInfixExpression(node, env)
 	}
 
 	return nil
 }
 
-func applyFunction(node ast.Node, fn object.Object, args []object.Object) object.Object {
-	var evaluated object.Object
-	function, ok := fn.(*object.Function)
-	if !ok {
-		return newError(node, "not a function: %s", fn.Type())
+// evalTailCall evaluates the function and arguments of a call without
+// making it, returning the call as a TailCall.
+func (ev *evaluation) evalTailCall(node *ast.CallExpression, env *object.Environment) object.Object {
+	function := ev.eval(node.Function, env)
+	if isAbrupt(function) {
+		return function
 	}
 
-	extendedEnv := extendFunctionEnv(function, args)
+	args := ev.evalExpressions(node.Arguments, env)
+	if len(args) == 1 && isAbrupt(args[0]) {
+		return args[0]
+	}
 
-	if function.NativeImpl != nil {
-		evaluated = function.NativeImpl(extendedEnv, args)
-	} else {
-		evaluated = Eval(function.Body, extendedEnv)
+	return &object.TailCall{Call: node, Function: function, Arguments: args}
+}
+
+// evalTailExpression evaluates an expression in tail position, whose value
+// is the value of the function it is in. Calls there, including those
+// ending a branch of an if or match expression, are returned as a TailCall.
+func (ev *evaluation) evalTailExpression(node ast.Expression, env *object.Environment) object.Object {
+	switch node := node.(type) {
+	case *ast.CallExpression:
+		return ev.evalTailCall(node, env)
+	case *ast.IfExpression:
+		condition := ev.eval(node.Condition, env)
+		if isAbrupt(condition) {
+			return condition
+		}
+
+		if isTruthy(condition) {
+			return ev.evalTailBlock(node.Consequence, env)
+		} else if node.Alternative != nil {
+			return ev.evalTailBlock(node.Alternative, env)
+		}
+
+		return NULL
+	case *ast.MatchExpression:
+		arm, err := ev.matchArm(node, env)
+		if err != nil {
+			return err
+		} else if arm == nil {
+			return NULL
+		}
+
+		return ev.evalTailBlock(arm.Body, env)
+	}
+
+	return ev.eval(node, env)
+}
+
+// evalTailBlock evaluates a block whose last expression is in tail
+// position.
+func (ev *evaluation) evalTailBlock(block *ast.BlockStatement, env *object.Environment) object.Object {
+	var result object.Object
+
+	for i, stmt := range block.Statements {
+		ev.statement = stmt
+		if es, ok := stmt.(*ast.ExpressionStatement); ok && i == len(block.Statements)-1 {
+			return ev.evalTailExpression(es.Expression, env)
+		}
+
+		result = ev.eval(stmt, env)
+
+		if isAbrupt(result) {
+			return result
+		}
+	}
+
+	return result
+}
+
+// completeCall makes the call obj stands for if it is a TailCall, and
+// otherwise returns obj.
+func (ev *evaluation) completeCall(obj object.Object) object.Object {
+	if call, ok := obj.(*object.TailCall); ok {
+		return ev.applyFunction(call.Call, call.Function, call.Arguments)
+	}
+
+	return obj
+}
+
+// applyFunction calls fn, failing instead if calls already nest as deeply
+// as allowed.
+func (ev *evaluation) applyFunction(node ast.Node, fn object.Object, args []object.Object) object.Object {
+	if ev.callDepth >= ev.maxCallDepth {
+		return newError(node, "stack overflow: more than %d nested calls", ev.maxCallDepth)
+	}
+
+	ev.callDepth++
+	defer func() { ev.callDepth-- }()
+
+	// The statement being evaluated is left alone on a panic, for Eval to
+	// report it.
+	caller := ev.statement
+	result := ev.callFunction(node, fn, args)
+	ev.statement = caller
+
+	return result
+}
+
+// callFunction makes a call. When the function ends in a tail call, that
+// call is made here in turn, so a chain of tail calls runs in constant Go
+// stack and counts as a single level of nesting.
+//
+// An error is traced to the function whose body it came from. One raised
+// by making a tail call is traced to the function making it, which is
+// still the one running.
+func (ev *evaluation) callFunction(node ast.Node, fn object.Object, args []object.Object) object.Object {
+	var caller *object.Function
+	var callerNode ast.Node
+
+	for {
+		var evaluated object.Object
+		function, ok := fn.(*object.Function)
+
+		switch {
+		case !ok:
+			evaluated = newError(node, "not a function: %s", fn.Type())
+		case function.NativeImpl == nil && len(args) != len(function.Parameters):
+			evaluated = newError(node, "wrong number of arguments: want=%d, got=%d", len(function.Parameters), len(args))
+		case function.NativeImpl != nil:
+			evaluated = function.NativeImpl(extendFunctionEnv(function, args), args)
+			// Builtins have no source position of their own, so their
+			// errors are reported at the call.
+			if errObj, ok := evaluated.(*object.Error); ok && errObj.LineNo == 0 {
+				tok := node.NodeToken()
+				errObj.LineNo, errObj.Position, errObj.Filename = tok.LineNo, tok.Position, tok.Filename
+				errObj.Span = utf8.RuneCountInString(tok.Literal)
+			}
+		default:
+			caller, callerNode = function, node
+			evaluated = ev.evalTailBlock(function.Body, extendFunctionEnv(function, args))
+		}
+
+		evaluated = unwrapReturnValue(evaluated)
+
+		if errObj, ok := evaluated.(*object.Error); ok && caller != nil {
+			tok := callerNode.NodeToken()
+			errObj.Stack = append(errObj.Stack, object.StackFrame{
+				Function: functionName(caller),
+				LineNo:   tok.LineNo,
+				Position: tok.Position,
+				Filename: tok.Filename,
+			})
+		}
+
+		call, ok := evaluated.(*object.TailCall)
+		if !ok {
+			return checkStrayLoopControl(nullIfNil(evaluated))
+		}
+
+		node, fn, args = call.Call, call.Function, call.Arguments
+	}
+}
+
+// functionName names fn in stack traces. Functions are known by the name
+// they were defined with; the VM cannot tell what name an anonymous one was
+// called through, so neither engine tries.
+func functionName(fn *object.Function) string {
+	if fn.Name != "" {
+		return fn.Name
 	}
 
-	return unwrapReturnValue(evaluated)
+	return "<anonymous>"
+}
+
+// checkStrayLoopControl turns a break or continue signal that escaped every
+// loop into a runtime error. The parser rejects such programs, so this only
+// guards ASTs that were built by other means.
+func checkStrayLoopControl(obj object.Object) object.Object {
+	switch obj := obj.(type) {
+	case *object.Break:
+		return object.NewError("'break' outside of loop", obj.LineNo, obj.Position)
+	case *object.Continue:
+		return object.NewError("'continue' outside of loop", obj.LineNo, obj.Position)
+	}
+
+	return obj
 }
 
 func extendFunctionEnv(fn *object.Function, args []object.Object) *object.Environment {
-	env := object.NewEnclosedEnvironment(fn.Env)
+	env := object.NewScopedEnvironment(fn.Env, fn.Scope)
 	for paramIdx, param := range fn.Parameters {
-		env.Set(param.Value, args[paramIdx])
+		defineVariable(env, param, args[paramIdx])
 	}
 	return env
 }
@@ -111,37 +348,138 @@ func unwrapReturnValue(obj object.Object) object.Object {
 }
 
 func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object {
+	if node.Resolved {
+		if val, ok := env.GetAt(node.Depth, node.Slot, node.Value); ok {
+			return val
+		}
+	}
+
 	val, ok := env.Get(node.Value)
 	if !ok {
-		return newError(node, "identifier not found: %s", node.Value)
+		return identifierNotFound(node.Token, node.Value)
+	}
+
+	return val
+}
+
+func identifierNotFound(tok token.Token, name string) *object.Error {
+	err := newErrorAt(tok, "identifier not found: %s", name)
+	err.Hint = fmt.Sprintf("declare it first with let %s = ...", name)
+	return err
+}
+
+func undeclaredAssignment(tok token.Token, name string) *object.Error {
+	err := newErrorAt(tok, "assignment to undeclared variable: %s", name)
+	err.Hint = fmt.Sprintf("declare it with let %s = ... instead", name)
+	return err
+}
+
+// defineVariable binds name in env, using the slot the resolver assigned
+// when there is one.
+func defineVariable(env *object.Environment, name *ast.Identifier, val object.Object) {
+	if name.Resolved && name.Slot >= 0 {
+		env.SetSlot(name.Slot, val)
+	} else {
+		env.Set(name.Value, val)
+	}
+}
+
+// assignVariable updates an existing variable, reporting false if it is
+// not declared.
+func assignVariable(env *object.Environment, name *ast.Identifier, val object.Object) bool {
+	if name.Resolved && env.AssignAt(name.Depth, name.Slot, name.Value, val) {
+		return true
+	}
+
+	_, ok := env.Assign(name.Value, val)
+	return ok
+}
+
+func (ev *evaluation) evalAssignExpression(node *ast.AssignExpression, env *object.Environment) object.Object {
+	val := ev.eval(node.Value, env)
+	if isAbrupt(val) {
+		return val
+	}
+
+	if !assignVariable(env, node.Name, val) {
+		return undeclaredAssignment(node.Name.Token, node.Name.Value)
 	}
 
 	return val
 }
 
-func evalProgram(program *ast.Program, env *object.Environment) object.Object {
+func (ev *evaluation) evalCompoundAssignExpression(node *ast.CompoundAssignExpression, env *object.Environment) object.Object {
+	current := evalIdentifier(node.Name, env)
+	if IsError(current) {
+		return current
+	}
+
+	val := ev.eval(node.Value, env)
+	if isAbrupt(val) {
+		return val
+	}
+
+	result := evalInfixOperation(node.Token, node.Operator, current, val)
+	if IsError(result) {
+		return result
+	}
+
+	assignVariable(env, node.Name, result)
+
+	return result
+}
+
+func evalIncrementExpression(node *ast.IncrementExpression, env *object.Environment) object.Object {
+	current := evalIdentifier(node.Name, env)
+	if IsError(current) {
+		return current
+	}
+
+	operator := "+"
+	if node.Operator == "--" {
+		operator = "-"
+	}
+
+	result := evalInfixOperation(node.Token, operator, current, &object.Integer{Value: 1})
+	if IsError(result) {
+		return result
+	}
+
+	assignVariable(env, node.Name, result)
+
+	if node.Prefix {
+		return result
+	}
+
+	return current
+}
+
+func (ev *evaluation) evalProgram(program *ast.Program, env *object.Environment) object.Object {
 	var result object.Object
 
 	for _, stmt := range program.Statements {
-		result = Eval(stmt, env)
+		ev.statement = stmt
+		result = ev.eval(stmt, env)
 
 		switch result := result.(type) {
 		case *object.ReturnValue:
-			return result.Value
+			return ev.completeCall(result.Value)
 		case *object.Error:
 			return result
+		case *object.Break, *object.Continue:
+			return checkStrayLoopControl(result)
 		}
 	}
 
 	return result
 }
 
-func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Object {
+func (ev *evaluation) evalExpressions(exps []ast.Expression, env *object.Environment) []object.Object {
 	var result []object.Object
 
 	for _, e := range exps {
-		evaluated := Eval(e, env)
-		if IsError(evaluated) {
+		evaluated := ev.eval(e, env)
+		if isAbrupt(evaluated) {
 			return []object.Object{evaluated}
 		}
 
@@ -151,90 +489,327 @@ func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Ob
 	return result
 }
 
-func evalWhileExpression(node *ast.WhileExpression, env *object.Environment) object.Object {
-	condition := Eval(node.Condition, env)
-	if IsError(condition) {
+func (ev *evaluation) evalWhileExpression(node *ast.WhileExpression, env *object.Environment) object.Object {
+	condition := ev.eval(node.Condition, env)
+	if isAbrupt(condition) {
 		return condition
 	}
 
-	var result object.Object
+	var result object.Object = NULL
 	for isTruthy(condition) {
-		result = Eval(node.Block, env)
-		if IsError(result) {
+		var ok bool
+		if result, ok = ev.evalLoopBody(node.Block, env, result); !ok {
 			return result
 		}
 
-		condition = Eval(node.Condition, env)
+		condition = ev.eval(node.Condition, env)
+		if isAbrupt(condition) {
+			return condition
+		}
+	}
+
+	return result
+}
+
+func (ev *evaluation) evalForExpression(node *ast.ForExpression, env *object.Environment) object.Object {
+	loopEnv := object.NewScopedEnvironment(env, node.Scope)
+
+	if node.Init != nil {
+		init := ev.eval(node.Init, loopEnv)
+		if isAbrupt(init) {
+			return init
+		}
+	}
+
+	var result object.Object = NULL
+	for {
+		if node.Condition != nil {
+			condition := ev.eval(node.Condition, loopEnv)
+			if isAbrupt(condition) {
+				return condition
+			}
+
+			if !isTruthy(condition) {
+				break
+			}
+		}
+
+		var ok bool
+		if result, ok = ev.evalLoopBody(node.Block, loopEnv, result); !ok {
+			return result
+		}
+
+		if node.Post != nil {
+			post := ev.eval(node.Post, loopEnv)
+			if IsError(post) {
+				return post
+			}
+		}
+	}
+
+	return result
+}
+
+func (ev *evaluation) evalForInExpression(node *ast.ForInExpression, env *object.Environment) object.Object {
+	iterable := ev.eval(node.Iterable, env)
+	if isAbrupt(iterable) {
+		return iterable
+	}
+
+	it, ok := iterable.(object.Iterable)
+	if !ok {
+		return newError(node.Iterable, "cannot iterate over %s", iterable.Type())
+	}
+
+	loopEnv := object.NewScopedEnvironment(env, node.Scope)
+
+	var result object.Object = NULL
+	for _, item := range it.Iterate() {
+		defineVariable(loopEnv, node.Variable, item)
+
+		if result, ok = ev.evalLoopBody(node.Block, loopEnv, result); !ok {
+			return result
+		}
 	}
 
 	return result
 }
 
-func evalIfExpression(node *ast.IfExpression, env *object.Environment) object.Object {
-	condition := Eval(node.Condition, env)
-	if IsError(condition) {
+// evalLoopBody runs one iteration of a loop body. It returns the loop's
+// value so far and whether the loop should keep going. When it reports
+// false the returned object is what the loop expression evaluates to:
+// an error or return value to propagate, or the last value on break.
+func (ev *evaluation) evalLoopBody(block *ast.BlockStatement, env *object.Environment, result object.Object) (object.Object, bool) {
+	evaluated := ev.eval(block, env)
+
+	switch evaluated.(type) {
+	case *object.Error, *object.ReturnValue:
+		return evaluated, false
+	case *object.Break:
+		return result, false
+	case *object.Continue:
+		return result, true
+	default:
+		return nullIfNil(evaluated), true
+	}
+}
+
+func (ev *evaluation) evalIndexExpression(node *ast.IndexExpression, env *object.Environment) object.Object {
+	left := ev.eval(node.Left, env)
+	if isAbrupt(left) {
+		return left
+	}
+
+	index := ev.eval(node.Index, env)
+	if isAbrupt(index) {
+		return index
+	}
+
+	return evalIndexOperation(node.Index.NodeToken(), left, index)
+}
+
+// evalIndexOperation indexes an already evaluated collection. Errors are
+// reported at tok, the position of the index expression.
+func evalIndexOperation(tok token.Token, left, index object.Object) object.Object {
+	switch {
+	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
+		return evalArrayIndexExpression(tok, left, index)
+	case left.Type() == object.HASH_OBJ:
+		return evalHashIndexExpression(tok, left, index)
+	default:
+		return newErrorAt(tok, "index operator not supported: %s[%s]", left.Type(), index.Type())
+	}
+}
+
+func evalArrayIndexExpression(tok token.Token, array, index object.Object) object.Object {
+	elements := array.(*object.Array).Elements
+	idx := index.(*object.Integer).Value
+
+	if idx < 0 || idx >= int64(len(elements)) {
+		return newErrorAt(tok, "index out of bounds: %d (length %d)", idx, len(elements))
+	}
+
+	return elements[idx]
+}
+
+func evalHashIndexExpression(tok token.Token, hash, index object.Object) object.Object {
+	key, ok := index.(object.Hashable)
+	if !ok {
+		return newErrorAt(tok, "unusable as hash key: %s", index.Type())
+	}
+
+	value, ok := hash.(*object.Hash).Get(key)
+	if !ok {
+		return NULL
+	}
+
+	return value
+}
+
+func (ev *evaluation) evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Object {
+	hash := object.NewHash()
+
+	for _, pair := range node.Pairs {
+		key := ev.eval(pair.Key, env)
+		if isAbrupt(key) {
+			return key
+		}
+
+		hashKey, ok := key.(object.Hashable)
+		if !ok {
+			return newError(node, "unusable as hash key: %s", key.Type())
+		}
+
+		value := ev.eval(pair.Value, env)
+		if isAbrupt(value) {
+			return value
+		}
+
+		hash.Set(hashKey, value)
+	}
+
+	return hash
+}
+
+func (ev *evaluation) evalIfExpression(node *ast.IfExpression, env *object.Environment) object.Object {
+	condition := ev.eval(node.Condition, env)
+	if isAbrupt(condition) {
 		return condition
 	}
 
 	if isTruthy(condition) {
-		return Eval(node.Consequence, env)
+		return nullIfNil(ev.eval(node.Consequence, env))
 	} else if node.Alternative != nil {
-		return Eval(node.Alternative, env)
+		return nullIfNil(ev.eval(node.Alternative, env))
 	}
 
 	return NULL
 }
 
-func evalInfixExpression(node *ast.InfixExpression, env *object.Environment) object.Object {
-	left := Eval(node.Left, env)
-	if IsError(left) {
+func (ev *evaluation) evalMatchExpression(node *ast.MatchExpression, env *object.Environment) object.Object {
+	arm, err := ev.matchArm(node, env)
+	if err != nil {
+		return err
+	} else if arm == nil {
+		return NULL
+	}
+
+	return nullIfNil(ev.eval(arm.Body, env))
+}
+
+// matchArm returns the first arm of node with a pattern equal to the
+// subject, comparing them as == does, or nil if no arm matches. Patterns
+// are evaluated in order, and only until one matches.
+func (ev *evaluation) matchArm(node *ast.MatchExpression, env *object.Environment) (*ast.MatchArm, object.Object) {
+	subject := ev.eval(node.Subject, env)
+	if isAbrupt(subject) {
+		return nil, subject
+	}
+
+	for i, arm := range node.Arms {
+		if len(arm.Patterns) == 0 {
+			return &node.Arms[i], nil
+		}
+
+		for _, pattern := range arm.Patterns {
+			value := ev.eval(pattern, env)
+			if isAbrupt(value) {
+				return nil, value
+			}
+
+			if isTruthy(evalInfixOperation(pattern.NodeToken(), "==", subject, value)) {
+				return &node.Arms[i], nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func (ev *evaluation) evalInfixExpression(node *ast.InfixExpression, env *object.Environment) object.Object {
+	if node.Operator == "&&" || node.Operator == "||" {
+		return ev.evalLogicalExpression(node, env)
+	}
+
+	left := ev.eval(node.Left, env)
+	if isAbrupt(left) {
+		return left
+	}
+
+	right := ev.eval(node.Right, env)
+	if isAbrupt(right) {
+		return right
+	}
+
+	return evalInfixOperation(node.Token, node.Operator, left, right)
+}
+
+// evalLogicalExpression evaluates && and || with short-circuit semantics:
+// the right operand is only evaluated when the left one does not already
+// decide the result. The result is always a Boolean, never an operand.
+func (ev *evaluation) evalLogicalExpression(node *ast.InfixExpression, env *object.Environment) object.Object {
+	left := ev.eval(node.Left, env)
+	if isAbrupt(left) {
 		return left
 	}
 
-	right := Eval(node.Right, env)
-	if IsError(right) {
+	if node.Operator == "&&" && !isTruthy(left) {
+		return FALSE
+	}
+
+	if node.Operator == "||" && isTruthy(left) {
+		return TRUE
+	}
+
+	right := ev.eval(node.Right, env)
+	if isAbrupt(right) {
 		return right
 	}
 
+	return nativeBoolToBooleanObject(isTruthy(right))
+}
+
+// evalInfixOperation applies a binary operator to already evaluated
+// operands. It is shared by infix, compound assignment and increment
+// expressions so that all of them follow the same typing rules.
+func evalInfixOperation(tok token.Token, operator string, left, right object.Object) object.Object {
 	switch {
 	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
-		return evalIntegerInfixExpression(node, left, right)
+		return evalIntegerInfixExpression(tok, operator, left, right)
+	case isNumeric(left) && isNumeric(right):
+		return evalFloatInfixExpression(tok, operator, left, right)
 	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
-		return evalStringInfixExpression(node, left, right)
-	case node.Operator == "==":
+		return evalStringInfixExpression(tok, operator, left, right)
+	case operator == "==":
 		return nativeBoolToBooleanObject(left == right)
-	case node.Operator == "!=":
+	case operator == "!=":
 		return nativeBoolToBooleanObject(left != right)
-	case node.Operator == "&&":
-		return nativeBoolToBooleanObject(isTruthy(left) && isTruthy(right))
-	case node.Operator == "||":
-		return nativeBoolToBooleanObject(isTruthy(left) || isTruthy(right))
 	default:
-		return newError(node, "unsupported operation: %s %s %s", left.Type(), node.Operator, right.Type())
+		return newErrorAt(tok, "unsupported operation: %s %s %s", left.Type(), operator, right.Type())
 	}
 }
 
-func evalStringInfixExpression(node *ast.InfixExpression, left, right object.Object) object.Object {
+func evalStringInfixExpression(tok token.Token, operator string, left, right object.Object) object.Object {
 	leftVal := left.(*object.String).Value
 	rightVal := right.(*object.String).Value
 
-	switch node.Operator {
+	switch operator {
 	case "+":
 		return &object.String{Value: leftVal + rightVal}
 	case "==":
 		return nativeBoolToBooleanObject(leftVal == rightVal)
 	case "!=":
-		return nativeBoolToBooleanObject(leftVal == rightVal)
+		return nativeBoolToBooleanObject(leftVal != rightVal)
 	default:
-		return newError(node, "unknown operator: %s %s %s", left.Type(), node.Operator, right.Type())
+		return newErrorAt(tok, "unknown operator: %s %s %s", left.Type(), operator, right.Type())
 	}
 }
 
-func evalIntegerInfixExpression(node *ast.InfixExpression, left, right object.Object) object.Object {
+func evalIntegerInfixExpression(tok token.Token, operator string, left, right object.Object) object.Object {
 	leftVal := left.(*object.Integer).Value
 	rightVal := right.(*object.Integer).Value
 
-	switch node.Operator {
+	switch operator {
 	case "+":
 		return &object.Integer{Value: leftVal + rightVal}
 	case "-":
@@ -242,7 +817,49 @@ func evalIntegerInfixExpression(node *ast.InfixExpression, left, right object.Ob
 	case "*":
 		return &object.Integer{Value: leftVal * rightVal}
 	case "/":
+		if rightVal == 0 {
+			return newErrorAt(tok, "division by zero")
+		}
 		return &object.Integer{Value: leftVal / rightVal}
+	case "%":
+		if rightVal == 0 {
+			return newErrorAt(tok, "division by zero")
+		}
+		return &object.Integer{Value: leftVal % rightVal}
+	case "<":
+		return nativeBoolToBooleanObject(leftVal < rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
+	case ">":
+		return nativeBoolToBooleanObject(leftVal > rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
+	case "==":
+		return nativeBoolToBooleanObject(leftVal == rightVal)
+	case "!=":
+		return nativeBoolToBooleanObject(leftVal != rightVal)
+	default:
+		return newErrorAt(tok, "unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	}
+}
+
+// evalFloatInfixExpression handles arithmetic and comparisons where at least
+// one operand is a float; integer operands are widened to float64.
+func evalFloatInfixExpression(tok token.Token, operator string, left, right object.Object) object.Object {
+	leftVal := toFloat(left)
+	rightVal := toFloat(right)
+
+	switch operator {
+	case "+":
+		return &object.Float{Value: leftVal + rightVal}
+	case "-":
+		return &object.Float{Value: leftVal - rightVal}
+	case "*":
+		return &object.Float{Value: leftVal * rightVal}
+	case "/":
+		return &object.Float{Value: leftVal / rightVal}
+	case "%":
+		return &object.Float{Value: math.Mod(leftVal, rightVal)}
 	case "<":
 		return nativeBoolToBooleanObject(leftVal < rightVal)
 	case "<=":
@@ -256,35 +873,38 @@ func evalIntegerInfixExpression(node *ast.InfixExpression, left, right object.Ob
 	case "!=":
 		return nativeBoolToBooleanObject(leftVal != rightVal)
 	default:
-		return newError(node, "unknown operator: %s %s %s", left.Type(), node.Operator, right.Type())
+		return newErrorAt(tok, "unknown operator: %s %s %s", left.Type(), operator, right.Type())
 	}
 }
 
-func evalPrefixExpression(node *ast.PrefixExpression, env *object.Environment) object.Object {
-	right := Eval(node.Right, env)
-	if IsError(right) {
+func (ev *evaluation) evalPrefixExpression(node *ast.PrefixExpression, env *object.Environment) object.Object {
+	right := ev.eval(node.Right, env)
+	if isAbrupt(right) {
 		return right
 	}
 
 	switch node.Operator {
 	case "-":
-		return evalMinusPrefixOperatorExpression(node.Right, right)
+		return evalMinusPrefixOperatorExpression(node.Right.NodeToken(), right)
 	case "!":
-		return evalBangOperatorExpression(node.Right, right)
+		return evalBangOperatorExpression(right)
 	default:
 		return newError(node, "unknown operator: %s%s", node.Operator, right.Type())
 	}
 }
 
-func evalMinusPrefixOperatorExpression(node ast.Expression, right object.Object) object.Object {
-	if right.Type() != object.INTEGER_OBJ {
-		return newError(node, "unknown operator: -%s", right.Type())
+func evalMinusPrefixOperatorExpression(tok token.Token, right object.Object) object.Object {
+	switch right := right.(type) {
+	case *object.Integer:
+		return &object.Integer{Value: -right.Value}
+	case *object.Float:
+		return &object.Float{Value: -right.Value}
+	default:
+		return newErrorAt(tok, "unknown operator: -%s", right.Type())
 	}
-
-	return &object.Integer{Value: -right.(*object.Integer).Value}
 }
 
-func evalBangOperatorExpression(node ast.Expression, right object.Object) object.Object {
+func evalBangOperatorExpression(right object.Object) object.Object {
 	switch right {
 	case TRUE:
 		return FALSE
@@ -293,33 +913,55 @@ func evalBangOperatorExpression(node ast.Expression, right object.Object) object
 	case NULL:
 		return TRUE
 	default:
-		intLit, ok := right.(*object.Integer)
-		if ok {
-			return nativeBoolToBooleanObject(intLit.Value == 0)
+		switch right := right.(type) {
+		case *object.Integer:
+			return nativeBoolToBooleanObject(right.Value == 0)
+		case *object.Float:
+			return nativeBoolToBooleanObject(right.Value == 0)
 		}
 
 		return FALSE
 	}
 }
 
-func evalBlockStatements(block *ast.BlockStatement, env *object.Environment) object.Object {
+func (ev *evaluation) evalBlockStatements(block *ast.BlockStatement, env *object.Environment) object.Object {
 	var result object.Object
 
 	for _, stmt := range block.Statements {
-		result = Eval(stmt, env)
-
-		if result != nil {
-			rt := result.Type()
+		ev.statement = stmt
+		result = ev.eval(stmt, env)
 
-			if rt == object.RETURN_OBJ || rt == object.ERROR_OBJ {
-				return result
-			}
+		if isAbrupt(result) {
+			return result
 		}
 	}
 
 	return result
 }
 
+// nullIfNil turns the missing value of a statement, such as a block ending
+// in a let, into NULL where it becomes the value of an expression.
+func nullIfNil(obj object.Object) object.Object {
+	if obj == nil {
+		return NULL
+	}
+
+	return obj
+}
+
+// isAbrupt reports whether result cuts evaluation short: an error, or a
+// return, break or continue signal on its way to the function or loop it
+// belongs to. It ends the block it comes from, and any expression it is an
+// operand of, as in 1 + if (x) { break }.
+func isAbrupt(result object.Object) bool {
+	if result == nil {
+		return false
+	}
+
+	rt := result.Type()
+	return rt == object.RETURN_OBJ || rt == object.ERROR_OBJ || rt == object.BREAK_OBJ || rt == object.CONTINUE_OBJ
+}
+
 func nativeBoolToBooleanObject(input bool) *object.Boolean {
 	if input {
 		return TRUE
@@ -335,16 +977,41 @@ func isTruthy(obj object.Object) bool {
 	case TRUE:
 		return true
 	default:
-		if intObj, ok := obj.(*object.Integer); ok {
-			return intObj.Value != 0
+		switch obj := obj.(type) {
+		case *object.Integer:
+			return obj.Value != 0
+		case *object.Float:
+			return obj.Value != 0
 		}
 
 		return true
 	}
 }
 
+func isNumeric(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJ || obj.Type() == object.FLOAT_OBJ
+}
+
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.Float:
+		return obj.Value
+	default:
+		return 0
+	}
+}
+
 func newError(node ast.Node, format string, a ...interface{}) *object.Error {
-	return object.NewError(fmt.Sprintf(format, a...), node.NodeToken().LineNo, node.NodeToken().Position)
+	return newErrorAt(node.NodeToken(), format, a...)
+}
+
+func newErrorAt(tok token.Token, format string, a ...interface{}) *object.Error {
+	err := object.NewError(fmt.Sprintf(format, a...), tok.LineNo, tok.Position)
+	err.Filename = tok.Filename
+	err.Span = utf8.RuneCountInString(tok.Literal)
+	return err
 }
 
 func IsError(obj object.Object) bool {
@@ -354,3 +1021,35 @@ func IsError(obj object.Object) bool {
 
 	return false
 }
+
+// The functions below expose the evaluator's operator semantics to the VM,
+// so that both agree on results and error messages. Errors are reported at
+// tok.
+
+func InfixOperation(tok token.Token, operator string, left, right object.Object) object.Object {
+	return evalInfixOperation(tok, operator, left, right)
+}
+
+func MinusOperation(tok token.Token, right object.Object) object.Object {
+	return evalMinusPrefixOperatorExpression(tok, right)
+}
+
+func BangOperation(right object.Object) object.Object {
+	return evalBangOperatorExpression(right)
+}
+
+func IndexOperation(tok token.Token, left, index object.Object) object.Object {
+	return evalIndexOperation(tok, left, index)
+}
+
+func IdentifierNotFound(tok token.Token, name string) object.Object {
+	return identifierNotFound(tok, name)
+}
+
+func UndeclaredAssignment(tok token.Token, name string) object.Object {
+	return undeclaredAssignment(tok, name)
+}
+
+func IsTruthy(obj object.Object) bool {
+	return isTruthy(obj)
+}
@@ -2,42 +2,120 @@ package lexer
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/hculpan/kabkey/pkg/diagnostic"
 	"github.com/hculpan/kabkey/pkg/token"
 )
 
+// Lexer works on runes rather than bytes, so positions are character
+// columns and identifiers may contain any Unicode letter.
 type Lexer struct {
-	input        string
+	input        []rune
 	position     int
 	readPosition int
 	lineNo       int
 	linePosition int
-	ch           byte
-	errors       []string
+	ch           rune
+	diagnostics  []diagnostic.Diagnostic
+	keepComments bool
+	filename     string
+
+	// lastType is the type of the last token returned other than a
+	// comment, which decides whether a line break ends a statement.
+	lastType token.TokenType
+
+	// newline is a NEWLINE token to return next, for the line break in a
+	// block comment returned as a token.
+	newline *token.Token
 }
 
 func NewLexer(input string) *Lexer {
-	l := &Lexer{input: input, lineNo: 1, linePosition: 0}
-	l.errors = []string{}
+	l := &Lexer{input: []rune(input), lineNo: 1, linePosition: 0}
+	l.diagnostics = []diagnostic.Diagnostic{}
 	l.readChar()
+	l.skipShebang()
 	return l
 }
 
 func (l *Lexer) Errors() []string {
-	return l.errors
+	errors := []string{}
+	for _, d := range l.diagnostics {
+		errors = append(errors, fmt.Sprintf("[%3d:%3d] %s", d.Line, d.Column, d.Message))
+	}
+
+	return errors
+}
+
+func (l *Lexer) Diagnostics() []diagnostic.Diagnostic {
+	return l.diagnostics
+}
+
+// SetFilename names the file being read, which tokens and diagnostics
+// then refer to.
+func (l *Lexer) SetFilename(filename string) {
+	l.filename = filename
 }
 
+// SetKeepComments controls whether comments are returned as COMMENT tokens
+// rather than skipped. The parser does not understand COMMENT tokens, so
+// this is only meant for tools that work directly on the token stream.
+func (l *Lexer) SetKeepComments(v bool) {
+	l.keepComments = v
+}
+
+// NextToken returns the next token of the input. A line break is returned
+// as a NEWLINE token if the token before it can end a statement, as a
+// semicolon would be in Go, so a statement continues on the next line
+// after an operator, a comma or an opening bracket. Consecutive line breaks
+// give a single NEWLINE token.
 func (l *Lexer) NextToken() token.Token {
+	tok := l.nextToken()
+	tok.Filename = l.filename
+	if tok.Type != token.COMMENT {
+		l.lastType = tok.Type
+	}
+
+	return tok
+}
+
+func (l *Lexer) nextToken() token.Token {
 	var tok token.Token
 
+	if l.newline != nil {
+		tok, l.newline = *l.newline, nil
+		return tok
+	}
+
 	l.skipWhitespace()
 
+	for l.ch == '/' && (l.peekChar() == '/' || l.peekChar() == '*') {
+		comment := l.readComment()
+		newline, ok := l.lineBreakIn(comment)
+		if l.keepComments {
+			if ok {
+				l.newline = &newline
+			}
+			return comment
+		} else if ok {
+			return newline
+		}
+		l.skipWhitespace()
+	}
+
 	switch l.ch {
 	case '=':
 		if l.peekChar() == '=' {
 			tok = newToken(token.EQ, '=', l.lineNo, l.linePosition)
 			tok.Literal = "=="
 			l.readChar()
+		} else if l.peekChar() == '>' {
+			tok = newToken(token.ARROW, '=', l.lineNo, l.linePosition)
+			tok.Literal = "=>"
+			l.readChar()
 		} else {
 			tok = newToken(token.ASSIGN, l.ch, l.lineNo, l.linePosition)
 		}
@@ -58,11 +136,12 @@ func (l *Lexer) NextToken() token.Token {
 			tok = newToken(token.ILLEGAL, l.ch, l.lineNo, l.linePosition)
 		}
 	case '"':
-		val := l.readString()
-		tok = newToken(token.STRING, ' ', l.lineNo, l.linePosition-len(val)-1)
-		tok.Literal = val
+		tok = newToken(token.STRING, ' ', l.lineNo, l.linePosition)
+		tok.Literal = l.readString()
 	case ';':
 		tok = newToken(token.SEMICOLON, l.ch, l.lineNo, l.linePosition)
+	case ':':
+		tok = newToken(token.COLON, l.ch, l.lineNo, l.linePosition)
 	case '(':
 		tok = newToken(token.LPAREN, l.ch, l.lineNo, l.linePosition)
 	case ')':
@@ -70,11 +149,25 @@ func (l *Lexer) NextToken() token.Token {
 	case ',':
 		tok = newToken(token.COMMA, l.ch, l.lineNo, l.linePosition)
 	case '+':
-		tok = newToken(token.PLUS, l.ch, l.lineNo, l.linePosition)
+		if l.peekChar() == '+' {
+			tok = newToken(token.INCREMENT, l.ch, l.lineNo, l.linePosition)
+			tok.Literal = "++"
+			l.readChar()
+		} else if l.peekChar() == '=' {
+			tok = newToken(token.PLUS_ASSIGN, l.ch, l.lineNo, l.linePosition)
+			tok.Literal = "+="
+			l.readChar()
+		} else {
+			tok = newToken(token.PLUS, l.ch, l.lineNo, l.linePosition)
+		}
 	case '{':
 		tok = newToken(token.LBRACE, l.ch, l.lineNo, l.linePosition)
 	case '}':
 		tok = newToken(token.RBRACE, l.ch, l.lineNo, l.linePosition)
+	case '[':
+		tok = newToken(token.LBRACKET, l.ch, l.lineNo, l.linePosition)
+	case ']':
+		tok = newToken(token.RBRACKET, l.ch, l.lineNo, l.linePosition)
 	case '!':
 		if l.peekChar() == '=' {
 			tok = newToken(token.NOT_EQ, '=', l.lineNo, l.linePosition)
@@ -84,11 +177,41 @@ func (l *Lexer) NextToken() token.Token {
 			tok = newToken(token.BANG, l.ch, l.lineNo, l.linePosition)
 		}
 	case '-':
-		tok = newToken(token.MINUS, l.ch, l.lineNo, l.linePosition)
+		if l.peekChar() == '-' {
+			tok = newToken(token.DECREMENT, l.ch, l.lineNo, l.linePosition)
+			tok.Literal = "--"
+			l.readChar()
+		} else if l.peekChar() == '=' {
+			tok = newToken(token.MINUS_ASSIGN, l.ch, l.lineNo, l.linePosition)
+			tok.Literal = "-="
+			l.readChar()
+		} else {
+			tok = newToken(token.MINUS, l.ch, l.lineNo, l.linePosition)
+		}
 	case '/':
-		tok = newToken(token.SLASH, l.ch, l.lineNo, l.linePosition)
+		if l.peekChar() == '=' {
+			tok = newToken(token.SLASH_ASSIGN, l.ch, l.lineNo, l.linePosition)
+			tok.Literal = "/="
+			l.readChar()
+		} else {
+			tok = newToken(token.SLASH, l.ch, l.lineNo, l.linePosition)
+		}
 	case '*':
-		tok = newToken(token.ASTERISK, l.ch, l.lineNo, l.linePosition)
+		if l.peekChar() == '=' {
+			tok = newToken(token.ASTERISK_ASSIGN, l.ch, l.lineNo, l.linePosition)
+			tok.Literal = "*="
+			l.readChar()
+		} else {
+			tok = newToken(token.ASTERISK, l.ch, l.lineNo, l.linePosition)
+		}
+	case '%':
+		if l.peekChar() == '=' {
+			tok = newToken(token.PERCENT_ASSIGN, l.ch, l.lineNo, l.linePosition)
+			tok.Literal = "%="
+			l.readChar()
+		} else {
+			tok = newToken(token.PERCENT, l.ch, l.lineNo, l.linePosition)
+		}
 	case '<':
 		if l.peekChar() == '=' {
 			tok = newToken(token.LTE, l.ch, l.lineNo, l.linePosition)
@@ -105,6 +228,10 @@ func (l *Lexer) NextToken() token.Token {
 		} else {
 			tok = newToken(token.GT, l.ch, l.lineNo, l.linePosition)
 		}
+	case '\n':
+		tok = newToken(token.NEWLINE, l.ch, l.lineNo, l.linePosition)
+		l.lineNo += 1
+		l.linePosition = 0
 	case 0:
 		tok.Literal = ""
 		tok.Type = token.EOF
@@ -120,8 +247,7 @@ func (l *Lexer) NextToken() token.Token {
 		} else if isDigit(l.ch) {
 			tok.LineNo = l.lineNo
 			tok.Position = l.linePosition
-			tok.Literal = l.readNumber()
-			tok.Type = token.INT
+			tok.Literal, tok.Type = l.readNumber()
 			return tok
 		} else {
 			tok = newToken(token.ILLEGAL, l.ch, l.lineNo, l.linePosition)
@@ -134,25 +260,163 @@ func (l *Lexer) NextToken() token.Token {
 }
 
 func (l *Lexer) readString() string {
-	result := ""
+	var result strings.Builder
 
 	l.readChar() // skip over current quote
 
 	for l.ch != '"' {
 		if l.ch == '\n' || l.ch == '\r' || l.position >= len(l.input) {
-			l.addError(l.lineNo, l.linePosition, "string not terminated with closing quote")
+			l.addDiagnostic(l.lineNo, l.linePosition, `add a closing " before the end of the line`, "string not terminated with closing quote")
 			break
 		}
-		result += string(l.ch)
+
+		if l.ch == '\\' {
+			l.readEscape(&result)
+		} else {
+			result.WriteRune(l.ch)
+		}
+		l.readChar()
+	}
+
+	return result.String()
+}
+
+// readEscape decodes the escape sequence starting at the current backslash
+// and leaves the lexer on its last character. Supported sequences are
+// \" \n \t \r \\, \xHH and \u{H...} with up to six hex digits.
+func (l *Lexer) readEscape(out *strings.Builder) {
+	lineNo, position := l.lineNo, l.linePosition
+
+	switch l.peekChar() {
+	case '"':
+		out.WriteRune('"')
+	case 'n':
+		out.WriteRune('\n')
+	case 't':
+		out.WriteRune('\t')
+	case 'r':
+		out.WriteRune('\r')
+	case '\\':
+		out.WriteRune('\\')
+	case 'x':
+		l.readChar()
+		if !isHexDigit(l.peekChar()) || !isHexDigit(l.peekCharAt(2)) {
+			l.addError(lineNo, position, "invalid escape sequence: \\x must be followed by two hex digits")
+			return
+		}
+		l.readChar()
+		l.readChar()
+		value, _ := strconv.ParseUint(string(l.input[l.position-1:l.position+1]), 16, 32)
+		out.WriteRune(rune(value))
+		return
+	case 'u':
+		l.readChar()
+		if l.peekChar() != '{' {
+			l.addError(lineNo, position, "invalid escape sequence: \\u must be followed by {hex digits}")
+			return
+		}
+		l.readChar()
+
+		start := l.position + 1
+		for isHexDigit(l.peekChar()) {
+			l.readChar()
+		}
+		digits := string(l.input[start : l.position+1])
+
+		if l.peekChar() != '}' || len(digits) == 0 || len(digits) > 6 {
+			l.addError(lineNo, position, "invalid escape sequence: \\u{%s", digits)
+			return
+		}
+		l.readChar()
+
+		value, _ := strconv.ParseUint(digits, 16, 32)
+		if value > unicode.MaxRune || (value >= 0xD800 && value <= 0xDFFF) {
+			l.addError(lineNo, position, "invalid escape sequence: \\u{%s} is not a valid code point", digits)
+			return
+		}
+		out.WriteRune(rune(value))
+		return
+	default:
+		l.addDiagnostic(lineNo, position, `supported escapes are \" \n \t \r \\ \xHH and \u{H...}`, "unknown escape sequence: \\%c", l.peekChar())
+		return
+	}
+
+	l.readChar()
+}
+
+// readComment reads a "//" line comment or a "/* */" block comment. Block
+// comments nest, so "/* a /* b */ c */" is a single comment.
+func (l *Lexer) readComment() token.Token {
+	start := l.position
+	tok := token.Token{Type: token.COMMENT, LineNo: l.lineNo, Position: l.linePosition}
+
+	if l.peekChar() == '/' {
+		for l.ch != '\n' && l.ch != 0 {
+			l.readChar()
+		}
+		tok.Literal = string(l.input[start:l.position])
+		return tok
+	}
+
+	l.readChar()
+	l.readChar()
+
+	depth := 1
+	for depth > 0 {
+		switch {
+		case l.ch == 0:
+			l.addDiagnostic(tok.LineNo, tok.Position, "add */ to close the comment", "block comment not terminated")
+			tok.Literal = string(l.input[start:l.position])
+			return tok
+		case l.ch == '/' && l.peekChar() == '*':
+			depth++
+			l.readChar()
+		case l.ch == '*' && l.peekChar() == '/':
+			depth--
+			l.readChar()
+		case l.ch == '\n':
+			l.lineNo += 1
+			l.linePosition = 0
+		}
 		l.readChar()
 	}
 
-	return result
+	tok.Literal = string(l.input[start:l.position])
+	return tok
+}
+
+// lineBreakIn returns a NEWLINE token for the first line break in a block
+// comment, if the comment follows a token that can end a statement. The
+// comment then ends the statement, as the line break would without it.
+func (l *Lexer) lineBreakIn(comment token.Token) (token.Token, bool) {
+	i := strings.IndexRune(comment.Literal, '\n')
+	if i < 0 || !endsStatement(l.lastType) {
+		return token.Token{}, false
+	}
+
+	position := comment.Position + utf8.RuneCountInString(comment.Literal[:i])
+	return newToken(token.NEWLINE, '\n', comment.LineNo, position), true
+}
+
+// skipShebang skips a "#!" interpreter line at the very start of the input.
+func (l *Lexer) skipShebang() {
+	if l.ch != '#' || l.peekChar() != '!' {
+		return
+	}
+
+	for l.ch != '\n' && l.ch != 0 {
+		l.readChar()
+	}
 }
 
+// skipWhitespace skips spaces and line breaks, stopping at a line break
+// that ends a statement.
 func (l *Lexer) skipWhitespace() {
 	for l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
 		if l.ch == '\n' {
+			if endsStatement(l.lastType) {
+				return
+			}
 			l.lineNo += 1
 			l.linePosition = 0
 		}
@@ -166,27 +430,69 @@ func (l *Lexer) readIdentifier() string {
 		l.readChar()
 	}
 
-	return l.input[position:l.position]
+	return string(l.input[position:l.position])
 }
 
-func (l *Lexer) readNumber() string {
+// readNumber reads an integer or floating-point literal. A literal is a
+// float if it has a fractional part ("1.5") or an exponent ("15e-1").
+func (l *Lexer) readNumber() (string, token.TokenType) {
 	position := l.position
+	tokenType := token.TokenType(token.INT)
+
+	l.readDigits()
+
+	if l.ch == '.' && isDigit(l.peekChar()) {
+		tokenType = token.FLOAT
+		l.readChar()
+		l.readDigits()
+	}
+
+	if l.ch == 'e' || l.ch == 'E' {
+		next := l.peekChar()
+		if isDigit(next) || ((next == '+' || next == '-') && isDigit(l.peekCharAt(2))) {
+			tokenType = token.FLOAT
+			l.readChar()
+			if l.ch == '+' || l.ch == '-' {
+				l.readChar()
+			}
+			l.readDigits()
+		}
+	}
+
+	return string(l.input[position:l.position]), tokenType
+}
+
+func (l *Lexer) readDigits() {
 	for isDigit(l.ch) {
 		l.readChar()
 	}
+}
+
+// endsStatement reports whether a statement can end with a token of type t.
+func endsStatement(t token.TokenType) bool {
+	switch t {
+	case token.IDENT, token.INT, token.FLOAT, token.STRING, token.TRUE, token.FALSE,
+		token.RETURN, token.BREAK, token.CONTINUE, token.INCREMENT, token.DECREMENT,
+		token.RPAREN, token.RBRACKET, token.RBRACE:
+		return true
+	}
 
-	return l.input[position:l.position]
+	return false
 }
 
-func isDigit(ch byte) bool {
+func isDigit(ch rune) bool {
 	return '0' <= ch && ch <= '9'
 }
 
-func isLetter(ch byte) bool {
-	return ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || (ch == '_')
+func isHexDigit(ch rune) bool {
+	return isDigit(ch) || ('a' <= ch && ch <= 'f') || ('A' <= ch && ch <= 'F')
+}
+
+func isLetter(ch rune) bool {
+	return unicode.IsLetter(ch) || (ch == '_')
 }
 
-func newToken(tokenType token.TokenType, ch byte, lineNo, position int) token.Token {
+func newToken(tokenType token.TokenType, ch rune, lineNo, position int) token.Token {
 	return token.Token{
 		Type:     tokenType,
 		Literal:  string(ch),
@@ -207,7 +513,7 @@ func (l *Lexer) readChar() {
 	l.linePosition += 1
 }
 
-func (l *Lexer) peekChar() byte {
+func (l *Lexer) peekChar() rune {
 	if l.readPosition >= len(l.input) {
 		return 0
 	} else {
@@ -215,7 +521,27 @@ func (l *Lexer) peekChar() byte {
 	}
 }
 
+func (l *Lexer) peekCharAt(offset int) rune {
+	pos := l.position + offset
+	if pos >= len(l.input) {
+		return 0
+	}
+
+	return l.input[pos]
+}
+
 func (l *Lexer) addError(lineNo, position int, format string, a ...interface{}) {
-	msg := fmt.Sprintf("[%d:%d] %s", lineNo, position, fmt.Sprintf(format, a...))
-	l.errors = append(l.errors, msg)
+	l.addDiagnostic(lineNo, position, "", format, a...)
+}
+
+func (l *Lexer) addDiagnostic(lineNo, position int, hint string, format string, a ...interface{}) {
+	l.diagnostics = append(l.diagnostics, diagnostic.Diagnostic{
+		Severity: diagnostic.Error,
+		File:     l.filename,
+		Line:     lineNo,
+		Column:   position,
+		Span:     1,
+		Message:  fmt.Sprintf(format, a...),
+		Hint:     hint,
+	})
 }
@@ -26,6 +26,277 @@ func TestString(t *testing.T) {
 	}
 }
 
+func TestStringEscapes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"a\nb"`, "a\nb"},
+		{`"tab\there"`, "tab\there"},
+		{`"cr\r"`, "cr\r"},
+		{`"say \"hi\""`, `say "hi"`},
+		{`"back\\slash"`, `back\slash`},
+		{`"\x41\x62"`, "Ab"},
+		{`"\u{48}\u{e9}\u{1F600}"`, "H\u00e9\U0001F600"},
+		{`"héllo wörld"`, "héllo wörld"},
+	}
+
+	for i, tt := range tests {
+		l := NewLexer(tt.input)
+		tok := l.NextToken()
+
+		if len(l.Errors()) != 0 {
+			t.Errorf("tests[%d] - unexpected errors: %v", i, l.Errors())
+		}
+
+		if tok.Type != token.STRING {
+			t.Fatalf("tests[%d] - expected type %q, got %q", i, token.STRING, tok.Type)
+		}
+
+		if tok.Literal != tt.expected {
+			t.Errorf("tests[%d] - expected literal %q, got %q", i, tt.expected, tok.Literal)
+		}
+	}
+}
+
+func TestInvalidStringEscapes(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{`"\q"`, `[  1:  2] unknown escape sequence: \q`},
+		{`"\xZ1"`, `[  1:  2] invalid escape sequence: \x must be followed by two hex digits`},
+		{`"\u41"`, `[  1:  2] invalid escape sequence: \u must be followed by {hex digits}`},
+		{`"\u{}"`, `[  1:  2] invalid escape sequence: \u{`},
+		{`"\u{110000}"`, `[  1:  2] invalid escape sequence: \u{110000} is not a valid code point`},
+	}
+
+	for i, tt := range tests {
+		l := NewLexer(tt.input)
+		l.NextToken()
+
+		if len(l.Errors()) == 0 || l.Errors()[0] != tt.expectedError {
+			t.Errorf("tests[%d] - expected error %q, got %v", i, tt.expectedError, l.Errors())
+		}
+	}
+}
+
+func TestUnicodeIdentifiersAndPositions(t *testing.T) {
+	input := `let café = "naïve"; café`
+
+	tests := []struct {
+		expectedType     token.TokenType
+		expectedLiteral  string
+		expectedPosition int
+	}{
+		{token.LET, "let", 1},
+		{token.IDENT, "café", 5},
+		{token.ASSIGN, "=", 10},
+		{token.STRING, "naïve", 12},
+		{token.SEMICOLON, ";", 19},
+		{token.IDENT, "café", 21},
+		{token.EOF, "", 25},
+	}
+
+	l := NewLexer(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - token type wrong, expected %q, got %q", i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - token literal wrong, expected %q, got %q", i, tt.expectedLiteral, tok.Literal)
+		}
+
+		if tok.Position != tt.expectedPosition {
+			t.Fatalf("tests[%d] - token position wrong, expected %d, got %d", i, tt.expectedPosition, tok.Position)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := `#!/usr/bin/env kabkey
+let a = 1; // trailing comment
+/* block
+   comment */ a
+/* outer /* inner */ still outer */ 2 / 3
+//`
+
+	tests := []struct {
+		expectedType     token.TokenType
+		expectedLiteral  string
+		expectedLine     int
+		expectedPosition int
+	}{
+		{token.LET, "let", 2, 1},
+		{token.IDENT, "a", 2, 5},
+		{token.ASSIGN, "=", 2, 7},
+		{token.INT, "1", 2, 9},
+		{token.SEMICOLON, ";", 2, 10},
+		{token.IDENT, "a", 4, 15},
+		{token.NEWLINE, "\n", 4, 16},
+		{token.INT, "2", 5, 37},
+		{token.SLASH, "/", 5, 39},
+		{token.INT, "3", 5, 41},
+		{token.NEWLINE, "\n", 5, 42},
+		{token.EOF, "", 6, 3},
+	}
+
+	l := NewLexer(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - token type wrong, expected %q, got %q", i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - token literal wrong, expected %q, got %q", i, tt.expectedLiteral, tok.Literal)
+		}
+
+		if tok.LineNo != tt.expectedLine {
+			t.Fatalf("tests[%d] - token line wrong, expected %d, got %d", i, tt.expectedLine, tok.LineNo)
+		}
+
+		if tok.Position != tt.expectedPosition {
+			t.Fatalf("tests[%d] - token position wrong, expected %d, got %d", i, tt.expectedPosition, tok.Position)
+		}
+	}
+
+	if len(l.Errors()) != 0 {
+		t.Fatalf("unexpected lexer errors: %v", l.Errors())
+	}
+}
+
+func TestKeepComments(t *testing.T) {
+	input := "a // one\n/* two */ b"
+
+	l := NewLexer(input)
+	l.SetKeepComments(true)
+
+	expected := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.COMMENT, "// one"},
+		{token.NEWLINE, "\n"},
+		{token.COMMENT, "/* two */"},
+		{token.IDENT, "b"},
+		{token.EOF, ""},
+	}
+
+	for i, tt := range expected {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType || tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - expected %q %q, got %q %q", i, tt.expectedType, tt.expectedLiteral, tok.Type, tok.Literal)
+		}
+	}
+}
+
+func TestBlockCommentLineBreaks(t *testing.T) {
+	tests := []struct {
+		input    string
+		keep     bool
+		expected []token.TokenType
+	}{
+		{"a /*\n*/ b", false, []token.TokenType{token.IDENT, token.NEWLINE, token.IDENT}},
+		{"a /* x */ b", false, []token.TokenType{token.IDENT, token.IDENT}},
+		{"a + /*\n*/ b", false, []token.TokenType{token.IDENT, token.PLUS, token.IDENT}},
+		{"a /*\n*/\n/*\n*/ b", false, []token.TokenType{token.IDENT, token.NEWLINE, token.IDENT}},
+		{"a /*\n*/ b", true, []token.TokenType{token.IDENT, token.COMMENT, token.NEWLINE, token.IDENT}},
+	}
+
+	for i, tt := range tests {
+		l := NewLexer(tt.input)
+		l.SetKeepComments(tt.keep)
+
+		for j, expected := range append(tt.expected, token.EOF) {
+			tok := l.NextToken()
+			if tok.Type != expected {
+				t.Fatalf("tests[%d] - token %d: expected %q, got %q", i, j, expected, tok.Type)
+			}
+		}
+	}
+
+	// The line break is reported where it is in the comment.
+	l := NewLexer("a /* x\n */ b")
+	l.NextToken()
+	if tok := l.NextToken(); tok.LineNo != 1 || tok.Position != 7 {
+		t.Errorf("wrong NEWLINE position. expected=[1:7], got=[%d:%d]", tok.LineNo, tok.Position)
+	}
+}
+
+func TestUnterminatedBlockComment(t *testing.T) {
+	l := NewLexer("1 /* never /* closed */")
+
+	if tok := l.NextToken(); tok.Type != token.INT {
+		t.Fatalf("expected %q, got %q", token.INT, tok.Type)
+	}
+
+	if tok := l.NextToken(); tok.Type != token.EOF {
+		t.Fatalf("expected %q, got %q", token.EOF, tok.Type)
+	}
+
+	if len(l.Errors()) != 1 || l.Errors()[0] != "[  1:  3] block comment not terminated" {
+		t.Fatalf("wrong errors, got %v", l.Errors())
+	}
+}
+
+func TestFilename(t *testing.T) {
+	l := NewLexer("let s = \"\\q\";")
+	l.SetFilename("main.mky")
+
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		if tok.Filename != "main.mky" {
+			t.Fatalf("token %q has wrong filename %q", tok.Literal, tok.Filename)
+		}
+	}
+
+	diagnostics := l.Diagnostics()
+	if len(diagnostics) != 1 {
+		t.Fatalf("wrong diagnostics, got %v", diagnostics)
+	}
+
+	d := diagnostics[0]
+	if d.File != "main.mky" || d.Line != 1 || d.Column != 10 || d.Message != `unknown escape sequence: \q` || d.Hint == "" {
+		t.Errorf("wrong diagnostic, got %+v", d)
+	}
+}
+
+func TestNumbers(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{"42", token.INT, "42"},
+		{"1.5", token.FLOAT, "1.5"},
+		{"1.5e-3", token.FLOAT, "1.5e-3"},
+		{"2E10", token.FLOAT, "2E10"},
+		{"3e+2", token.FLOAT, "3e+2"},
+		{"7e", token.INT, "7"},
+		{"8.", token.INT, "8"},
+	}
+
+	for i, tt := range tests {
+		l := NewLexer(tt.input)
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Errorf("tests[%d] - token type wrong, expected %q, got %q", i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Errorf("tests[%d] - token literal wrong, expected %q, got %q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
 func TestNextToken(t *testing.T) {
 	input := `let five = 5;
 let ten = 10;
@@ -36,7 +307,7 @@ let add = fn(x, y) {
 	
 let result = add(five, ten);
 
-!-/*5;
+!-/ *5;
 
 5 < 10 > 5;
 
@@ -62,6 +333,9 @@ a || a
 
 a <= a
 a >= a
+[1, 2]
+{"a": 1}
+a += -= *= /= %= % ++ --
 `
 
 	tests := []struct {
@@ -95,6 +369,7 @@ a >= a
 		{token.IDENT, "y", 5, 9},
 		{token.SEMICOLON, ";", 5, 10},
 		{token.RBRACE, "}", 6, 1},
+		{token.NEWLINE, "\n", 6, 2},
 		{token.LET, "let", 8, 1},
 		{token.IDENT, "result", 8, 5},
 		{token.ASSIGN, "=", 8, 12},
@@ -108,9 +383,9 @@ a >= a
 		{token.BANG, "!", 10, 1},
 		{token.MINUS, "-", 10, 2},
 		{token.SLASH, "/", 10, 3},
-		{token.ASTERISK, "*", 10, 4},
-		{token.INT, "5", 10, 5},
-		{token.SEMICOLON, ";", 10, 6},
+		{token.ASTERISK, "*", 10, 5},
+		{token.INT, "5", 10, 6},
+		{token.SEMICOLON, ";", 10, 7},
 		{token.INT, "5", 12, 1},
 		{token.LT, "<", 12, 3},
 		{token.INT, "10", 12, 5},
@@ -134,6 +409,7 @@ a >= a
 		{token.FALSE, "false", 17, 15},
 		{token.SEMICOLON, ";", 17, 20},
 		{token.RBRACE, "}", 18, 1},
+		{token.NEWLINE, "\n", 18, 2},
 		{token.INT, "10", 20, 1},
 		{token.EQ, "==", 20, 4},
 		{token.INT, "10", 20, 7},
@@ -167,19 +443,46 @@ a >= a
 		{token.INT, "1", 28, 17},
 		{token.SEMICOLON, ";", 28, 18},
 		{token.RBRACE, "}", 29, 1},
+		{token.NEWLINE, "\n", 29, 2},
 		{token.IDENT, "a", 31, 1},
 		{token.AND, "&&", 31, 3},
 		{token.IDENT, "a", 31, 6},
+		{token.NEWLINE, "\n", 31, 7},
 		{token.IDENT, "a", 32, 1},
 		{token.OR, "||", 32, 3},
 		{token.IDENT, "a", 32, 6},
+		{token.NEWLINE, "\n", 32, 7},
 		{token.IDENT, "a", 34, 1},
 		{token.LTE, "<=", 34, 3},
 		{token.IDENT, "a", 34, 6},
+		{token.NEWLINE, "\n", 34, 7},
 		{token.IDENT, "a", 35, 1},
 		{token.GTE, ">=", 35, 3},
 		{token.IDENT, "a", 35, 6},
-		{token.EOF, "", 36, 1},
+		{token.NEWLINE, "\n", 35, 7},
+		{token.LBRACKET, "[", 36, 1},
+		{token.INT, "1", 36, 2},
+		{token.COMMA, ",", 36, 3},
+		{token.INT, "2", 36, 5},
+		{token.RBRACKET, "]", 36, 6},
+		{token.NEWLINE, "\n", 36, 7},
+		{token.LBRACE, "{", 37, 1},
+		{token.STRING, "a", 37, 2},
+		{token.COLON, ":", 37, 5},
+		{token.INT, "1", 37, 7},
+		{token.RBRACE, "}", 37, 8},
+		{token.NEWLINE, "\n", 37, 9},
+		{token.IDENT, "a", 38, 1},
+		{token.PLUS_ASSIGN, "+=", 38, 3},
+		{token.MINUS_ASSIGN, "-=", 38, 6},
+		{token.ASTERISK_ASSIGN, "*=", 38, 9},
+		{token.SLASH_ASSIGN, "/=", 38, 12},
+		{token.PERCENT_ASSIGN, "%=", 38, 15},
+		{token.PERCENT, "%", 38, 18},
+		{token.INCREMENT, "++", 38, 20},
+		{token.DECREMENT, "--", 38, 23},
+		{token.NEWLINE, "\n", 38, 25},
+		{token.EOF, "", 39, 1},
 	}
 
 	l := NewLexer(input)
@@ -1,7 +1,15 @@
 package object
 
+import "github.com/hculpan/kabkey/pkg/ast"
+
+// Environment holds the variables of one scope. Variables the resolver has
+// assigned a slot to live in slots, indexed by position; any others live in
+// store, which scoped environments only allocate when needed. A nil slot is
+// a variable that has not been set yet.
 type Environment struct {
 	store map[string]Object
+	slots []Object
+	scope *ast.Scope
 	outer *Environment
 }
 
@@ -18,7 +26,38 @@ func NewEnvironment() *Environment {
 	}
 }
 
+// NewScopedEnvironment creates an environment laid out as scope describes.
+// A nil scope gives a plain enclosed environment.
+func NewScopedEnvironment(outer *Environment, scope *ast.Scope) *Environment {
+	if scope == nil {
+		return NewEnclosedEnvironment(outer)
+	}
+
+	return &Environment{
+		slots: make([]Object, len(scope.Slots)),
+		scope: scope,
+		outer: outer,
+	}
+}
+
+// slot returns the slot index of name in this environment, or -1.
+func (e *Environment) slot(name string) int {
+	if e.scope == nil {
+		return -1
+	}
+
+	if i, ok := e.scope.Slots[name]; ok {
+		return i
+	}
+
+	return -1
+}
+
 func (e *Environment) Get(name string) (Object, bool) {
+	if i := e.slot(name); i >= 0 && e.slots[i] != nil {
+		return e.slots[i], true
+	}
+
 	obj, ok := e.store[name]
 	if !ok && e.outer != nil {
 		obj, ok = e.outer.Get(name)
@@ -27,6 +66,97 @@ func (e *Environment) Get(name string) (Object, bool) {
 }
 
 func (e *Environment) Set(name string, val Object) Object {
+	if i := e.slot(name); i >= 0 {
+		e.slots[i] = val
+		return val
+	}
+
+	if e.store == nil {
+		e.store = make(map[string]Object)
+	}
+
 	e.store[name] = val
 	return val
 }
+
+// Assign updates name in the scope where it was defined, walking outward
+// through enclosing environments. It reports false if name is undeclared.
+func (e *Environment) Assign(name string, val Object) (Object, bool) {
+	if i := e.slot(name); i >= 0 && e.slots[i] != nil {
+		e.slots[i] = val
+		return val, true
+	}
+
+	if _, ok := e.store[name]; ok {
+		e.store[name] = val
+		return val, true
+	}
+
+	if e.outer != nil {
+		return e.outer.Assign(name, val)
+	}
+
+	return nil, false
+}
+
+// The methods below take a location computed by the resolver: depth
+// environments outward, then slot in that environment, or a lookup of name
+// there when slot is -1. They report false when the variable is not set at
+// that location, in which case callers fall back to Get and Assign, which
+// search by name.
+
+func (e *Environment) GetAt(depth, slot int, name string) (Object, bool) {
+	target := e.ancestor(depth)
+	if target == nil {
+		return nil, false
+	}
+
+	if slot < 0 {
+		obj, ok := target.store[name]
+		return obj, ok
+	}
+
+	if slot >= len(target.slots) {
+		return nil, false
+	}
+
+	obj := target.slots[slot]
+	return obj, obj != nil
+}
+
+func (e *Environment) AssignAt(depth, slot int, name string, val Object) bool {
+	target := e.ancestor(depth)
+	if target == nil {
+		return false
+	}
+
+	if slot < 0 {
+		if _, ok := target.store[name]; !ok {
+			return false
+		}
+		target.store[name] = val
+		return true
+	}
+
+	if slot >= len(target.slots) || target.slots[slot] == nil {
+		return false
+	}
+
+	target.slots[slot] = val
+	return true
+}
+
+// SetSlot sets a variable the resolver declared in this environment.
+func (e *Environment) SetSlot(slot int, val Object) Object {
+	e.slots[slot] = val
+	return val
+}
+
+func (e *Environment) ancestor(depth int) *Environment {
+	target := e
+	for i := 0; i < depth && target != nil; i++ {
+		target = target.outer
+	}
+
+	return target
+}
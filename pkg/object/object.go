@@ -3,9 +3,13 @@ package object
 import (
 	"bytes"
 	"fmt"
+	"hash/fnv"
+	"strconv"
 	"strings"
 
 	"github.com/hculpan/kabkey/pkg/ast"
+	"github.com/hculpan/kabkey/pkg/code"
+	"github.com/hculpan/kabkey/pkg/diagnostic"
 )
 
 type ObjectType string
@@ -13,13 +17,21 @@ type ObjectType string
 type BuiltinFunction func(env *Environment, arg []Object) Object
 
 const (
-	INTEGER_OBJ  = "INTEGER"
-	BOOLEAN_OBJ  = "BOOLEAN"
-	NULL_OBJ     = "NULL"
-	RETURN_OBJ   = "RETURN_VALUE"
-	ERROR_OBJ    = "ERROR"
-	FUNCTION_OBJ = "FUNCTION"
-	STRING_OBJ   = "STRING"
+	INTEGER_OBJ   = "INTEGER"
+	FLOAT_OBJ     = "FLOAT"
+	BOOLEAN_OBJ   = "BOOLEAN"
+	NULL_OBJ      = "NULL"
+	RETURN_OBJ    = "RETURN_VALUE"
+	BREAK_OBJ     = "BREAK"
+	CONTINUE_OBJ  = "CONTINUE"
+	TAIL_CALL_OBJ = "TAIL_CALL"
+	ERROR_OBJ     = "ERROR"
+	FUNCTION_OBJ  = "FUNCTION"
+	STRING_OBJ    = "STRING"
+	ARRAY_OBJ     = "ARRAY"
+	HASH_OBJ      = "HASH"
+
+	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION"
 )
 
 var extendedErrorOutput bool = true
@@ -28,11 +40,33 @@ func SetExtendedErrorOutput(v bool) {
 	extendedErrorOutput = v
 }
 
+// ExtendedErrorOutput reports whether errors are shown with their positions
+// and tracebacks.
+func ExtendedErrorOutput() bool {
+	return extendedErrorOutput
+}
+
 type Object interface {
 	Type() ObjectType
 	Inspect() string
 }
 
+type HashKey struct {
+	Type  ObjectType
+	Value uint64
+}
+
+// Hashable is implemented by objects that may be used as keys in a Hash.
+type Hashable interface {
+	HashKey() HashKey
+}
+
+// Iterable is implemented by objects that can be looped over with a
+// for-in loop. Iterate returns the loop values in order.
+type Iterable interface {
+	Iterate() []Object
+}
+
 type Integer struct {
 	Value int64
 }
@@ -45,6 +79,29 @@ func (i *Integer) Type() ObjectType {
 	return INTEGER_OBJ
 }
 
+func (i *Integer) HashKey() HashKey {
+	return HashKey{Type: i.Type(), Value: uint64(i.Value)}
+}
+
+type Float struct {
+	Value float64
+}
+
+// Inspect always shows a fractional part or exponent so that floats can be
+// told apart from integers in output.
+func (f *Float) Inspect() string {
+	result := strconv.FormatFloat(f.Value, 'g', -1, 64)
+	if !strings.ContainsAny(result, ".eIN") {
+		result += ".0"
+	}
+
+	return result
+}
+
+func (f *Float) Type() ObjectType {
+	return FLOAT_OBJ
+}
+
 type String struct {
 	Value string
 }
@@ -57,6 +114,23 @@ func (s *String) Type() ObjectType {
 	return STRING_OBJ
 }
 
+// Iterate yields each character of the string as a one-character String.
+func (s *String) Iterate() []Object {
+	result := []Object{}
+	for _, r := range s.Value {
+		result = append(result, &String{Value: string(r)})
+	}
+
+	return result
+}
+
+func (s *String) HashKey() HashKey {
+	h := fnv.New64a()
+	h.Write([]byte(s.Value))
+
+	return HashKey{Type: s.Type(), Value: h.Sum64()}
+}
+
 type Boolean struct {
 	Value bool
 }
@@ -69,6 +143,110 @@ func (b *Boolean) Type() ObjectType {
 	return BOOLEAN_OBJ
 }
 
+func (b *Boolean) HashKey() HashKey {
+	var value uint64
+	if b.Value {
+		value = 1
+	}
+
+	return HashKey{Type: b.Type(), Value: value}
+}
+
+type Array struct {
+	Elements []Object
+}
+
+func (a *Array) Inspect() string {
+	var out bytes.Buffer
+
+	elements := []string{}
+	for _, e := range a.Elements {
+		elements = append(elements, e.Inspect())
+	}
+
+	out.WriteString("[")
+	out.WriteString(strings.Join(elements, ", "))
+	out.WriteString("]")
+
+	return out.String()
+}
+
+func (a *Array) Type() ObjectType {
+	return ARRAY_OBJ
+}
+
+func (a *Array) Iterate() []Object {
+	return a.Elements
+}
+
+type HashPair struct {
+	Key   Object
+	Value Object
+}
+
+// Hash keeps its keys in insertion order so that Inspect and the
+// keys/values builtins produce stable output.
+type Hash struct {
+	Pairs map[HashKey]HashPair
+	Order []HashKey
+}
+
+func NewHash() *Hash {
+	return &Hash{Pairs: make(map[HashKey]HashPair)}
+}
+
+func (h *Hash) Set(key Hashable, value Object) {
+	hashKey := key.HashKey()
+	if _, ok := h.Pairs[hashKey]; !ok {
+		h.Order = append(h.Order, hashKey)
+	}
+
+	h.Pairs[hashKey] = HashPair{Key: key.(Object), Value: value}
+}
+
+func (h *Hash) Get(key Hashable) (Object, bool) {
+	pair, ok := h.Pairs[key.HashKey()]
+	return pair.Value, ok
+}
+
+func (h *Hash) OrderedPairs() []HashPair {
+	result := make([]HashPair, 0, len(h.Order))
+	for _, k := range h.Order {
+		result = append(result, h.Pairs[k])
+	}
+
+	return result
+}
+
+func (h *Hash) Inspect() string {
+	var out bytes.Buffer
+
+	pairs := []string{}
+	for _, pair := range h.OrderedPairs() {
+		pairs = append(pairs, pair.Key.Inspect()+": "+pair.Value.Inspect())
+	}
+
+	out.WriteString("{")
+	out.WriteString(strings.Join(pairs, ", "))
+	out.WriteString("}")
+
+	return out.String()
+}
+
+func (h *Hash) Type() ObjectType {
+	return HASH_OBJ
+}
+
+// Iterate yields the keys of the hash in insertion order.
+func (h *Hash) Iterate() []Object {
+	result := make([]Object, 0, len(h.Order))
+	for _, pair := range h.OrderedPairs() {
+		result = append(result, pair.Key)
+	}
+
+	return result
+}
+
 type Null struct {
 }
 
@@ -92,23 +270,148 @@ func (rv *ReturnValue) Inspect() string {
 	return rv.Value.Inspect()
 }
 
+// Break and Continue are internal control-flow signals produced by the
+// break and continue statements. Like ReturnValue they are not values: the
+// evaluator must pass them up out of every block and expression they come
+// from until the enclosing loop consumes them, or they would end up stored
+// in variables, printed or used as operands.
+type Break struct {
+	LineNo   int
+	Position int
+}
+
+func (b *Break) Type() ObjectType {
+	return BREAK_OBJ
+}
+
+func (b *Break) Inspect() string {
+	return "break"
+}
+
+type Continue struct {
+	LineNo   int
+	Position int
+}
+
+func (c *Continue) Type() ObjectType {
+	return CONTINUE_OBJ
+}
+
+func (c *Continue) Inspect() string {
+	return "continue"
+}
+
+// TailCall is an internal signal for a call in tail position. Instead of
+// making the call, the evaluator hands it back to the function being
+// called, which makes it in its place so that the Go stack does not grow.
+type TailCall struct {
+	Call      *ast.CallExpression
+	Function  Object
+	Arguments []Object
+}
+
+func (tc *TailCall) Type() ObjectType {
+	return TAIL_CALL_OBJ
+}
+
+func (tc *TailCall) Inspect() string {
+	return "tail call"
+}
+
 type Error struct {
 	Message  string
 	LineNo   int
 	Position int
 	Filename string
+	Span     int
+	Hint     string
+
+	// Stack holds the calls the error propagated out of, innermost first.
+	Stack []StackFrame
 }
 
 func (e *Error) Type() ObjectType {
 	return ERROR_OBJ
 }
 
+// Inspect describes the error. Extended error output adds its position and
+// a traceback of the calls it propagated out of, in which runs of the same
+// call, as in deep recursion, are shown once.
 func (e *Error) Inspect() string {
-	if extendedErrorOutput {
-		return fmt.Sprintf("[%d:%d] ERROR: %s", e.LineNo, e.Position, e.Message)
-	} else {
+	if !extendedErrorOutput {
 		return fmt.Sprintf("ERROR: %s", e.Message)
 	}
+
+	return fmt.Sprintf("[%d:%d] ERROR: %s", e.LineNo, e.Position, e.Message) + e.Traceback()
+}
+
+// Traceback lists the calls the error propagated out of, one per line and
+// each line starting with a newline.
+func (e *Error) Traceback() string {
+	var out bytes.Buffer
+
+	for i := 0; i < len(e.Stack); {
+		frame := e.Stack[i]
+		repeated := 0
+		for i+repeated+1 < len(e.Stack) && e.Stack[i+repeated+1] == frame {
+			repeated++
+		}
+
+		out.WriteString("\n\tin " + frame.String())
+		if repeated > 0 {
+			fmt.Fprintf(&out, "\n\t... repeated %d more times", repeated)
+		}
+
+		i += repeated + 1
+	}
+
+	return out.String()
+}
+
+// Diagnostic describes the error for display with the source it refers to.
+func (e *Error) Diagnostic() diagnostic.Diagnostic {
+	return diagnostic.Diagnostic{
+		Severity: diagnostic.Error,
+		File:     e.Filename,
+		Line:     e.LineNo,
+		Column:   e.Position,
+		Span:     e.Span,
+		Message:  e.Message,
+		Hint:     e.Hint,
+	}
+}
+
+// Render describes the error with the line of source it refers to, as
+// Diagnostic().Render does, followed by its traceback.
+func (e *Error) Render(source string) string {
+	out := e.Diagnostic().Render(source)
+	if len(e.Stack) > 0 {
+		out += strings.TrimPrefix(e.Traceback(), "\n") + "\n"
+	}
+
+	return out
+}
+
+// Error lets the VM return runtime errors through Go's error interface.
+func (e *Error) Error() string {
+	return fmt.Sprintf("[%d:%d] %s", e.LineNo, e.Position, e.Message)
+}
+
+// StackFrame is a call in progress when an error occurred: the function
+// called and where it was called from.
+type StackFrame struct {
+	Function string
+	LineNo   int
+	Position int
+	Filename string
+}
+
+func (sf StackFrame) String() string {
+	if sf.Filename != "" {
+		return fmt.Sprintf("%s called from %s [%d:%d]", sf.Function, sf.Filename, sf.LineNo, sf.Position)
+	}
+
+	return fmt.Sprintf("%s called from [%d:%d]", sf.Function, sf.LineNo, sf.Position)
 }
 
 func NewError(msg string, lineNo, position int) *Error {
@@ -123,6 +426,7 @@ type Function struct {
 	Name       string
 	Parameters []*ast.Identifier
 	Body       *ast.BlockStatement
+	Scope      *ast.Scope
 	Env        *Environment
 	NativeImpl BuiltinFunction
 }
@@ -132,18 +436,101 @@ func (f *Function) Type() ObjectType {
 }
 
 func (f *Function) Inspect() string {
-	var out bytes.Buffer
+	if f.NativeImpl != nil {
+		return "builtin function " + f.Name
+	}
 
 	params := []string{}
 	for _, p := range f.Parameters {
 		params = append(params, p.String())
 	}
 
-	out.WriteString("fn(")
+	return inspectFunction(f.Name, params, f.Body.String())
+}
+
+// inspectFunction renders a function the same way in both engines.
+func inspectFunction(name string, params []string, body string) string {
+	var out bytes.Buffer
+
+	out.WriteString("fn")
+	if name != "" {
+		out.WriteString(" " + name)
+	}
+	out.WriteString("(")
 	out.WriteString(strings.Join(params, ", "))
 	out.WriteString(") {\n")
-	out.WriteString(f.Body.String())
+	out.WriteString(body)
 	out.WriteString("\n}")
 
 	return out.String()
 }
+
+// Capture describes where a closure finds one of its free variables when it
+// is created: a local slot of the enclosing frame, or one of the enclosing
+// closure's own free variables.
+type Capture struct {
+	Local bool
+	Index int
+}
+
+type CompiledFunction struct {
+	Name          string
+	Instructions  code.Instructions
+	Positions     code.PositionTable
+	NumLocals     int
+	NumParameters int
+	Captures      []Capture
+	LocalNames    []string
+	FreeNames     []string
+	// Body is the source of the function's body as the evaluator prints
+	// it, for Closure.Inspect.
+	Body string
+}
+
+func (cf *CompiledFunction) Type() ObjectType {
+	return COMPILED_FUNCTION_OBJ
+}
+
+func (cf *CompiledFunction) Inspect() string {
+	return fmt.Sprintf("CompiledFunction[%p]", cf)
+}
+
+// Upvalue is a variable captured by a closure. While the frame that owns
+// the variable is live, Location points at its stack slot so that the frame
+// and every closure see the same value; when the frame returns, Close moves
+// the value into the upvalue itself.
+type Upvalue struct {
+	Location *Object
+	Closed   Object
+}
+
+func (u *Upvalue) Get() Object {
+	return *u.Location
+}
+
+func (u *Upvalue) Set(value Object) {
+	*u.Location = value
+}
+
+func (u *Upvalue) Close() {
+	u.Closed = *u.Location
+	u.Location = &u.Closed
+}
+
+// Closure is a compiled function together with the variables it captured.
+// It reports itself as a FUNCTION so that scripts cannot tell it apart from
+// an evaluator function.
+type Closure struct {
+	Fn   *CompiledFunction
+	Free []*Upvalue
+}
+
+func (c *Closure) Type() ObjectType {
+	return FUNCTION_OBJ
+}
+
+// Inspect prints the closure like the evaluator's Function. Its parameters
+// are the first of its locals.
+func (c *Closure) Inspect() string {
+	return inspectFunction(c.Fn.Name, c.Fn.LocalNames[:c.Fn.NumParameters], c.Fn.Body)
+}
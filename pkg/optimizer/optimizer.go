@@ -0,0 +1,416 @@
+// Package optimizer simplifies a parsed program before it is evaluated or
+// compiled.
+//
+// Infix and prefix expressions whose operands are literals are folded into
+// a single literal, using the evaluator's own operator semantics. If
+// expressions with a literal condition lose the branch that can never run,
+// and while loops whose condition is a literal false value are dropped.
+//
+// Every folded literal keeps the line and position of the expression it
+// replaces, so errors reported at it point where they did before. An
+// operation that would fail at run time is left for the run time to
+// report, except for integer division by a literal zero, which is reported
+// as an error by the optimizer unless it is in code that can never run.
+package optimizer
+
+import (
+	"fmt"
+
+	"github.com/hculpan/kabkey/pkg/ast"
+	"github.com/hculpan/kabkey/pkg/diagnostic"
+	"github.com/hculpan/kabkey/pkg/evaluator"
+	"github.com/hculpan/kabkey/pkg/object"
+	"github.com/hculpan/kabkey/pkg/token"
+)
+
+type Optimizer struct {
+	diagnostics []diagnostic.Diagnostic
+
+	// dead is set while optimizing code that can never run, whose errors
+	// would never happen and so are not reported.
+	dead bool
+}
+
+func New() *Optimizer {
+	return &Optimizer{diagnostics: []diagnostic.Diagnostic{}}
+}
+
+func (o *Optimizer) Errors() []string {
+	errors := []string{}
+	for _, d := range o.diagnostics {
+		errors = append(errors, fmt.Sprintf("[%3d:%3d] %s", d.Line, d.Column, d.Message))
+	}
+
+	return errors
+}
+
+func (o *Optimizer) Diagnostics() []diagnostic.Diagnostic {
+	return o.diagnostics
+}
+
+// Optimize rewrites program in place and returns it.
+func (o *Optimizer) Optimize(program *ast.Program) *ast.Program {
+	program.Statements = o.optimizeStatements(program.Statements)
+	return program
+}
+
+func (o *Optimizer) addError(tok token.Token, msg string, a ...interface{}) {
+	if o.dead {
+		return
+	}
+
+	o.diagnostics = append(o.diagnostics, diagnostic.Diagnostic{
+		Severity: diagnostic.Error,
+		File:     tok.Filename,
+		Line:     tok.LineNo,
+		Column:   tok.Position,
+		Span:     1,
+		Message:  fmt.Sprintf(msg, a...),
+	})
+}
+
+// optimizeStatements optimizes a list of statements evaluated one after the
+// other. An if expression statement with a literal condition is replaced by
+// the statements of the branch that runs, and a statement whose expression
+// does nothing is removed. The last statement supplies the value of the
+// list, so it is only simplified, never removed, and is only replaced by a
+// branch that also ends in an expression: one ending in a let has no value
+// of its own, where the if has null.
+func (o *Optimizer) optimizeStatements(statements []ast.Statement) []ast.Statement {
+	result := []ast.Statement{}
+	for i, s := range statements {
+		s = o.optimizeStatement(s)
+		last := i == len(statements)-1
+
+		es, ok := s.(*ast.ExpressionStatement)
+		if !ok {
+			result = append(result, s)
+			continue
+		}
+
+		switch e := es.Expression.(type) {
+		case *ast.IfExpression:
+			if branch, ok := takenBranch(e); ok {
+				if branch != nil && len(branch.Statements) > 0 {
+					if !last || endsInExpression(branch) {
+						result = append(result, branch.Statements...)
+						continue
+					}
+				} else if !last {
+					continue
+				}
+			}
+		case *ast.WhileExpression:
+			if isLiteral(e.Condition) && !evaluator.IsTruthy(literalValue(e.Condition)) && !last {
+				continue
+			}
+		}
+
+		result = append(result, s)
+	}
+
+	return result
+}
+
+func (o *Optimizer) optimizeStatement(s ast.Statement) ast.Statement {
+	switch s := s.(type) {
+	case *ast.LetStatement:
+		s.Value = o.optimizeExpression(s.Value)
+	case *ast.ReturnStatement:
+		if s.ReturnValue != nil {
+			s.ReturnValue = o.optimizeExpression(s.ReturnValue)
+		}
+	case *ast.ExpressionStatement:
+		if s.Expression != nil {
+			s.Expression = o.optimizeExpression(s.Expression)
+		}
+	case *ast.BlockStatement:
+		o.optimizeBlock(s)
+	}
+
+	return s
+}
+
+func (o *Optimizer) optimizeBlock(block *ast.BlockStatement) {
+	if block != nil {
+		block.Statements = o.optimizeStatements(block.Statements)
+	}
+}
+
+// optimizeDeadBlock optimizes a block, which can never run if dead is set.
+func (o *Optimizer) optimizeDeadBlock(block *ast.BlockStatement, dead bool) {
+	outer := o.dead
+	o.dead = outer || dead
+	o.optimizeBlock(block)
+	o.dead = outer
+}
+
+// endsInExpression reports whether the last statement of block is an
+// expression, whose value is the block's.
+func endsInExpression(block *ast.BlockStatement) bool {
+	_, ok := block.Statements[len(block.Statements)-1].(*ast.ExpressionStatement)
+	return ok
+}
+
+func (o *Optimizer) optimizeExpression(e ast.Expression) ast.Expression {
+	switch e := e.(type) {
+	case *ast.PrefixExpression:
+		e.Right = o.optimizeExpression(e.Right)
+		return o.foldPrefix(e)
+	case *ast.InfixExpression:
+		e.Left = o.optimizeExpression(e.Left)
+
+		outer := o.dead
+		o.dead = outer || shortCircuits(e)
+		e.Right = o.optimizeExpression(e.Right)
+		o.dead = outer
+
+		return o.foldInfix(e)
+	case *ast.IfExpression:
+		e.Condition = o.optimizeExpression(e.Condition)
+
+		literal := isLiteral(e.Condition)
+		truthy := literal && evaluator.IsTruthy(literalValue(e.Condition))
+		o.optimizeDeadBlock(e.Consequence, literal && !truthy)
+		o.optimizeDeadBlock(e.Alternative, truthy)
+
+		return pruneIf(e)
+	case *ast.MatchExpression:
+		e.Subject = o.optimizeExpression(e.Subject)
+		for _, arm := range e.Arms {
+			for i, p := range arm.Patterns {
+				arm.Patterns[i] = o.optimizeExpression(p)
+			}
+			o.optimizeBlock(arm.Body)
+		}
+	case *ast.WhileExpression:
+		e.Condition = o.optimizeExpression(e.Condition)
+
+		never := isLiteral(e.Condition) && !evaluator.IsTruthy(literalValue(e.Condition))
+		o.optimizeDeadBlock(e.Block, never)
+		if never {
+			e.Block = &ast.BlockStatement{Token: e.Block.Token}
+		}
+	case *ast.ForExpression:
+		if e.Init != nil {
+			e.Init = o.optimizeStatement(e.Init)
+		}
+		if e.Condition != nil {
+			e.Condition = o.optimizeExpression(e.Condition)
+		}
+		if e.Post != nil {
+			e.Post = o.optimizeExpression(e.Post)
+		}
+		o.optimizeBlock(e.Block)
+	case *ast.ForInExpression:
+		e.Iterable = o.optimizeExpression(e.Iterable)
+		o.optimizeBlock(e.Block)
+	case *ast.AssignExpression:
+		e.Value = o.optimizeExpression(e.Value)
+	case *ast.CompoundAssignExpression:
+		e.Value = o.optimizeExpression(e.Value)
+	case *ast.FunctionLiteral:
+		o.optimizeBlock(e.Body)
+	case *ast.CallExpression:
+		e.Function = o.optimizeExpression(e.Function)
+		for i, a := range e.Arguments {
+			e.Arguments[i] = o.optimizeExpression(a)
+		}
+	case *ast.ArrayLiteral:
+		for i, el := range e.Elements {
+			e.Elements[i] = o.optimizeExpression(el)
+		}
+	case *ast.HashLiteral:
+		for i, pair := range e.Pairs {
+			e.Pairs[i].Key = o.optimizeExpression(pair.Key)
+			e.Pairs[i].Value = o.optimizeExpression(pair.Value)
+		}
+	case *ast.IndexExpression:
+		e.Left = o.optimizeExpression(e.Left)
+		e.Index = o.optimizeExpression(e.Index)
+	}
+
+	return e
+}
+
+func (o *Optimizer) foldPrefix(e *ast.PrefixExpression) ast.Expression {
+	if !isLiteral(e.Right) {
+		return e
+	}
+
+	right := literalValue(e.Right)
+	var result object.Object
+	switch e.Operator {
+	case "-":
+		result = evaluator.MinusOperation(e.Right.NodeToken(), right)
+	case "!":
+		result = evaluator.BangOperation(right)
+	}
+
+	return toLiteral(e, result)
+}
+
+func (o *Optimizer) foldInfix(e *ast.InfixExpression) ast.Expression {
+	if e.Operator == "&&" || e.Operator == "||" {
+		return foldLogical(e)
+	}
+
+	if isDivisionByZero(e) {
+		o.addError(e.Token, "division by zero")
+		return e
+	}
+
+	if !isLiteral(e.Left) || !isLiteral(e.Right) {
+		return e
+	}
+
+	left, right := literalValue(e.Left), literalValue(e.Right)
+	return toLiteral(e, evaluator.InfixOperation(e.Token, e.Operator, left, right))
+}
+
+// isDivisionByZero reports whether e divides an integer literal by a
+// literal zero, which has no result. Operands are folded first, so either
+// may have started out as a constant expression. Any other dividend may be
+// a float, which divides by zero to an infinity, so it is left to the
+// runtime.
+func isDivisionByZero(e *ast.InfixExpression) bool {
+	if e.Operator != "/" && e.Operator != "%" {
+		return false
+	}
+
+	divisor, ok := e.Right.(*ast.IntegerLiteral)
+	if !ok || divisor.Value != 0 {
+		return false
+	}
+
+	_, isInteger := e.Left.(*ast.IntegerLiteral)
+	return isInteger
+}
+
+// shortCircuits reports whether the left operand of a && or || expression
+// is a literal that decides the result, so that the right is never run.
+func shortCircuits(e *ast.InfixExpression) bool {
+	if (e.Operator != "&&" && e.Operator != "||") || !isLiteral(e.Left) {
+		return false
+	}
+
+	return evaluator.IsTruthy(literalValue(e.Left)) == (e.Operator == "||")
+}
+
+// foldLogical folds && and || once the left operand alone decides the
+// result, or both operands are literals. The right operand is never
+// evaluated in the first case, so dropping it changes nothing.
+func foldLogical(e *ast.InfixExpression) ast.Expression {
+	if !isLiteral(e.Left) {
+		return e
+	}
+
+	switch {
+	case shortCircuits(e) && e.Operator == "&&":
+		return toLiteral(e, evaluator.FALSE)
+	case shortCircuits(e):
+		return toLiteral(e, evaluator.TRUE)
+	case isLiteral(e.Right):
+		if evaluator.IsTruthy(literalValue(e.Right)) {
+			return toLiteral(e, evaluator.TRUE)
+		}
+		return toLiteral(e, evaluator.FALSE)
+	}
+
+	return e
+}
+
+// pruneIf drops the branch of an if expression that can never run. When
+// the branch that runs is a single expression, that expression replaces the
+// if altogether.
+func pruneIf(e *ast.IfExpression) ast.Expression {
+	branch, ok := takenBranch(e)
+	if !ok {
+		return e
+	}
+
+	if branch != nil && len(branch.Statements) == 1 {
+		if es, ok := branch.Statements[0].(*ast.ExpressionStatement); ok && es.Expression != nil {
+			return es.Expression
+		}
+	}
+
+	if evaluator.IsTruthy(literalValue(e.Condition)) {
+		e.Alternative = nil
+	} else if e.Alternative != nil {
+		e.Condition = toLiteral(e.Condition, evaluator.TRUE)
+		e.Consequence, e.Alternative = e.Alternative, nil
+	} else {
+		e.Consequence = &ast.BlockStatement{Token: e.Consequence.Token}
+	}
+
+	return e
+}
+
+// takenBranch returns the block an if expression with a literal condition
+// runs, which is nil for a false condition without an else. The second
+// result is false when the condition is not a literal.
+func takenBranch(e *ast.IfExpression) (*ast.BlockStatement, bool) {
+	if !isLiteral(e.Condition) {
+		return nil, false
+	}
+
+	if evaluator.IsTruthy(literalValue(e.Condition)) {
+		return e.Consequence, true
+	}
+
+	return e.Alternative, true
+}
+
+func isLiteral(e ast.Expression) bool {
+	switch e.(type) {
+	case *ast.IntegerLiteral, *ast.FloatLiteral, *ast.StringLiteral, *ast.Boolean:
+		return true
+	}
+
+	return false
+}
+
+func literalValue(e ast.Expression) object.Object {
+	switch e := e.(type) {
+	case *ast.IntegerLiteral:
+		return &object.Integer{Value: e.Value}
+	case *ast.FloatLiteral:
+		return &object.Float{Value: e.Value}
+	case *ast.StringLiteral:
+		return &object.String{Value: e.Value}
+	case *ast.Boolean:
+		if e.Value {
+			return evaluator.TRUE
+		}
+		return evaluator.FALSE
+	}
+
+	return nil
+}
+
+// toLiteral returns the literal for result, positioned at the token of the
+// expression it replaces. If result is not a literal value, such as an
+// error, the expression is returned unchanged.
+func toLiteral(e ast.Expression, result object.Object) ast.Expression {
+	tok := e.NodeToken()
+	switch result := result.(type) {
+	case *object.Integer:
+		tok.Type, tok.Literal = token.INT, result.Inspect()
+		return &ast.IntegerLiteral{Token: tok, Value: result.Value}
+	case *object.Float:
+		tok.Type, tok.Literal = token.FLOAT, result.Inspect()
+		return &ast.FloatLiteral{Token: tok, Value: result.Value}
+	case *object.String:
+		tok.Type, tok.Literal = token.STRING, result.Value
+		return &ast.StringLiteral{Token: tok, Value: result.Value}
+	case *object.Boolean:
+		tok.Type, tok.Literal = token.FALSE, "false"
+		if result.Value {
+			tok.Type, tok.Literal = token.TRUE, "true"
+		}
+		return &ast.Boolean{Token: tok, Value: result.Value}
+	}
+
+	return e
+}
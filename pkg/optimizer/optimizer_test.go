@@ -0,0 +1,238 @@
+package optimizer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hculpan/kabkey/pkg/ast"
+	"github.com/hculpan/kabkey/pkg/difftest"
+	"github.com/hculpan/kabkey/pkg/evaluator"
+	"github.com/hculpan/kabkey/pkg/lexer"
+	"github.com/hculpan/kabkey/pkg/object"
+	"github.com/hculpan/kabkey/pkg/parser"
+)
+
+func TestConstantFolding(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 + 2 * 3", "7"},
+		{"-5", "-5"},
+		{"-(2 - 7)", "5"},
+		{"10 / 4", "2"},
+		{"10 % 4", "2"},
+		{"1.5 * 2", "3.0"},
+		{"2 / 0.0", "+Inf"},
+		{`"foo" + "bar"`, `"foobar"`},
+		{"1 < 2", "true"},
+		{"!true", "false"},
+		{"!0", "true"},
+		{`"a" == "a"`, "true"},
+		{"true == false", "false"},
+		{"1 > 2 && x", "false"},
+		{"1 < 2 || x", "true"},
+		{"1 && 0", "false"},
+		{"true && x", "(true && x)"},
+		{"x + 1 * 2", "(x + 2)"},
+		{"1 + 2 + x", "(3 + x)"},
+		{`1 + "a"`, `(1 + "a")`},
+		{"-true", "(-true)"},
+		{"let a = 2 * 3;", "let a = 6;"},
+		{"f(1 + 1, [2 * 2], {3 - 3: 4})", "f(2, [4], {0: 4})"},
+		{"fn() { return 6 / 3; }", "fn() return 2;"},
+	}
+
+	for _, tt := range tests {
+		program, errors := optimize(t, tt.input)
+		if len(errors) > 0 {
+			t.Errorf("%q: unexpected errors: %v", tt.input, errors)
+			continue
+		}
+
+		if program.String() != tt.expected {
+			t.Errorf("%q: wrong program. want=%q, got=%q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
+func TestDeadBranchElimination(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"if (true) { a; b }; c", "abc"},
+		{"if (false) { a; b }; c", "c"},
+		{"if (false) { a } else { b; d }; c", "bdc"},
+		{"if (1 > 2) { a }; c", "c"},
+		{"if (x) { a }; c", "if x ac"},
+		{"if (true) { a; b } else { d }", "ab"},
+		{"c; if (false) { a }", "cif false "},
+		{"c; if (true) { }", "cif true "},
+		{"let v = if (true) { 1 } else { 2 };", "let v = 1;"},
+		{"let v = if (0) { 1 };", "let v = if 0 ;"},
+		{"let v = if (false) { 1 } else { a; b };", "let v = if true ab;"},
+		{"let v = if (true) { a; b } else { d };", "let v = if true ab;"},
+		{"while (false) { a }; c", "c"},
+		{"while (0) { a }; c", "c"},
+		{"c; while (false) { a }", "cwhile false "},
+		{"while (true) { if (false) { break }; a }", "while true a"},
+		{"while (true) { if (false) { break } }", "while true if false "},
+		{"fn() { if (true) { return 1 }; 2 }", "fn() return 1;2"},
+		{"if (true) { a; let b = 1; }", "if true alet b = 1;"},
+		{"if (true) { let b = 1; }; c", "let b = 1;c"},
+	}
+
+	for _, tt := range tests {
+		program, errors := optimize(t, tt.input)
+		if len(errors) > 0 {
+			t.Errorf("%q: unexpected errors: %v", tt.input, errors)
+			continue
+		}
+
+		if program.String() != tt.expected {
+			t.Errorf("%q: wrong program. want=%q, got=%q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
+func TestDivisionByLiteralZero(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"5 / 0", []string{"[  1:  3] division by zero"}},
+		{"let a = 1;\nlet b = (a + 1) % (2 - 2);", nil},
+		{"let b = (3 - 1) % (2 - 2);", []string{"[  1: 17] division by zero"}},
+		{"if (true) { 1 / 0 }", []string{"[  1: 15] division by zero"}},
+		{"if (false) { 1 / 0 }", nil},
+		{"if (true) { 1 } else { 1 / 0 }", nil},
+		{"if (false) { if (true) { 1 / 0 } } else { 2 }", nil},
+		{"while (false) { 1 / 0 }", nil},
+		{"false && 1 / 0", nil},
+		{"true || 1 / 0", nil},
+		{"true && 1 / 0", []string{"[  1: 11] division by zero"}},
+		{"x / 0", nil},
+		{"5.0 / 0", nil},
+		{"5 / 0.0", nil},
+		{"5 / x", nil},
+	}
+
+	for _, tt := range tests {
+		_, errors := optimize(t, tt.input)
+		if len(errors) != len(tt.expected) {
+			t.Errorf("%q: wrong errors. want=%v, got=%v", tt.input, tt.expected, errors)
+			continue
+		}
+
+		for i, msg := range tt.expected {
+			if errors[i] != msg {
+				t.Errorf("%q: wrong error. want=%q, got=%q", tt.input, msg, errors[i])
+			}
+		}
+	}
+}
+
+func TestFloatVariableDividedByZero(t *testing.T) {
+	program, errors := optimize(t, "let x = 1.5; x / 0")
+	if len(errors) > 0 {
+		t.Fatalf("unexpected errors: %v", errors)
+	}
+
+	result := difftest.RunEvaluator(program)
+	if result.Error != "" || result.Value != "+Inf" {
+		t.Errorf("wrong result. want=+Inf, got=%q (error %q)", result.Value, result.Error)
+	}
+}
+
+func TestTrailingLetKeepsValue(t *testing.T) {
+	program, _ := optimize(t, "if (true) { let x = 1 }")
+
+	env := object.NewEnvironment()
+	if value := evaluator.Eval(program, env); value != evaluator.NULL {
+		t.Errorf("wrong value. want=NULL, got=%v", value)
+	}
+}
+
+func TestFoldedLiteralsKeepPositions(t *testing.T) {
+	program, _ := optimize(t, "let a = 1;\nlet b = a + -(\"x\" + \"y\");")
+
+	let := program.Statements[1].(*ast.LetStatement)
+	infix := let.Value.(*ast.InfixExpression)
+	folded, ok := infix.Right.(*ast.PrefixExpression)
+	if !ok {
+		t.Fatalf("right operand not a prefix expression. got=%T", infix.Right)
+	}
+
+	str, ok := folded.Right.(*ast.StringLiteral)
+	if !ok {
+		t.Fatalf("operand not folded. got=%T", folded.Right)
+	}
+
+	if str.Value != "xy" {
+		t.Errorf("wrong value. want=%q, got=%q", "xy", str.Value)
+	}
+
+	// The folded literal stands where the + operator was.
+	if str.Token.LineNo != 2 || str.Token.Position != 19 {
+		t.Errorf("wrong position. want=[2:19], got=[%d:%d]", str.Token.LineNo, str.Token.Position)
+	}
+}
+
+// TestOptimizedProgramsBehaveTheSame runs the differential test corpus and
+// the evaluator's test programs with and without optimization, expecting
+// the same output, value and errors.
+func TestOptimizedProgramsBehaveTheSame(t *testing.T) {
+	files, err := filepath.Glob("../difftest/testdata/*/*.mky")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases, err := difftest.ExtractCases("../evaluator/evaluator_test.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Errorf("%s: %s", file, err)
+			continue
+		}
+		cases = append(cases, difftest.Case{Name: file, Input: string(content)})
+	}
+
+	for _, c := range cases {
+		plain, err := difftest.Parse(c.Input)
+		if err != nil {
+			t.Errorf("%s: does not parse:\n%s", c.Name, err)
+			continue
+		}
+
+		optimized, _ := difftest.Parse(c.Input)
+		opt := New()
+		opt.Optimize(optimized)
+		if len(opt.Errors()) > 0 {
+			continue
+		}
+
+		if diff := difftest.Diff(difftest.RunEvaluator(plain), difftest.RunEvaluator(optimized)); diff != "" {
+			t.Errorf("%s: optimized program behaves differently:\n%s", c.Name, diff)
+		}
+	}
+}
+
+func optimize(t *testing.T, input string) (*ast.Program, []string) {
+	l := lexer.NewLexer(input)
+	p := parser.NewParser(l)
+	program := p.ParseProgram()
+	if len(l.Errors()) > 0 || len(p.Errors()) > 0 {
+		t.Fatalf("%q: parse errors: %v %v", input, l.Errors(), p.Errors())
+	}
+
+	opt := New()
+	opt.Optimize(program)
+
+	return program, opt.Errors()
+}
@@ -3,8 +3,12 @@ package parser
 import (
 	"fmt"
 	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/hculpan/kabkey/pkg/ast"
+	"github.com/hculpan/kabkey/pkg/diagnostic"
 	"github.com/hculpan/kabkey/pkg/lexer"
 	"github.com/hculpan/kabkey/pkg/token"
 )
@@ -12,29 +16,44 @@ import (
 const (
 	_ int = iota
 	LOWEST
+	ASSIGN
+	LOGICALOR
+	LOGICALAND
 	EQUALS
-	LOGICALOPS
 	LESSERGREATER
 	SUM
 	PRODUCT
 	PREFIX
+	POSTFIX
 	CALL
+	INDEX
 )
 
 var precedences = map[token.TokenType]int{
+	token.ASSIGN:   ASSIGN,
 	token.EQ:       EQUALS,
 	token.NOT_EQ:   EQUALS,
 	token.LT:       LESSERGREATER,
 	token.GT:       LESSERGREATER,
 	token.GTE:      LESSERGREATER,
 	token.LTE:      LESSERGREATER,
-	token.AND:      LOGICALOPS,
-	token.OR:       LOGICALOPS,
+	token.AND:      LOGICALAND,
+	token.OR:       LOGICALOR,
 	token.PLUS:     SUM,
 	token.MINUS:    SUM,
 	token.SLASH:    PRODUCT,
 	token.ASTERISK: PRODUCT,
+	token.PERCENT:  PRODUCT,
 	token.LPAREN:   CALL,
+	token.LBRACKET: INDEX,
+
+	token.PLUS_ASSIGN:     ASSIGN,
+	token.MINUS_ASSIGN:    ASSIGN,
+	token.ASTERISK_ASSIGN: ASSIGN,
+	token.SLASH_ASSIGN:    ASSIGN,
+	token.PERCENT_ASSIGN:  ASSIGN,
+	token.INCREMENT:       POSTFIX,
+	token.DECREMENT:       POSTFIX,
 }
 
 type (
@@ -47,7 +66,30 @@ type Parser struct {
 	curToken  token.Token
 	peekToken token.Token
 
-	errors []string
+	diagnostics []diagnostic.Diagnostic
+
+	// panicking is set by the first error in a statement and cleared once
+	// the parser has skipped to the start of the next one. Errors found in
+	// between are only knock-on effects of the first and are not reported.
+	panicking bool
+
+	// braceDepth counts the braces open at the current token, which tells
+	// the statement boundaries of a block from those of a block nested in
+	// the statement being skipped.
+	braceDepth int
+
+	// brackets holds the brackets open at the current token, innermost
+	// last. A line break ends a statement only outside parentheses and
+	// square brackets.
+	brackets []token.TokenType
+
+	// peekOnNewLine is set when a NEWLINE token came between the current
+	// and the peek token.
+	peekOnNewLine bool
+
+	// loopDepth counts the loops enclosing the current position within the
+	// innermost function, so break and continue can be checked at parse time.
+	loopDepth int
 
 	prefixParseFns map[token.TokenType]prefixParseFn
 	infixParseFns  map[token.TokenType]infixParseFn
@@ -55,8 +97,8 @@ type Parser struct {
 
 func NewParser(l *lexer.Lexer) *Parser {
 	p := &Parser{
-		l:      l,
-		errors: []string{},
+		l:           l,
+		diagnostics: []diagnostic.Diagnostic{},
 	}
 
 	p.nextToken()
@@ -65,6 +107,7 @@ func NewParser(l *lexer.Lexer) *Parser {
 	p.prefixParseFns = make(map[token.TokenType]prefixParseFn)
 	p.registerPrefix(token.IDENT, p.parseIdentifier)
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
+	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
 	p.registerPrefix(token.BANG, p.parsePrefixExpression)
 	p.registerPrefix(token.MINUS, p.parsePrefixExpression)
 	p.registerPrefix(token.TRUE, p.parseBoolean)
@@ -74,12 +117,19 @@ func NewParser(l *lexer.Lexer) *Parser {
 	p.registerPrefix(token.FUNCTION, p.parseFunctionLiteral)
 	p.registerPrefix(token.STRING, p.parseStringLiteral)
 	p.registerPrefix(token.WHILE, p.parseWhileExpression)
+	p.registerPrefix(token.FOR, p.parseForExpression)
+	p.registerPrefix(token.MATCH, p.parseMatchExpression)
+	p.registerPrefix(token.LBRACKET, p.parseArrayLiteral)
+	p.registerPrefix(token.LBRACE, p.parseHashLiteral)
+	p.registerPrefix(token.INCREMENT, p.parsePrefixIncrement)
+	p.registerPrefix(token.DECREMENT, p.parsePrefixIncrement)
 
 	p.infixParseFns = make(map[token.TokenType]infixParseFn)
 	p.registerInfix(token.PLUS, p.parseInfixExpression)
 	p.registerInfix(token.MINUS, p.parseInfixExpression)
 	p.registerInfix(token.ASTERISK, p.parseInfixExpression)
 	p.registerInfix(token.SLASH, p.parseInfixExpression)
+	p.registerInfix(token.PERCENT, p.parseInfixExpression)
 	p.registerInfix(token.EQ, p.parseInfixExpression)
 	p.registerInfix(token.NOT_EQ, p.parseInfixExpression)
 	p.registerInfix(token.LT, p.parseInfixExpression)
@@ -89,37 +139,97 @@ func NewParser(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.GTE, p.parseInfixExpression)
 	p.registerInfix(token.LTE, p.parseInfixExpression)
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
+	p.registerInfix(token.LBRACKET, p.parseIndexExpression)
+	p.registerInfix(token.ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.PLUS_ASSIGN, p.parseCompoundAssignExpression)
+	p.registerInfix(token.MINUS_ASSIGN, p.parseCompoundAssignExpression)
+	p.registerInfix(token.ASTERISK_ASSIGN, p.parseCompoundAssignExpression)
+	p.registerInfix(token.SLASH_ASSIGN, p.parseCompoundAssignExpression)
+	p.registerInfix(token.PERCENT_ASSIGN, p.parseCompoundAssignExpression)
+	p.registerInfix(token.INCREMENT, p.parsePostfixIncrement)
+	p.registerInfix(token.DECREMENT, p.parsePostfixIncrement)
 
 	return p
 }
 
-func (p *Parser) parseCallArguments() []ast.Expression {
-	args := []ast.Expression{}
+func (p *Parser) parseExpressionList(end token.TokenType) []ast.Expression {
+	list := []ast.Expression{}
 
-	if p.peekTokenIs(token.RPAREN) {
+	if p.peekTokenIs(end) {
 		p.nextToken()
-		return args
+		return list
 	}
 
 	p.nextToken()
-	args = append(args, p.parseExpression(LOWEST))
+	list = append(list, p.parseExpression(LOWEST))
 
 	for p.peekTokenIs(token.COMMA) {
 		p.nextToken()
 		p.nextToken()
-		args = append(args, p.parseExpression(LOWEST))
+		list = append(list, p.parseExpression(LOWEST))
 	}
 
-	if !p.expectPeek(token.RPAREN) {
+	if !p.expectPeek(end) {
 		return nil
 	}
 
-	return args
+	return list
 }
 
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 	exp := &ast.CallExpression{Token: p.curToken, Function: function}
-	exp.Arguments = p.parseCallArguments()
+	exp.Arguments = p.parseExpressionList(token.RPAREN)
+	return exp
+}
+
+func (p *Parser) parseArrayLiteral() ast.Expression {
+	array := &ast.ArrayLiteral{Token: p.curToken}
+	array.Elements = p.parseExpressionList(token.RBRACKET)
+	return array
+}
+
+// parseHashLiteral is only reached when a '{' appears in expression
+// position; blocks following if, while and fn are consumed directly by
+// parseBlockStatement and never go through the prefix table.
+func (p *Parser) parseHashLiteral() ast.Expression {
+	hash := &ast.HashLiteral{Token: p.curToken}
+	hash.Pairs = []ast.HashPair{}
+
+	for !p.peekTokenIs(token.RBRACE) {
+		p.nextToken()
+		key := p.parseExpression(LOWEST)
+
+		if !p.expectPeek(token.COLON) {
+			return nil
+		}
+
+		p.nextToken()
+		value := p.parseExpression(LOWEST)
+
+		hash.Pairs = append(hash.Pairs, ast.HashPair{Key: key, Value: value})
+
+		if !p.peekTokenIs(token.RBRACE) && !p.expectPeek(token.COMMA) {
+			return nil
+		}
+	}
+
+	if !p.expectPeek(token.RBRACE) {
+		return nil
+	}
+
+	return hash
+}
+
+func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
+	exp := &ast.IndexExpression{Token: p.curToken, Left: left}
+
+	p.nextToken()
+	exp.Index = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.RBRACKET) {
+		return nil
+	}
+
 	return exp
 }
 
@@ -136,7 +246,10 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 		return nil
 	}
 
+	outerLoopDepth := p.loopDepth
+	p.loopDepth = 0
 	lit.Body = p.parseBlockStatement()
+	p.loopDepth = outerLoopDepth
 
 	return lit
 }
@@ -187,7 +300,83 @@ func (p *Parser) parseWhileExpression() ast.Expression {
 		return nil
 	}
 
+	p.loopDepth++
+	exp.Block = p.parseBlockStatement()
+	p.loopDepth--
+
+	return exp
+}
+
+func (p *Parser) parseForExpression() ast.Expression {
+	forToken := p.curToken
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	p.nextToken()
+
+	if p.curTokenIs(token.IDENT) && p.peekTokenIs(token.IN) {
+		return p.parseForInExpression(forToken)
+	}
+
+	exp := &ast.ForExpression{Token: forToken}
+
+	if !p.curTokenIs(token.SEMICOLON) {
+		exp.Init = p.parseStatement()
+		if !p.curTokenIs(token.SEMICOLON) {
+			p.peekError(token.SEMICOLON)
+			return nil
+		}
+	}
+
+	p.nextToken()
+	if !p.curTokenIs(token.SEMICOLON) {
+		exp.Condition = p.parseExpression(LOWEST)
+		if !p.expectPeek(token.SEMICOLON) {
+			return nil
+		}
+	}
+
+	p.nextToken()
+	if !p.curTokenIs(token.RPAREN) {
+		exp.Post = p.parseExpression(LOWEST)
+		if !p.expectPeek(token.RPAREN) {
+			return nil
+		}
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	p.loopDepth++
+	exp.Block = p.parseBlockStatement()
+	p.loopDepth--
+
+	return exp
+}
+
+func (p *Parser) parseForInExpression(forToken token.Token) ast.Expression {
+	exp := &ast.ForInExpression{Token: forToken}
+	exp.Variable = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+	p.nextToken()
+	p.nextToken()
+
+	exp.Iterable = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	p.loopDepth++
 	exp.Block = p.parseBlockStatement()
+	p.loopDepth--
 
 	return exp
 }
@@ -216,6 +405,23 @@ func (p *Parser) parseIfExpression() ast.Expression {
 	if p.peekTokenIs(token.ELSE) {
 		p.nextToken()
 
+		// else if is an else block holding just the nested if.
+		if p.peekTokenIs(token.IF) {
+			p.nextToken()
+			tok := p.curToken
+
+			nested := p.parseIfExpression()
+			if nested == nil {
+				return nil
+			}
+
+			expression.Alternative = &ast.BlockStatement{
+				Token:      tok,
+				Statements: []ast.Statement{&ast.ExpressionStatement{Token: tok, Expression: nested}},
+			}
+			return expression
+		}
+
 		if !p.expectPeek(token.LBRACE) {
 			return nil
 		}
@@ -226,14 +432,111 @@ func (p *Parser) parseIfExpression() ast.Expression {
 	return expression
 }
 
+// parseMatchExpression parses match (subject) { arms }. Arms are separated
+// by commas, which may be left out after a block or at the end of a line.
+func (p *Parser) parseMatchExpression() ast.Expression {
+	expression := &ast.MatchExpression{Token: p.curToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	p.nextToken()
+
+	expression.Subject = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	for !p.peekTokenIs(token.RBRACE) {
+		p.nextToken()
+
+		arm, ok := p.parseMatchArm()
+		if !ok {
+			return nil
+		}
+		expression.Arms = append(expression.Arms, arm)
+
+		if p.peekTokenIs(token.COMMA) {
+			p.nextToken()
+		} else if !p.peekTokenIs(token.RBRACE) && !p.curTokenIs(token.RBRACE) && !p.peekOnNewLine {
+			p.peekError(token.COMMA)
+			return nil
+		}
+	}
+
+	if !p.expectPeek(token.RBRACE) {
+		return nil
+	}
+
+	return expression
+}
+
+// parseMatchArm parses patterns => body. A body starting with a brace is a
+// block, so a hash literal body has to be put in parentheses.
+func (p *Parser) parseMatchArm() (ast.MatchArm, bool) {
+	arm := ast.MatchArm{Token: p.curToken}
+
+	patterns := []ast.Expression{p.parseExpression(LOWEST)}
+	for p.peekTokenIs(token.COMMA) {
+		p.nextToken()
+		p.nextToken()
+		patterns = append(patterns, p.parseExpression(LOWEST))
+	}
+
+	for _, pattern := range patterns {
+		if ident, ok := pattern.(*ast.Identifier); ok && ident.Value == "_" && len(patterns) > 1 {
+			p.addError(ident.Token, "_ must be the only pattern of a match arm")
+			return arm, false
+		}
+	}
+
+	if ident, ok := patterns[0].(*ast.Identifier); !ok || ident.Value != "_" {
+		arm.Patterns = patterns
+	}
+
+	if !p.expectPeek(token.ARROW) {
+		return arm, false
+	}
+
+	p.nextToken()
+
+	if p.curTokenIs(token.LBRACE) {
+		arm.Body = p.parseBlockStatement()
+	} else {
+		stmt := &ast.ExpressionStatement{Token: p.curToken, Expression: p.parseExpression(LOWEST)}
+		arm.Body = &ast.BlockStatement{Token: stmt.Token, Statements: []ast.Statement{stmt}}
+	}
+
+	return arm, true
+}
+
 func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 	block := &ast.BlockStatement{Token: p.curToken}
 	block.Statements = []ast.Statement{}
+	depth := p.braceDepth
+
+	if p.panicking {
+		// The error came before the block, so the statement it belongs
+		// to is skipped, block and all.
+		return block
+	}
 
 	p.nextToken()
 	for !p.curTokenIs(token.RBRACE) && !p.curTokenIs(token.EOF) {
 		stmt := p.parseStatement()
-		if stmt != nil {
+		if p.panicking {
+			p.synchronize(depth)
+			if p.braceDepth < depth {
+				// The statement ran past the end of the block.
+				break
+			}
+		} else if stmt != nil {
 			block.Statements = append(block.Statements, stmt)
 		}
 		p.nextToken()
@@ -276,6 +579,74 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	return expression
 }
 
+// parseAssignExpression parses "name = value". Assignment is right
+// associative, so the value is parsed one precedence level lower.
+func (p *Parser) parseAssignExpression(left ast.Expression) ast.Expression {
+	ident, ok := left.(*ast.Identifier)
+	if !ok {
+		p.addError(p.curToken, "invalid assignment target: %s", left.String())
+		return nil
+	}
+
+	expression := &ast.AssignExpression{Token: p.curToken, Name: ident}
+
+	p.nextToken()
+
+	expression.Value = p.parseExpression(ASSIGN - 1)
+
+	return expression
+}
+
+func (p *Parser) parseCompoundAssignExpression(left ast.Expression) ast.Expression {
+	ident, ok := left.(*ast.Identifier)
+	if !ok {
+		p.addError(p.curToken, "invalid assignment target: %s", left.String())
+		return nil
+	}
+
+	expression := &ast.CompoundAssignExpression{
+		Token:    p.curToken,
+		Name:     ident,
+		Operator: strings.TrimSuffix(p.curToken.Literal, "="),
+	}
+
+	p.nextToken()
+
+	expression.Value = p.parseExpression(ASSIGN - 1)
+
+	return expression
+}
+
+func (p *Parser) parsePrefixIncrement() ast.Expression {
+	expression := &ast.IncrementExpression{
+		Token:    p.curToken,
+		Operator: p.curToken.Literal,
+		Prefix:   true,
+	}
+
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+
+	expression.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+	return expression
+}
+
+func (p *Parser) parsePostfixIncrement(left ast.Expression) ast.Expression {
+	ident, ok := left.(*ast.Identifier)
+	if !ok {
+		p.addError(p.curToken, "invalid %s target: %s", p.curToken.Literal, left.String())
+		return nil
+	}
+
+	return &ast.IncrementExpression{
+		Token:    p.curToken,
+		Name:     ident,
+		Operator: p.curToken.Literal,
+	}
+}
+
 func (p *Parser) parsePrefixExpression() ast.Expression {
 	expression := &ast.PrefixExpression{
 		Token:    p.curToken,
@@ -314,13 +685,29 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	return lit
 }
 
+func (p *Parser) parseFloatLiteral() ast.Expression {
+	lit := &ast.FloatLiteral{Token: p.curToken}
+
+	value, err := strconv.ParseFloat(p.curToken.Literal, 64)
+	if err != nil {
+		p.addError(p.curToken, "could not parse %q as float", p.curToken.Literal)
+		return nil
+	}
+
+	lit.Value = value
+
+	return lit
+}
+
 func (p *Parser) ParseProgram() *ast.Program {
 	program := &ast.Program{}
 	program.Statements = []ast.Statement{}
 
 	for !p.curTokenIs(token.EOF) {
 		stmt := p.parseStatement()
-		if stmt != nil {
+		if p.panicking {
+			p.synchronize(0)
+		} else if stmt != nil {
 			program.Statements = append(program.Statements, stmt)
 		}
 		p.nextToken()
@@ -329,12 +716,52 @@ func (p *Parser) ParseProgram() *ast.Program {
 	return program
 }
 
+// synchronize recovers from an error by skipping the rest of the statement
+// it was found in, up to the start of the next statement of the block at
+// depth braces. A statement ends with a semicolon or a NEWLINE, and one
+// starts with let or return, but only outside the braces of the statement
+// being skipped. A closing brace ends the block itself, and the parser
+// stops at once if the statement already ran past it.
+func (p *Parser) synchronize(depth int) {
+	for !p.peekTokenIs(token.EOF) && p.braceDepth >= depth {
+		if p.braceDepth == depth {
+			if p.curTokenIs(token.SEMICOLON) || p.peekTokenIs(token.LET) || p.peekTokenIs(token.RETURN) {
+				break
+			}
+			if depth > 0 && p.peekTokenIs(token.RBRACE) {
+				break
+			}
+			if p.peekOnNewLine {
+				break
+			}
+		}
+
+		p.nextToken()
+	}
+
+	// Brackets left open by the statement skipped are never closed.
+	for len(p.brackets) > 0 && p.brackets[len(p.brackets)-1] != token.LBRACE {
+		p.brackets = p.brackets[:len(p.brackets)-1]
+	}
+
+	p.panicking = false
+}
+
 func (p *Parser) parseStatement() ast.Statement {
 	switch p.curToken.Type {
 	case token.LET:
 		return p.parseLetStatement()
+	case token.FUNCTION:
+		if p.peekTokenIs(token.IDENT) {
+			return p.parseFunctionDeclaration()
+		}
+		return p.parseExpressionStatement()
 	case token.RETURN:
 		return p.parseReturnStatement()
+	case token.BREAK:
+		return p.parseBreakStatement()
+	case token.CONTINUE:
+		return p.parseContinueStatement()
 	default:
 		return p.parseExpressionStatement()
 	}
@@ -361,7 +788,7 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 
 	leftExpr := prefix()
 
-	for !p.peekTokenIs(token.SEMICOLON) && precedence < p.peekPrecedence() {
+	for !p.peekTokenIs(token.SEMICOLON) && !p.atLineEnd() && precedence < p.peekPrecedence() {
 		infix := p.infixParseFns[p.peekToken.Type]
 		if infix == nil {
 			return leftExpr
@@ -378,6 +805,14 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 func (p *Parser) parseReturnStatement() ast.Statement {
 	stmt := &ast.ReturnStatement{Token: p.curToken}
 
+	// A return without a value returns null.
+	if p.peekTokenIs(token.SEMICOLON) || p.peekTokenIs(token.RBRACE) || p.peekTokenIs(token.EOF) || p.atLineEnd() {
+		if p.peekTokenIs(token.SEMICOLON) {
+			p.nextToken()
+		}
+		return stmt
+	}
+
 	p.nextToken()
 
 	stmt.ReturnValue = p.parseExpression(LOWEST)
@@ -388,6 +823,34 @@ func (p *Parser) parseReturnStatement() ast.Statement {
 	return stmt
 }
 
+func (p *Parser) parseBreakStatement() ast.Statement {
+	stmt := &ast.BreakStatement{Token: p.curToken}
+
+	if p.loopDepth == 0 {
+		p.addDiagnostic(p.curToken, "break may only be used inside a while or for loop", "'break' outside of loop")
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseContinueStatement() ast.Statement {
+	stmt := &ast.ContinueStatement{Token: p.curToken}
+
+	if p.loopDepth == 0 {
+		p.addDiagnostic(p.curToken, "continue may only be used inside a while or for loop", "'continue' outside of loop")
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
 func (p *Parser) parseLetStatement() ast.Statement {
 	stmt := &ast.LetStatement{Token: p.curToken}
 
@@ -408,6 +871,37 @@ func (p *Parser) parseLetStatement() ast.Statement {
 
 	stmt.Value = p.parseExpression(LOWEST)
 
+	if fn, ok := stmt.Value.(*ast.FunctionLiteral); ok {
+		fn.Name = stmt.Name.Value
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+// parseFunctionDeclaration parses fn name(params) { body }, which binds
+// name in the current scope as let name = fn(params) { body } would.
+func (p *Parser) parseFunctionDeclaration() ast.Statement {
+	stmt := &ast.LetStatement{Token: p.curToken}
+
+	p.nextToken()
+
+	stmt.Name = &ast.Identifier{
+		Token: p.curToken,
+		Value: p.curToken.Literal,
+	}
+
+	fn, ok := p.parseFunctionLiteral().(*ast.FunctionLiteral)
+	if !ok {
+		return nil
+	}
+	fn.Token = stmt.Token
+	fn.Name = stmt.Name.Value
+	stmt.Value = fn
+
 	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
 	}
@@ -434,12 +928,56 @@ func (p *Parser) expectPeek(t token.TokenType) bool {
 }
 
 func (p *Parser) peekError(t token.TokenType) {
-	p.addError(p.peekToken, "expected token of type %q, got %q", t, p.peekToken.Type)
+	hint := ""
+	if isPunctuation(t) {
+		hint = fmt.Sprintf("insert %q before this", t)
+	}
+
+	p.addDiagnostic(p.peekToken, hint, "expected token of type %q, got %q", t, p.peekToken.Type)
 }
 
 func (p *Parser) addError(token token.Token, msg string, a ...interface{}) {
-	err := fmt.Sprintf("[%3d:%3d] %s", token.LineNo, token.Position, fmt.Sprintf(msg, a...))
-	p.errors = append(p.errors, err)
+	p.addDiagnostic(token, "", msg, a...)
+}
+
+func (p *Parser) addDiagnostic(token token.Token, hint string, msg string, a ...interface{}) {
+	if p.panicking {
+		return
+	}
+	p.panicking = true
+
+	p.diagnostics = append(p.diagnostics, diagnostic.Diagnostic{
+		Severity: diagnostic.Error,
+		File:     token.Filename,
+		Line:     token.LineNo,
+		Column:   token.Position,
+		Span:     tokenSpan(token),
+		Message:  fmt.Sprintf(msg, a...),
+		Hint:     hint,
+	})
+}
+
+// tokenSpan is how many characters of source token takes up, as nearly as
+// can be told from its literal.
+func tokenSpan(tok token.Token) int {
+	span := utf8.RuneCountInString(tok.Literal)
+	if tok.Type == token.STRING {
+		span += 2
+	}
+
+	return span
+}
+
+// isPunctuation reports whether the token type is spelled the way it is
+// written, as "(" or ";" are.
+func isPunctuation(t token.TokenType) bool {
+	for _, r := range string(t) {
+		if unicode.IsLetter(r) {
+			return false
+		}
+	}
+
+	return true
 }
 
 func (p *Parser) registerPrefix(tokenType token.TokenType, fn prefixParseFn) {
@@ -450,16 +988,73 @@ func (p *Parser) registerInfix(tokenType token.TokenType, fn infixParseFn) {
 	p.infixParseFns[tokenType] = fn
 }
 func (p *Parser) Errors() []string {
-	return p.errors
+	errors := []string{}
+	for _, d := range p.diagnostics {
+		errors = append(errors, fmt.Sprintf("[%3d:%3d] %s", d.Line, d.Column, d.Message))
+	}
+
+	return errors
+}
+
+func (p *Parser) Diagnostics() []diagnostic.Diagnostic {
+	return p.diagnostics
 }
 
 func (p *Parser) nextToken() {
 	p.curToken = p.peekToken
 	p.peekToken = p.l.NextToken()
+
+	p.peekOnNewLine = false
+	for p.peekTokenIs(token.NEWLINE) {
+		p.peekOnNewLine = true
+		p.peekToken = p.l.NextToken()
+	}
+
+	switch p.curToken.Type {
+	case token.LBRACE:
+		p.braceDepth++
+		p.brackets = append(p.brackets, token.LBRACE)
+	case token.LPAREN, token.LBRACKET:
+		p.brackets = append(p.brackets, p.curToken.Type)
+	case token.RBRACE:
+		if p.braceDepth > 0 {
+			p.braceDepth--
+		}
+		p.closeBracket(token.LBRACE)
+	case token.RPAREN:
+		p.closeBracket(token.LPAREN)
+	case token.RBRACKET:
+		p.closeBracket(token.LBRACKET)
+	}
+}
+
+// closeBracket closes the innermost open bracket of type open, and with it
+// any opened after it and left unclosed by a syntax error. A closing
+// bracket without a matching open one is ignored.
+func (p *Parser) closeBracket(open token.TokenType) {
+	for i := len(p.brackets) - 1; i >= 0; i-- {
+		if p.brackets[i] == open {
+			p.brackets = p.brackets[:i]
+			return
+		}
+	}
+}
+
+// atLineEnd reports whether a line break between the current and the peek
+// token ends the statement, which it does unless the current token is
+// inside parentheses or square brackets. The lexer leaves out line breaks
+// after tokens that cannot end a statement, so a statement still continues
+// on the next line after an operator, a comma or an opening bracket.
+func (p *Parser) atLineEnd() bool {
+	if !p.peekOnNewLine {
+		return false
+	}
+
+	return len(p.brackets) == 0 || p.brackets[len(p.brackets)-1] == token.LBRACE
 }
 
 func (p *Parser) noPrefixParseFnError(t token.TokenType) {
-	p.addError(p.curToken, "no prefix parse function for %q found", t)
+	p.addDiagnostic(p.curToken, "an expression was expected here", "no prefix parse function for %q found", t)
 }
 
 func (p *Parser) peekPrecedence() int {
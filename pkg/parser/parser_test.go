@@ -5,7 +5,9 @@ import (
 	"testing"
 
 	"github.com/hculpan/kabkey/pkg/ast"
+	"github.com/hculpan/kabkey/pkg/diagnostic"
 	"github.com/hculpan/kabkey/pkg/lexer"
+	"github.com/hculpan/kabkey/pkg/token"
 )
 
 func TestCallExpressionParsing(t *testing.T) {
@@ -112,6 +114,278 @@ func TestFunctionLiteralParsing(t *testing.T) {
 	testInfixExpression(t, 0, bodyStmt.Expression, "x", "+", "y")
 }
 
+func TestFunctionDeclaration(t *testing.T) {
+	tests := []struct {
+		input        string
+		expectedName string
+		expected     string
+	}{
+		{"fn add(x, y) { x + y; }", "add", "fn add(x, y) (x + y)"},
+		{"fn noop() { }\nnoop()", "noop", "fn noop() noop()"},
+		{"let add = fn(x, y) { x + y; };", "add", "let add = fn(x, y) (x + y);"},
+		{"let f = fn() { fn() { 1 } };", "f", "let f = fn() fn() 1;"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.NewLexer(tt.input)
+		p := NewParser(l)
+		program := p.ParseProgram()
+		checkParseErrors(t, p, []string{})
+
+		stmt, ok := program.Statements[0].(*ast.LetStatement)
+		if !ok {
+			t.Fatalf("%q: program.Statements[0] is not ast.LetStatement. got=%T", tt.input, program.Statements[0])
+		}
+
+		if stmt.Name.Value != tt.expectedName {
+			t.Errorf("%q: wrong name. want=%q, got=%q", tt.input, tt.expectedName, stmt.Name.Value)
+		}
+
+		function, ok := stmt.Value.(*ast.FunctionLiteral)
+		if !ok {
+			t.Fatalf("%q: stmt.Value is not ast.FunctionLiteral. got=%T", tt.input, stmt.Value)
+		}
+
+		if function.Name != tt.expectedName || function.Token.Type != token.FUNCTION {
+			t.Errorf("%q: wrong function literal. got name=%q, token=%q", tt.input, function.Name, function.Token.Type)
+		}
+
+		// A function literal nested in another is not named after it.
+		if len(function.Body.Statements) == 1 {
+			if es, ok := function.Body.Statements[0].(*ast.ExpressionStatement); ok {
+				if nested, ok := es.Expression.(*ast.FunctionLiteral); ok && nested.Name != "" {
+					t.Errorf("%q: nested function literal named %q", tt.input, nested.Name)
+				}
+			}
+		}
+
+		if program.String() != tt.expected {
+			t.Errorf("%q: wrong program. want=%q, got=%q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
+func TestArrayLiteralParsing(t *testing.T) {
+	input := "[1, 2 * 2, 3 + 3]"
+	l := lexer.NewLexer(input)
+	p := NewParser(l)
+	program := p.ParseProgram()
+	checkParseErrors(t, p, []string{})
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("stmt is not ast.ExpressionStatement. got=%T", program.Statements[0])
+	}
+
+	array, ok := stmt.Expression.(*ast.ArrayLiteral)
+	if !ok {
+		t.Fatalf("exp not ast.ArrayLiteral. got=%T", stmt.Expression)
+	}
+
+	if len(array.Elements) != 3 {
+		t.Fatalf("len(array.Elements) not 3. got=%d", len(array.Elements))
+	}
+
+	testIntegerLiteral(t, 0, array.Elements[0], 1)
+	testInfixExpression(t, 0, array.Elements[1], 2, "*", 2)
+	testInfixExpression(t, 0, array.Elements[2], 3, "+", 3)
+}
+
+func TestEmptyArrayLiteralParsing(t *testing.T) {
+	input := "[]"
+	l := lexer.NewLexer(input)
+	p := NewParser(l)
+	program := p.ParseProgram()
+	checkParseErrors(t, p, []string{})
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	array, ok := stmt.Expression.(*ast.ArrayLiteral)
+	if !ok {
+		t.Fatalf("exp not ast.ArrayLiteral. got=%T", stmt.Expression)
+	}
+
+	if len(array.Elements) != 0 {
+		t.Fatalf("len(array.Elements) not 0. got=%d", len(array.Elements))
+	}
+}
+
+func TestHashLiteralParsing(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`{"one": 1, "two": 2, "three": 3}`, `{"one": 1, "two": 2, "three": 3}`},
+		{`{}`, `{}`},
+		{`{"one": 0 + 1, 2: 10 - 8, true: 15 / 5}`, `{"one": (0 + 1), 2: (10 - 8), true: (15 / 5)}`},
+		{`let h = {"a": {"b": 1}}`, `let h = {"a": {"b": 1}};`},
+		{`if (x) { {"a": 1} }`, `if x {"a": 1}`},
+		{`fn() { {} }`, `fn() {}`},
+	}
+
+	for i, tt := range tests {
+		l := lexer.NewLexer(tt.input)
+		p := NewParser(l)
+		program := p.ParseProgram()
+		checkParseErrors(t, p, []string{})
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("[test %d] program has incorrect number of statements, expected 1, got %d", i, len(program.Statements))
+		}
+
+		if program.String() != tt.expected {
+			t.Errorf("[test %d] expected=%q, got=%q", i, tt.expected, program.String())
+		}
+	}
+}
+
+func TestHashLiteralPairs(t *testing.T) {
+	input := `{"one": 1, "two": 2}`
+	l := lexer.NewLexer(input)
+	p := NewParser(l)
+	program := p.ParseProgram()
+	checkParseErrors(t, p, []string{})
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	hash, ok := stmt.Expression.(*ast.HashLiteral)
+	if !ok {
+		t.Fatalf("exp is not ast.HashLiteral. got=%T", stmt.Expression)
+	}
+
+	if len(hash.Pairs) != 2 {
+		t.Fatalf("hash.Pairs has wrong length. got=%d", len(hash.Pairs))
+	}
+
+	testStringLiteral(t, 0, hash.Pairs[0].Key, "one")
+	testIntegerLiteral(t, 0, hash.Pairs[0].Value, 1)
+	testStringLiteral(t, 0, hash.Pairs[1].Key, "two")
+	testIntegerLiteral(t, 0, hash.Pairs[1].Value, 2)
+}
+
+func TestIndexExpressionParsing(t *testing.T) {
+	input := "myArray[1 + 1]"
+	l := lexer.NewLexer(input)
+	p := NewParser(l)
+	program := p.ParseProgram()
+	checkParseErrors(t, p, []string{})
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("stmt is not ast.ExpressionStatement. got=%T", program.Statements[0])
+	}
+
+	indexExp, ok := stmt.Expression.(*ast.IndexExpression)
+	if !ok {
+		t.Fatalf("exp not *ast.IndexExpression. got=%T", stmt.Expression)
+	}
+
+	if !testIdentifier(t, 0, indexExp.Left, "myArray") {
+		return
+	}
+
+	testInfixExpression(t, 0, indexExp.Index, 1, "+", 1)
+}
+
+func TestAssignExpressionParsing(t *testing.T) {
+	input := "x = 5 * 2;"
+	l := lexer.NewLexer(input)
+	p := NewParser(l)
+	program := p.ParseProgram()
+	checkParseErrors(t, p, []string{})
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("stmt is not ast.ExpressionStatement. got=%T", program.Statements[0])
+	}
+
+	exp, ok := stmt.Expression.(*ast.AssignExpression)
+	if !ok {
+		t.Fatalf("exp not *ast.AssignExpression. got=%T", stmt.Expression)
+	}
+
+	if !testIdentifier(t, 0, exp.Name, "x") {
+		return
+	}
+
+	testInfixExpression(t, 0, exp.Value, 5, "*", 2)
+}
+
+func TestInvalidAssignmentTarget(t *testing.T) {
+	input := "1 + 2 = 3"
+	l := lexer.NewLexer(input)
+	p := NewParser(l)
+	p.ParseProgram()
+	checkParseErrors(t, p, []string{"[  1:  7] invalid assignment target: (1 + 2)"})
+}
+
+func TestIncrementExpressionParsing(t *testing.T) {
+	tests := []struct {
+		input    string
+		operator string
+		prefix   bool
+	}{
+		{"i++", "++", false},
+		{"i--", "--", false},
+		{"++i", "++", true},
+		{"--i", "--", true},
+	}
+
+	for i, tt := range tests {
+		l := lexer.NewLexer(tt.input)
+		p := NewParser(l)
+		program := p.ParseProgram()
+		checkParseErrors(t, p, []string{})
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		exp, ok := stmt.Expression.(*ast.IncrementExpression)
+		if !ok {
+			t.Fatalf("[test %d] exp not *ast.IncrementExpression. got=%T", i, stmt.Expression)
+		}
+
+		if exp.Operator != tt.operator {
+			t.Errorf("[test %d] exp.Operator is not %q, got %q", i, tt.operator, exp.Operator)
+		}
+
+		if exp.Prefix != tt.prefix {
+			t.Errorf("[test %d] exp.Prefix is not %t, got %t", i, tt.prefix, exp.Prefix)
+		}
+
+		testIdentifier(t, i, exp.Name, "i")
+	}
+}
+
+// TestIncrementOnItsOwnLine pins down where a ++ or -- standing on a line
+// of its own belongs. A postfix operator must be on the same line as its
+// operand, so the line break before it ends the statement, and it becomes
+// the prefix operator of the identifier that follows.
+func TestIncrementOnItsOwnLine(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"a\n++\nb", []string{"a", "(++b)"}},
+		{"a\n--\nb", []string{"a", "(--b)"}},
+		{"a++\nb", []string{"(a++)", "b"}},
+		{"a\n++b", []string{"a", "(++b)"}},
+	}
+
+	for _, tt := range tests {
+		l := lexer.NewLexer(tt.input)
+		p := NewParser(l)
+		program := p.ParseProgram()
+		checkParseErrors(t, p, []string{})
+
+		if len(program.Statements) != len(tt.expected) {
+			t.Fatalf("%q: expected %d statements, got %d: %q", tt.input, len(tt.expected), len(program.Statements), program.String())
+		}
+
+		for i, expected := range tt.expected {
+			if program.Statements[i].String() != expected {
+				t.Errorf("%q: statement %d wrong. want=%q, got=%q", tt.input, i, expected, program.Statements[i].String())
+			}
+		}
+	}
+}
+
 func TestWhileExpression(t *testing.T) {
 	input := `while (a < 10) { a }`
 	l := lexer.NewLexer(input)
@@ -144,6 +418,96 @@ func TestWhileExpression(t *testing.T) {
 	}
 }
 
+func TestForExpressionParsing(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"for (let i = 0; i < 10; i += 1) { x }", "for (let i = 0; (i < 10); (i += 1)) x"},
+		{"for (i = 0; i < 10; i++) { x }", "for ((i = 0); (i < 10); (i++)) x"},
+		{"for (;;) { break }", "for (; ; ) break;"},
+		{"for (c in \"abc\") { c }", "for (c in \"abc\") c"},
+		{"for (x in [1, 2]) { continue }", "for (x in [1, 2]) continue;"},
+	}
+
+	for i, tt := range tests {
+		l := lexer.NewLexer(tt.input)
+		p := NewParser(l)
+		program := p.ParseProgram()
+		checkParseErrors(t, p, []string{})
+
+		if program.String() != tt.expected {
+			t.Errorf("[test %d] expected=%q, got=%q", i, tt.expected, program.String())
+		}
+	}
+}
+
+func TestForInExpressionParsing(t *testing.T) {
+	input := "for (item in items) { item }"
+	l := lexer.NewLexer(input)
+	p := NewParser(l)
+	program := p.ParseProgram()
+	checkParseErrors(t, p, []string{})
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	exp, ok := stmt.Expression.(*ast.ForInExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.ForInExpression. got=%T", stmt.Expression)
+	}
+
+	testIdentifier(t, 0, exp.Variable, "item")
+	testIdentifier(t, 0, exp.Iterable, "items")
+
+	if len(exp.Block.Statements) != 1 {
+		t.Errorf("block is not 1 statements. got=%d\n", len(exp.Block.Statements))
+	}
+}
+
+func TestBreakContinueParsing(t *testing.T) {
+	input := `while (true) { if (a) { break; } continue }`
+	l := lexer.NewLexer(input)
+	p := NewParser(l)
+	program := p.ParseProgram()
+	checkParseErrors(t, p, []string{})
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	exp, ok := stmt.Expression.(*ast.WhileExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.WhileExpression. got=%T", stmt.Expression)
+	}
+
+	if len(exp.Block.Statements) != 2 {
+		t.Fatalf("block is not 2 statements. got=%d\n", len(exp.Block.Statements))
+	}
+
+	ifExp := exp.Block.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.IfExpression)
+	if _, ok := ifExp.Consequence.Statements[0].(*ast.BreakStatement); !ok {
+		t.Errorf("statement is not ast.BreakStatement. got=%T", ifExp.Consequence.Statements[0])
+	}
+
+	if _, ok := exp.Block.Statements[1].(*ast.ContinueStatement); !ok {
+		t.Errorf("statement is not ast.ContinueStatement. got=%T", exp.Block.Statements[1])
+	}
+}
+
+func TestBreakContinueOutsideLoop(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"break;", "[  1:  1] 'break' outside of loop"},
+		{"if (true) { continue }", "[  1: 13] 'continue' outside of loop"},
+		{"while (true) { fn() { break } }", "[  1: 23] 'break' outside of loop"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.NewLexer(tt.input)
+		p := NewParser(l)
+		p.ParseProgram()
+		checkParseErrors(t, p, []string{tt.expectedError})
+	}
+}
+
 func TestIfExpression(t *testing.T) {
 	input := `if (x < y) { x }`
 	l := lexer.NewLexer(input)
@@ -228,6 +592,96 @@ func TestIfElseExpression(t *testing.T) {
 	}
 }
 
+func TestElseIfExpression(t *testing.T) {
+	input := `if (x < y) { x } else if (x > y) { y } else { z }`
+	l := lexer.NewLexer(input)
+	p := NewParser(l)
+	program := p.ParseProgram()
+	checkParseErrors(t, p, []string{})
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain %d statements. got=%d\n", 1, len(program.Statements))
+	}
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	exp, ok := stmt.Expression.(*ast.IfExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.IfExpression. got=%T", stmt.Expression)
+	}
+	if exp.Alternative == nil || len(exp.Alternative.Statements) != 1 {
+		t.Fatalf("alternative is not 1 statement. got=%+v", exp.Alternative)
+	}
+	alternative, ok := exp.Alternative.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("Alternative.Statements[0] is not ast.ExpressionStatement. got=%T", exp.Alternative.Statements[0])
+	}
+	nested, ok := alternative.Expression.(*ast.IfExpression)
+	if !ok {
+		t.Fatalf("alternative is not ast.IfExpression. got=%T", alternative.Expression)
+	}
+	if !testInfixExpression(t, 0, nested.Condition, "x", ">", "y") {
+		return
+	}
+	if nested.Alternative == nil || nested.Alternative.String() != "z" {
+		t.Errorf("wrong nested alternative. got=%+v", nested.Alternative)
+	}
+}
+
+func TestMatchExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		arms     int
+	}{
+		{`match (x) { 1 => "one" }`, `match x {1 => "one"}`, 1},
+		{`match (x) { 1, 2 => "low", "x" => y, _ => z }`, `match x {1, 2 => "low", "x" => y, _ => z}`, 3},
+		{`match (x) { 1, 2 => "low", }`, `match x {1, 2 => "low"}`, 1},
+		{"match (x) {\n\t1 => a\n\t-1 => b\n}", `match x {1 => a, (-1) => b}`, 2},
+		{"match (x) { 1 => { let y = 2; y } _ => 0 }", `match x {1 => let y = 2;y, _ => 0}`, 2},
+		{"match (x + 1) { a * 2 => ({}) }", `match (x + 1) {(a * 2) => {}}`, 1},
+		{"match (x) { }", `match x {}`, 0},
+	}
+
+	for _, tt := range tests {
+		l := lexer.NewLexer(tt.input)
+		p := NewParser(l)
+		program := p.ParseProgram()
+		checkParseErrors(t, p, []string{})
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("%q: program.Statements does not contain 1 statement. got=%d", tt.input, len(program.Statements))
+		}
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		exp, ok := stmt.Expression.(*ast.MatchExpression)
+		if !ok {
+			t.Fatalf("%q: stmt.Expression is not ast.MatchExpression. got=%T", tt.input, stmt.Expression)
+		}
+		if len(exp.Arms) != tt.arms {
+			t.Errorf("%q: expected %d arms, got %d", tt.input, tt.arms, len(exp.Arms))
+		}
+		if exp.String() != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.input, tt.expected, exp.String())
+		}
+	}
+}
+
+func TestMatchExpressionErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`match x { 1 => 2 }`, `[  1:  7] expected token of type "(", got "IDENT"`},
+		{`match (x) { 1 2 }`, `[  1: 15] expected token of type "=>", got "INT"`},
+		{`match (x) { 1 => 2 3 => 4 }`, `[  1: 20] expected token of type ",", got "INT"`},
+		{`match (x) { 1, _ => 2 }`, `[  1: 16] _ must be the only pattern of a match arm`},
+	}
+
+	for _, tt := range tests {
+		l := lexer.NewLexer(tt.input)
+		p := NewParser(l)
+		p.ParseProgram()
+		checkParseErrors(t, p, []string{tt.expected})
+	}
+}
+
 func TestBooleanExpression(t *testing.T) {
 	tests := []struct {
 		input           string
@@ -292,9 +746,23 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 		{"-(5 + 5)", "(-(5 + 5))"},
 		{"!(true == true)", "(!(true == true))"},
 		{`"a" == "a"`, `("a" == "a")`},
-		{"a && b == c || d", "((a && b) == (c || d))"},
-		{"a + 2 && b == c || d", "(((a + 2) && b) == (c || d))"},
+		{"a && b == c || d", "((a && (b == c)) || d)"},
+		{"a + 2 && b == c || d", "(((a + 2) && (b == c)) || d)"},
+		{"a || b && c", "(a || (b && c))"},
+		{"a != 0 && 10 / a > 1", "((a != 0) && ((10 / a) > 1))"},
+		{"a = b || c", "(a = (b || c))"},
 		{"(1 < 5) || (1 == 5)", "((1 < 5) || (1 == 5))"},
+		{"a * [1, 2, 3, 4][b * c] * d", "((a * ([1, 2, 3, 4][(b * c)])) * d)"},
+		{"add(a * b[2], b[1], 2 * [1, 2][1])", "add((a * (b[2])), (b[1]), (2 * ([1, 2][1])))"},
+		{"1.5 * 2 + -0.5", "((1.5 * 2) + (-0.5))"},
+		{"a = b = 1 + 2", "(a = (b = (1 + 2)))"},
+		{"a = b == c", "(a = (b == c))"},
+		{"a += b * 2", "(a += (b * 2))"},
+		{"a -= b -= 1", "(a -= (b -= 1))"},
+		{"a *= 2; b /= 2; c %= 2", "(a *= 2)(b /= 2)(c %= 2)"},
+		{"a % b * c", "((a % b) * c)"},
+		{"a++ + ++b", "((a++) + (++b))"},
+		{"-a--", "(-(a--))"},
 	}
 	for i, tt := range tests {
 		l := lexer.NewLexer(tt.input)
@@ -438,6 +906,38 @@ func TestIntegerLiteralExpression(t *testing.T) {
 
 }
 
+func TestFloatLiteralExpression(t *testing.T) {
+	input := "2.5e-1;"
+
+	l := lexer.NewLexer(input)
+	p := NewParser(l)
+	program := p.ParseProgram()
+
+	checkParseErrors(t, p, []string{})
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program has incorrect number of statements, expected 1, got %d", len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statement[0] is not *ast.ExpressionStatement, got %T", program.Statements[0])
+	}
+
+	literal, ok := stmt.Expression.(*ast.FloatLiteral)
+	if !ok {
+		t.Fatalf("exp not *ast.FloatLiteral, got %T", stmt.Expression)
+	}
+
+	if literal.Value != 0.25 {
+		t.Errorf("literal.Value not %g, got %g", 0.25, literal.Value)
+	}
+
+	if literal.TokenLiteral() != "2.5e-1" {
+		t.Errorf("literal.TokenLiteral not %q, got %q", "2.5e-1", literal.TokenLiteral())
+	}
+}
+
 func TestStringLiteralExpression(t *testing.T) {
 	input := `"foobar";`
 
@@ -590,6 +1090,179 @@ func testLetStatement(t *testing.T, s ast.Statement, name string) bool {
 	return true
 }
 
+func TestDiagnostics(t *testing.T) {
+	l := lexer.NewLexer("let x = (5 + foo;\nbreak;")
+	l.SetFilename("main.mky")
+	p := NewParser(l)
+	p.ParseProgram()
+
+	expected := []diagnostic.Diagnostic{
+		{File: "main.mky", Line: 1, Column: 17, Span: 1, Message: `expected token of type ")", got ";"`, Hint: `insert ")" before this`},
+		{File: "main.mky", Line: 2, Column: 1, Span: 5, Message: "'break' outside of loop", Hint: "break may only be used inside a while or for loop"},
+	}
+
+	diagnostics := p.Diagnostics()
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("expected %d diagnostics, got %+v", len(expected), diagnostics)
+	}
+
+	for i, d := range expected {
+		if diagnostics[i] != d {
+			t.Errorf("wrong diagnostic %d. expected %+v, got %+v", i, d, diagnostics[i])
+		}
+	}
+}
+
+func TestNewlineTermination(t *testing.T) {
+	tests := []struct {
+		input      string
+		expected   string
+		statements int
+	}{
+		{"let a = 1\n-1", "let a = 1;(-1)", 2},
+		{"let a = 1 -\n1", "let a = (1 - 1);", 1},
+		{"let a = 1 +\n\n2", "let a = (1 + 2);", 1},
+		{"let a = (1\n+ 2)", "let a = (1 + 2);", 1},
+		{"a; b\nc", "abc", 3},
+		{"a\n[0]", "a[0]", 2},
+		{"a\n(0)", "a0", 2},
+		{"[1\n, 2]", "[1, 2]", 1},
+		{"add(1,\n2)", "add(1, 2)", 1},
+		{"add(\n1\n,\n2\n)", "add(1, 2)", 1},
+		{"{\"a\":\n1}", "{\"a\": 1}", 1},
+		{"let f = fn(x) { x }\n(5)", "let f = fn(x) x;5", 2},
+		{"return\nx", "return ;x", 2},
+		{"return;", "return ;", 1},
+		{"fn() { return }", "fn() return ;", 1},
+		{"fn() {\n\treturn\n\tx\n}", "fn() return ;x", 1},
+		{"if (x) { y }\nelse { z }", "if x yelse z", 1},
+		{"let f = fn(x)\n{\n\tx\n}", "let f = fn(x) x;", 1},
+		{"f(fn(x) {\n\tx\n\t-1\n})", "f(fn(x) x(-1))", 1},
+		{"x\n++y", "x(++y)", 2},
+	}
+
+	for _, tt := range tests {
+		l := lexer.NewLexer(tt.input)
+		p := NewParser(l)
+		program := p.ParseProgram()
+		checkParseErrors(t, p, []string{})
+
+		if len(program.Statements) != tt.statements {
+			t.Errorf("%q: expected %d statements, got %d: %q", tt.input, tt.statements, len(program.Statements), program.String())
+			continue
+		}
+
+		if program.String() != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
+func TestErrorRecovery(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedErrors []string
+		statements     int
+	}{
+		{
+			"if (x { y }\nlet ok = 1;",
+			[]string{`[  1:  7] expected token of type ")", got "{"`},
+			1,
+		},
+		{
+			"if (x) { y } else z\nlet ok = 1;",
+			[]string{`[  1: 19] expected token of type "{", got "IDENT"`},
+			1,
+		},
+		{
+			"while x { y; z }\nlet ok = 1;",
+			[]string{`[  1:  7] expected token of type "(", got "IDENT"`},
+			1,
+		},
+		{
+			"while (x) {\n\ty +;\n\tz\n}\nlet ok = 1;",
+			[]string{`[  2:  5] no prefix parse function for ";" found`},
+			2,
+		},
+		{
+			"let f = fn(a, b {\n\ta + b\n};\nlet ok = 1;",
+			[]string{`[  1: 17] expected token of type ")", got "{"`},
+			1,
+		},
+		{
+			"let f = fn(a) {\n\tlet b = ;\n\ta\n};\nlet ok = 1;",
+			[]string{`[  2: 10] no prefix parse function for ";" found`},
+			2,
+		},
+		{
+			"fn add x) { x }\nlet ok = 1;",
+			[]string{`[  1:  8] expected token of type "(", got "IDENT"`},
+			1,
+		},
+		{
+			"add(1, , 2);\nlet ok = 1;",
+			[]string{`[  1:  8] no prefix parse function for "," found`},
+			1,
+		},
+		{
+			"add(1, 2;\nlet ok = 1;",
+			[]string{`[  1:  9] expected token of type ")", got ";"`},
+			1,
+		},
+		{
+			"a * * b\nc\nlet ok = 1;",
+			[]string{`[  1:  5] no prefix parse function for "*" found`},
+			2,
+		},
+		{
+			"let a = 1 +; let b = * 2; let ok = 1;",
+			[]string{
+				`[  1: 12] no prefix parse function for ";" found`,
+				`[  1: 22] no prefix parse function for "*" found`,
+			},
+			1,
+		},
+		{
+			"let f = fn() { if (x) { y + } };\nlet ok = 1;",
+			[]string{`[  1: 29] no prefix parse function for "}" found`},
+			2,
+		},
+		{
+			"let h = {\"a\" 1};\nlet ok = 1;",
+			[]string{`[  1: 14] expected token of type ":", got "INT"`},
+			1,
+		},
+	}
+
+	for _, tt := range tests {
+		l := lexer.NewLexer(tt.input)
+		p := NewParser(l)
+		program := p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) != len(tt.expectedErrors) {
+			t.Errorf("%q: expected errors %q, got %q", tt.input, tt.expectedErrors, errors)
+			continue
+		}
+
+		for i, msg := range tt.expectedErrors {
+			if errors[i] != msg {
+				t.Errorf("%q: expected error %q, got %q", tt.input, msg, errors[i])
+			}
+		}
+
+		if len(program.Statements) != tt.statements {
+			t.Errorf("%q: expected %d statements, got %d: %q", tt.input, tt.statements, len(program.Statements), program.String())
+			continue
+		}
+
+		last, ok := program.Statements[len(program.Statements)-1].(*ast.LetStatement)
+		if !ok || last.Name.Value != "ok" {
+			t.Errorf("%q: statement after the error not parsed: %q", tt.input, program.String())
+		}
+	}
+}
+
 func checkParseErrors(t *testing.T, p *Parser, testErrors []string) {
 	errors := p.Errors()
 	if len(errors) != len(testErrors) {
@@ -605,8 +1278,8 @@ func checkParseErrors(t *testing.T, p *Parser, testErrors []string) {
 	for i := range errors {
 		if testErrors[i] != errors[i] {
 			t.Errorf("expected error %q, got %q", testErrors[i], errors[i])
+			t.FailNow()
 		}
-		t.FailNow()
 	}
 }
 
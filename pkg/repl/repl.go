@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"io"
 
+	"github.com/hculpan/kabkey/pkg/diagnostic"
 	"github.com/hculpan/kabkey/pkg/evaluator"
 	"github.com/hculpan/kabkey/pkg/lexer"
 	"github.com/hculpan/kabkey/pkg/object"
 	"github.com/hculpan/kabkey/pkg/parser"
+	"github.com/hculpan/kabkey/pkg/resolver"
 )
 
 const PROMPT = ">> "
@@ -17,7 +19,6 @@ func Start(in io.Reader, out io.Writer) {
 	scanner := bufio.NewScanner(in)
 	env := object.NewEnvironment()
 	evaluator.LoadBuiltins(env)
-	object.SetExtendedErrorOutput(false)
 
 	for {
 		fmt.Fprintf(out, PROMPT)
@@ -33,24 +34,36 @@ func Start(in io.Reader, out io.Writer) {
 		p := parser.NewParser(l)
 		program := p.ParseProgram()
 		if len(l.Errors()) != 0 {
-			printErrors(out, l.Errors())
+			printErrors(out, line, l.Errors(), l.Diagnostics())
 			continue
 		} else if len(p.Errors()) != 0 {
-			printErrors(out, p.Errors())
+			printErrors(out, line, p.Errors(), p.Diagnostics())
 			continue
 		}
 
+		resolver.Resolve(program)
 		o := evaluator.Eval(program, env)
 
-		if o != nil {
+		if errObj, ok := o.(*object.Error); ok && object.ExtendedErrorOutput() {
+			io.WriteString(out, errObj.Render(line))
+		} else if o != nil {
 			io.WriteString(out, o.Inspect())
 			io.WriteString(out, "\n")
 		}
 	}
 }
 
-func printErrors(out io.Writer, errors []string) {
-	for _, msg := range errors {
-		io.WriteString(out, "\t"+msg+"\n")
+// printErrors shows the errors in a line of input, with the line itself
+// unless brief error output was asked for.
+func printErrors(out io.Writer, line string, errors []string, diagnostics []diagnostic.Diagnostic) {
+	if !object.ExtendedErrorOutput() {
+		for _, msg := range errors {
+			io.WriteString(out, "\t"+msg+"\n")
+		}
+		return
+	}
+
+	for _, d := range diagnostics {
+		io.WriteString(out, d.Render(line))
 	}
 }
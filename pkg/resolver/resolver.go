@@ -0,0 +1,195 @@
+// Package resolver works out ahead of time where the evaluator will find
+// each variable, so that lookups can index an environment's slots instead
+// of searching environments by name.
+//
+// A function call and a for loop each create an environment; the blocks
+// of if, match and while expressions share the environment around them. Every
+// variable declared in such a scope, by a parameter, a let statement or a
+// loop variable, gets a slot. An identifier resolves to the innermost
+// scope declaring its name. The global environment is not slot-based, so
+// names declared in no enclosing scope resolve to it and are looked up by
+// name there.
+//
+// Resolution is only a hint. A let may not have run yet when an identifier
+// is evaluated, leaving the slot empty; the evaluator then falls back to a
+// search by name, which keeps its behaviour unchanged.
+package resolver
+
+import "github.com/hculpan/kabkey/pkg/ast"
+
+type scope struct {
+	layout *ast.Scope
+	outer  *scope
+}
+
+// Resolve annotates the identifiers, functions and for loops of program.
+func Resolve(program *ast.Program) {
+	for _, s := range program.Statements {
+		resolve(s, nil)
+	}
+}
+
+// resolve annotates node, which is evaluated in scope s. A nil scope is
+// the global one.
+func resolve(node ast.Node, s *scope) {
+	switch node := node.(type) {
+	case *ast.Identifier:
+		resolveIdentifier(node, s)
+	case *ast.LetStatement:
+		resolve(node.Value, s)
+		resolveIdentifier(node.Name, s)
+	case *ast.FunctionLiteral:
+		fnScope := newScope(s)
+		for _, p := range node.Parameters {
+			declare(fnScope, p.Value)
+		}
+		declareLets(fnScope, node.Body)
+		node.Scope = fnScope.layout
+
+		for _, p := range node.Parameters {
+			resolveIdentifier(p, fnScope)
+		}
+		resolve(node.Body, fnScope)
+	case *ast.ForExpression:
+		loopScope := newScope(s)
+		declareLets(loopScope, node.Init)
+		declareLets(loopScope, node.Block)
+		node.Scope = loopScope.layout
+
+		resolve(node.Init, loopScope)
+		resolve(node.Condition, loopScope)
+		resolve(node.Post, loopScope)
+		resolve(node.Block, loopScope)
+	case *ast.ForInExpression:
+		resolve(node.Iterable, s)
+
+		loopScope := newScope(s)
+		declare(loopScope, node.Variable.Value)
+		declareLets(loopScope, node.Block)
+		node.Scope = loopScope.layout
+
+		resolveIdentifier(node.Variable, loopScope)
+		resolve(node.Block, loopScope)
+	default:
+		children(node, func(child ast.Node) {
+			resolve(child, s)
+		})
+	}
+}
+
+func newScope(outer *scope) *scope {
+	return &scope{layout: &ast.Scope{Slots: map[string]int{}}, outer: outer}
+}
+
+func declare(s *scope, name string) {
+	if _, ok := s.layout.Slots[name]; !ok {
+		s.layout.Slots[name] = len(s.layout.Slots)
+	}
+}
+
+// declareLets declares the let statements evaluated in the same
+// environment as node, which excludes those in nested functions and loops.
+func declareLets(s *scope, node ast.Node) {
+	switch node := node.(type) {
+	case *ast.LetStatement:
+		declare(s, node.Name.Value)
+		declareLets(s, node.Value)
+	case *ast.FunctionLiteral, *ast.ForExpression:
+	case *ast.ForInExpression:
+		declareLets(s, node.Iterable)
+	default:
+		children(node, func(child ast.Node) {
+			declareLets(s, child)
+		})
+	}
+}
+
+func resolveIdentifier(id *ast.Identifier, s *scope) {
+	depth := 0
+	for ; s != nil; s = s.outer {
+		if slot, ok := s.layout.Slots[id.Value]; ok {
+			id.Resolved, id.Depth, id.Slot = true, depth, slot
+			return
+		}
+		depth++
+	}
+
+	id.Resolved, id.Depth, id.Slot = true, depth, -1
+}
+
+// children calls f for each direct child of node.
+func children(node ast.Node, f func(ast.Node)) {
+	visit := func(nodes ...ast.Node) {
+		for _, n := range nodes {
+			if n != nil {
+				f(n)
+			}
+		}
+	}
+
+	switch node := node.(type) {
+	case *ast.Program:
+		for _, s := range node.Statements {
+			visit(s)
+		}
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			visit(s)
+		}
+	case *ast.ExpressionStatement:
+		visit(node.Expression)
+	case *ast.LetStatement:
+		visit(node.Name, node.Value)
+	case *ast.ReturnStatement:
+		visit(node.ReturnValue)
+	case *ast.AssignExpression:
+		visit(node.Name, node.Value)
+	case *ast.CompoundAssignExpression:
+		visit(node.Name, node.Value)
+	case *ast.IncrementExpression:
+		visit(node.Name)
+	case *ast.PrefixExpression:
+		visit(node.Right)
+	case *ast.InfixExpression:
+		visit(node.Left, node.Right)
+	case *ast.IfExpression:
+		visit(node.Condition, node.Consequence)
+		if node.Alternative != nil {
+			visit(node.Alternative)
+		}
+	case *ast.MatchExpression:
+		visit(node.Subject)
+		for _, arm := range node.Arms {
+			for _, p := range arm.Patterns {
+				visit(p)
+			}
+			visit(arm.Body)
+		}
+	case *ast.WhileExpression:
+		visit(node.Condition, node.Block)
+	case *ast.ForExpression:
+		visit(node.Init, node.Condition, node.Post, node.Block)
+	case *ast.ForInExpression:
+		visit(node.Variable, node.Iterable, node.Block)
+	case *ast.FunctionLiteral:
+		for _, p := range node.Parameters {
+			visit(p)
+		}
+		visit(node.Body)
+	case *ast.CallExpression:
+		visit(node.Function)
+		for _, a := range node.Arguments {
+			visit(a)
+		}
+	case *ast.ArrayLiteral:
+		for _, e := range node.Elements {
+			visit(e)
+		}
+	case *ast.HashLiteral:
+		for _, pair := range node.Pairs {
+			visit(pair.Key, pair.Value)
+		}
+	case *ast.IndexExpression:
+		visit(node.Left, node.Index)
+	}
+}
@@ -0,0 +1,135 @@
+package resolver
+
+import (
+	"testing"
+
+	"github.com/hculpan/kabkey/pkg/ast"
+	"github.com/hculpan/kabkey/pkg/evaluator"
+	"github.com/hculpan/kabkey/pkg/lexer"
+	"github.com/hculpan/kabkey/pkg/object"
+	"github.com/hculpan/kabkey/pkg/parser"
+)
+
+type location struct {
+	depth int
+	slot  int
+}
+
+func TestResolveLocations(t *testing.T) {
+	input := `
+	let g = 1;
+	let f = fn(a, b) {
+		let c = a;
+		if (b) { let d = c; }
+		for (let i = 0; i < d; i++) {
+			fn() { i + c + g }
+		}
+		for (x in [b]) { x + a }
+	};`
+
+	program := parse(t, input)
+	Resolve(program)
+
+	// Identifiers in source order, skipping the let names, which are
+	// declarations.
+	expected := []location{
+		{0, 0},  // a in let c
+		{0, 1},  // b in if
+		{0, 2},  // c in let d
+		{0, 0},  // i in condition
+		{1, 3},  // d in condition
+		{0, 0},  // i++
+		{1, 0},  // i in closure
+		{2, 2},  // c in closure
+		{3, -1}, // g in closure
+		{0, 1},  // b in iterable
+		{0, 0},  // x
+		{1, 0},  // a
+	}
+
+	identifiers := collectIdentifiers(program)
+	if len(identifiers) != len(expected) {
+		t.Fatalf("wrong number of identifiers. want=%d, got=%d", len(expected), len(identifiers))
+	}
+
+	for i, id := range identifiers {
+		if !id.Resolved {
+			t.Errorf("identifier %d (%s) not resolved", i, id.Value)
+			continue
+		}
+
+		actual := location{id.Depth, id.Slot}
+		if actual != expected[i] {
+			t.Errorf("identifier %d (%s) wrongly resolved. want=%+v, got=%+v", i, id.Value, expected[i], actual)
+		}
+	}
+}
+
+// TestResolvedProgramsBehaveTheSame checks programs whose variables are
+// not all set when they are read, where the evaluator must fall back from
+// slots to a search by name.
+func TestResolvedProgramsBehaveTheSame(t *testing.T) {
+	tests := []string{
+		"let a = 1; let f = fn() { let a = a + 1; a }; f()",
+		"let f = fn(x) { if (x) { let y = 1; }; y }; f(false)",
+		"let y = 5; let f = fn(x) { if (x) { let y = 1; }; y }; [f(true), f(false)]",
+		"let f = fn() { let g = fn() { h() }; let h = fn() { 2 }; g() }; f()",
+		"let n = 0; let f = fn() { n = n + 1; let n = 10; n += 1; n }; [f(), n]",
+		"let len = fn(x) { 0 }; len([1, 2])",
+		"let i = 0; for (let i = 0; i < 3; i++) { }; i",
+		"let f = fn(x) { match (x) { 1 => { let y = x + 1; }, _ => 0 }; y }; [f(1), f(2)]",
+		"let y = 7; let f = fn(x) { match (x) { y => { let y = 1; y } } }; [f(7), f(1)]",
+	}
+
+	for _, input := range tests {
+		byName := eval(parse(t, input))
+
+		program := parse(t, input)
+		Resolve(program)
+		resolved := eval(program)
+
+		if byName != resolved {
+			t.Errorf("%s: resolved program differs. by name=%s, resolved=%s", input, byName, resolved)
+		}
+	}
+}
+
+func parse(t *testing.T, input string) *ast.Program {
+	t.Helper()
+
+	p := parser.NewParser(lexer.NewLexer(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+
+	return program
+}
+
+func eval(program *ast.Program) string {
+	env := object.NewEnvironment()
+	evaluator.LoadBuiltins(env)
+	return evaluator.Eval(program, env).Inspect()
+}
+
+func collectIdentifiers(node ast.Node) []*ast.Identifier {
+	var result []*ast.Identifier
+
+	switch node := node.(type) {
+	case *ast.Identifier:
+		return []*ast.Identifier{node}
+	case *ast.LetStatement:
+		return collectIdentifiers(node.Value)
+	case *ast.FunctionLiteral:
+		return collectIdentifiers(node.Body)
+	case *ast.ForInExpression:
+		result = append(result, collectIdentifiers(node.Iterable)...)
+		return append(result, collectIdentifiers(node.Block)...)
+	}
+
+	children(node, func(child ast.Node) {
+		result = append(result, collectIdentifiers(child)...)
+	})
+
+	return result
+}
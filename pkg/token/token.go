@@ -16,25 +16,32 @@ const (
 
 	IDENT     = "IDENT"
 	INT       = "INT"
+	FLOAT     = "FLOAT"
 	ASSIGN    = "="
 	PLUS      = "+"
 	MINUS     = "-"
 	BANG      = "!"
 	ASTERISK  = "*"
 	SLASH     = "/"
+	PERCENT   = "%"
 	LT        = "<"
 	LTE       = "<="
 	GT        = ">"
 	GTE       = ">="
 	COMMA     = ","
 	SEMICOLON = ";"
+	COLON     = ":"
+	ARROW     = "=>"
 	LPAREN    = "("
 	RPAREN    = ")"
 	LBRACE    = "{"
 	RBRACE    = "}"
+	LBRACKET  = "["
+	RBRACKET  = "]"
 	EQ        = "=="
 	NOT_EQ    = "!="
 	NEWLINE   = "NEWLINE"
+	COMMENT   = "COMMENT"
 	FUNCTION  = "FUNCTION"
 	LET       = "LET"
 	RETURN    = "RETURN"
@@ -44,19 +51,37 @@ const (
 	ELSE      = "ELSE"
 	STRING    = "STRING"
 	WHILE     = "WHILE"
+	FOR       = "FOR"
+	IN        = "IN"
+	BREAK     = "BREAK"
+	CONTINUE  = "CONTINUE"
+	MATCH     = "MATCH"
 	OR        = "||"
 	AND       = "&&"
+
+	PLUS_ASSIGN     = "+="
+	MINUS_ASSIGN    = "-="
+	ASTERISK_ASSIGN = "*="
+	SLASH_ASSIGN    = "/="
+	PERCENT_ASSIGN  = "%="
+	INCREMENT       = "++"
+	DECREMENT       = "--"
 )
 
 var keywords = map[string]TokenType{
-	"fn":     FUNCTION,
-	"let":    LET,
-	"true":   TRUE,
-	"false":  FALSE,
-	"if":     IF,
-	"else":   ELSE,
-	"while":  WHILE,
-	"return": RETURN,
+	"fn":       FUNCTION,
+	"let":      LET,
+	"true":     TRUE,
+	"false":    FALSE,
+	"if":       IF,
+	"else":     ELSE,
+	"while":    WHILE,
+	"for":      FOR,
+	"in":       IN,
+	"return":   RETURN,
+	"break":    BREAK,
+	"continue": CONTINUE,
+	"match":    MATCH,
 }
 
 func LookupIdent(ident string) TokenType {
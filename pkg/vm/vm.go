@@ -0,0 +1,598 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/hculpan/kabkey/pkg/code"
+	"github.com/hculpan/kabkey/pkg/compiler"
+	"github.com/hculpan/kabkey/pkg/evaluator"
+	"github.com/hculpan/kabkey/pkg/object"
+	"github.com/hculpan/kabkey/pkg/token"
+)
+
+// StackSize is the number of stack slots a VM starts out with. The stack
+// grows as calls nest, so it is MaxFrames that limits recursion.
+const StackSize = 2048
+const GlobalsSize = 65536
+
+// MaxFrames is how deeply calls may nest, the same limit the evaluator
+// applies by default. A call in tail position replaces its caller's frame,
+// so a chain of tail calls runs at any length.
+const MaxFrames = evaluator.DefaultMaxCallDepth
+
+var (
+	NULL  = evaluator.NULL
+	TRUE  = evaluator.TRUE
+	FALSE = evaluator.FALSE
+)
+
+var operators = map[code.Opcode]string{
+	code.OpAdd:          "+",
+	code.OpSub:          "-",
+	code.OpMul:          "*",
+	code.OpDiv:          "/",
+	code.OpMod:          "%",
+	code.OpEqual:        "==",
+	code.OpNotEqual:     "!=",
+	code.OpLessThan:     "<",
+	code.OpLessEqual:    "<=",
+	code.OpGreaterThan:  ">",
+	code.OpGreaterEqual: ">=",
+}
+
+type VM struct {
+	constants   []object.Object
+	globals     []object.Object
+	globalNames []string
+	builtins    []object.Object
+	filename    string
+
+	stack []object.Object
+	sp    int // Always points to the next free slot. Top of stack is stack[sp-1]
+
+	frames      []*Frame
+	framesIndex int
+
+	// openUpvalues holds the upvalues that still point into the stack,
+	// keyed by stack slot.
+	openUpvalues map[int]*object.Upvalue
+
+	lastPopped object.Object
+}
+
+func New(bytecode *compiler.Bytecode) *VM {
+	mainFn := &object.CompiledFunction{
+		Instructions: bytecode.Instructions,
+		Positions:    bytecode.Positions,
+	}
+	mainClosure := &object.Closure{Fn: mainFn}
+
+	frames := make([]*Frame, MaxFrames+1)
+	frames[0] = NewFrame(mainClosure, 0)
+
+	names := bytecode.BuiltinNames
+	if names == nil {
+		names = evaluator.BuiltinNames()
+	}
+	builtins := make([]object.Object, len(names))
+	for i, name := range names {
+		fn, _ := evaluator.GetBuiltin(name)
+		builtins[i] = &object.Function{Name: name, NativeImpl: fn}
+	}
+
+	return &VM{
+		constants:   bytecode.Constants,
+		globals:     make([]object.Object, GlobalsSize),
+		globalNames: bytecode.GlobalNames,
+		builtins:    builtins,
+		filename:    bytecode.Filename,
+
+		stack: make([]object.Object, StackSize),
+		sp:    0,
+
+		frames:      frames,
+		framesIndex: 1,
+
+		openUpvalues: make(map[int]*object.Upvalue),
+	}
+}
+
+// LastPoppedStackElem returns the value of the last expression statement
+// run, which is the value of the program.
+func (vm *VM) LastPoppedStackElem() object.Object {
+	return vm.lastPopped
+}
+
+// Run executes the program. Runtime errors are returned as *object.Error
+// values carrying the same message and position as the evaluator's.
+//
+// The VM trusts its bytecode and does not check operands as it goes. Should
+// bytecode that did not come from the compiler make it fail, the panic is
+// returned as an error at the instruction being run.
+func (vm *VM) Run() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = vm.newError("invalid bytecode: %v", r)
+		}
+	}()
+
+	err = vm.run()
+	if errObj, ok := err.(*object.Error); ok {
+		if errObj.Filename == "" {
+			errObj.Filename = vm.filename
+		}
+		errObj.Stack = append(errObj.Stack, vm.traceback()...)
+	}
+
+	return err
+}
+
+// traceback lists the calls in progress, innermost first, the way the
+// evaluator records the calls an error propagates out of.
+func (vm *VM) traceback() []object.StackFrame {
+	var stack []object.StackFrame
+
+	for i := vm.framesIndex - 1; i > 0; i-- {
+		frame := vm.frames[i]
+
+		name := frame.cl.Fn.Name
+		if name == "" {
+			name = "<anonymous>"
+		}
+
+		stack = append(stack, object.StackFrame{
+			Function: name,
+			LineNo:   frame.caller.LineNo,
+			Position: frame.caller.Position,
+			Filename: vm.filename,
+		})
+	}
+
+	return stack
+}
+
+func (vm *VM) run() error {
+	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+		vm.currentFrame().ip++
+
+		ip := vm.currentFrame().ip
+		ins := vm.currentFrame().Instructions()
+		op := code.Opcode(ins[ip])
+
+		var err error
+
+		switch op {
+		case code.OpConstant:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			err = vm.push(vm.constants[constIndex])
+		case code.OpPop:
+			vm.lastPopped = vm.pop()
+		case code.OpTrue:
+			err = vm.push(TRUE)
+		case code.OpFalse:
+			err = vm.push(FALSE)
+		case code.OpNull:
+			err = vm.push(NULL)
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod,
+			code.OpEqual, code.OpNotEqual, code.OpLessThan, code.OpLessEqual,
+			code.OpGreaterThan, code.OpGreaterEqual:
+			right := vm.pop()
+			left := vm.pop()
+
+			err = vm.pushResult(evaluator.InfixOperation(vm.currentToken(), operators[op], left, right))
+		case code.OpMinus:
+			err = vm.pushResult(evaluator.MinusOperation(vm.currentToken(), vm.pop()))
+		case code.OpBang:
+			err = vm.push(evaluator.BangOperation(vm.pop()))
+		case code.OpJump:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip = pos - 1
+		case code.OpJumpNotTruthy, code.OpJumpTruthy:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			condition := vm.pop()
+			if evaluator.IsTruthy(condition) == (op == code.OpJumpTruthy) {
+				vm.currentFrame().ip = pos - 1
+			}
+		case code.OpGetGlobal:
+			globalIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			value := vm.globals[globalIndex]
+			if value == nil {
+				return vm.pushResult(evaluator.IdentifierNotFound(vm.currentToken(), vm.globalNames[globalIndex]))
+			}
+			err = vm.push(value)
+		case code.OpSetGlobal:
+			globalIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			vm.globals[globalIndex] = vm.pop()
+		case code.OpAssignGlobal:
+			globalIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			if vm.globals[globalIndex] == nil {
+				return vm.pushResult(evaluator.UndeclaredAssignment(vm.currentToken(), vm.globalNames[globalIndex]))
+			}
+			vm.globals[globalIndex] = vm.pop()
+		case code.OpGetLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			frame := vm.currentFrame()
+			value := vm.stack[frame.basePointer+int(localIndex)]
+			if value == nil {
+				return vm.pushResult(evaluator.IdentifierNotFound(vm.currentToken(), frame.cl.Fn.LocalNames[localIndex]))
+			}
+			err = vm.push(value)
+		case code.OpSetLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			frame := vm.currentFrame()
+			vm.stack[frame.basePointer+int(localIndex)] = vm.pop()
+		case code.OpGetFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			cl := vm.currentFrame().cl
+			value := cl.Free[freeIndex].Get()
+			if value == nil {
+				return vm.pushResult(evaluator.IdentifierNotFound(vm.currentToken(), cl.Fn.FreeNames[freeIndex]))
+			}
+			err = vm.push(value)
+		case code.OpSetFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			vm.currentFrame().cl.Free[freeIndex].Set(vm.pop())
+		case code.OpGetBuiltin:
+			builtinIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err = vm.push(vm.builtins[builtinIndex])
+		case code.OpArray:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			elements := make([]object.Object, numElements)
+			copy(elements, vm.stack[vm.sp-numElements:vm.sp])
+			vm.sp = vm.sp - numElements
+
+			err = vm.push(&object.Array{Elements: elements})
+		case code.OpHash:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			hash, hashErr := vm.buildHash(vm.sp-numElements, vm.sp)
+			if hashErr != nil {
+				return hashErr
+			}
+			vm.sp = vm.sp - numElements
+
+			err = vm.push(hash)
+		case code.OpIndex:
+			index := vm.pop()
+			left := vm.pop()
+
+			err = vm.pushResult(evaluator.IndexOperation(vm.currentToken(), left, index))
+		case code.OpClosure:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			err = vm.pushClosure(int(constIndex))
+		case code.OpCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err = vm.executeCall(int(numArgs))
+		case code.OpTailCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err = vm.executeTailCall(int(numArgs))
+		case code.OpReturnValue, code.OpReturn:
+			var returnValue object.Object = NULL
+			if op == code.OpReturnValue {
+				returnValue = vm.pop()
+			}
+
+			// A return at the top level ends the program with its value.
+			if vm.framesIndex == 1 {
+				vm.lastPopped = returnValue
+				return nil
+			}
+
+			frame := vm.popFrame()
+			vm.closeUpvalues(frame.basePointer)
+			vm.sp = frame.basePointer - 1
+
+			err = vm.push(returnValue)
+		case code.OpSwap:
+			vm.stack[vm.sp-1], vm.stack[vm.sp-2] = vm.stack[vm.sp-2], vm.stack[vm.sp-1]
+		case code.OpDup:
+			err = vm.push(vm.stack[vm.sp-1])
+		case code.OpIter:
+			iterable := vm.pop()
+
+			it, ok := iterable.(object.Iterable)
+			if !ok {
+				return vm.newError("cannot iterate over %s", iterable.Type())
+			}
+			err = vm.push(&iterator{items: it.Iterate()})
+		case code.OpIterNext:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			it := vm.pop().(*iterator)
+			if it.next < len(it.items) {
+				err = vm.push(it.items[it.next])
+				it.next++
+			} else {
+				vm.currentFrame().ip = pos - 1
+			}
+		default:
+			return fmt.Errorf("unknown opcode %d", op)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (vm *VM) executeCall(numArgs int) error {
+	// The main program's frame is not a call.
+	if vm.framesIndex > MaxFrames {
+		return vm.newError("stack overflow: more than %d nested calls", MaxFrames)
+	}
+
+	return vm.callValue(numArgs)
+}
+
+// callValue calls the callee below its arguments on the stack.
+func (vm *VM) callValue(numArgs int) error {
+	callee := vm.stack[vm.sp-1-numArgs]
+
+	switch callee := callee.(type) {
+	case *object.Closure:
+		return vm.callClosure(callee, numArgs, vm.currentPosition())
+	case *object.Function:
+		if callee.NativeImpl != nil {
+			return vm.callBuiltin(callee, numArgs)
+		}
+	}
+
+	return vm.newError("not a function: %s", callee.Type())
+}
+
+// executeTailCall makes a call in tail position. A closure takes over the
+// current frame, with the callee and its arguments moved down to where
+// the current function's own sit; anything else is called as usual, but
+// without adding to the nesting, as in the evaluator.
+func (vm *VM) executeTailCall(numArgs int) error {
+	cl, ok := vm.stack[vm.sp-1-numArgs].(*object.Closure)
+	if !ok {
+		return vm.callValue(numArgs)
+	}
+
+	if numArgs != cl.Fn.NumParameters {
+		return vm.newError("wrong number of arguments: want=%d, got=%d", cl.Fn.NumParameters, numArgs)
+	}
+
+	caller := vm.currentPosition()
+	frame := vm.popFrame()
+	vm.closeUpvalues(frame.basePointer)
+
+	copy(vm.stack[frame.basePointer-1:], vm.stack[vm.sp-1-numArgs:vm.sp])
+	vm.sp = frame.basePointer + numArgs
+
+	return vm.callClosure(cl, numArgs, caller)
+}
+
+// callClosure enters a closure called from the given position.
+func (vm *VM) callClosure(cl *object.Closure, numArgs int, caller code.Position) error {
+	if numArgs != cl.Fn.NumParameters {
+		return vm.newError("wrong number of arguments: want=%d, got=%d", cl.Fn.NumParameters, numArgs)
+	}
+
+	basePointer := vm.sp - numArgs
+	vm.growStack(basePointer + cl.Fn.NumLocals)
+
+	// Slots left over from earlier calls must not be mistaken for values.
+	for i := basePointer + numArgs; i < basePointer+cl.Fn.NumLocals; i++ {
+		vm.stack[i] = nil
+	}
+
+	frame := NewFrame(cl, basePointer)
+	frame.caller = caller
+	vm.pushFrame(frame)
+	vm.sp = basePointer + cl.Fn.NumLocals
+
+	return nil
+}
+
+// growStack makes room for at least size slots on the stack, moving the
+// open upvalues along with the slots they point at.
+func (vm *VM) growStack(size int) {
+	if size <= len(vm.stack) {
+		return
+	}
+
+	stack := make([]object.Object, 2*size)
+	copy(stack, vm.stack[:vm.sp])
+	vm.stack = stack
+
+	for slot, upvalue := range vm.openUpvalues {
+		upvalue.Location = &vm.stack[slot]
+	}
+}
+
+// callBuiltin calls a builtin function. Builtins do not use their
+// environment, so none is passed, and those that return nothing produce
+// null. Errors without a position of their own are reported at the call.
+func (vm *VM) callBuiltin(builtin *object.Function, numArgs int) error {
+	args := make([]object.Object, numArgs)
+	copy(args, vm.stack[vm.sp-numArgs:vm.sp])
+
+	result := builtin.NativeImpl(nil, args)
+	vm.sp = vm.sp - numArgs - 1
+
+	if errObj, ok := result.(*object.Error); ok && errObj.LineNo == 0 {
+		pos := vm.currentPosition()
+		errObj.LineNo, errObj.Position, errObj.Span = pos.LineNo, pos.Position, pos.Span
+	}
+
+	if result == nil {
+		result = NULL
+	}
+
+	return vm.pushResult(result)
+}
+
+func (vm *VM) pushClosure(constIndex int) error {
+	fn, ok := vm.constants[constIndex].(*object.CompiledFunction)
+	if !ok {
+		return fmt.Errorf("not a function: %+v", vm.constants[constIndex])
+	}
+
+	frame := vm.currentFrame()
+
+	free := make([]*object.Upvalue, len(fn.Captures))
+	for i, capture := range fn.Captures {
+		if capture.Local {
+			free[i] = vm.captureUpvalue(frame.basePointer + capture.Index)
+		} else {
+			free[i] = frame.cl.Free[capture.Index]
+		}
+	}
+
+	return vm.push(&object.Closure{Fn: fn, Free: free})
+}
+
+// captureUpvalue returns the upvalue for a stack slot, sharing it with any
+// closure that already captured the same slot.
+func (vm *VM) captureUpvalue(slot int) *object.Upvalue {
+	if upvalue, ok := vm.openUpvalues[slot]; ok {
+		return upvalue
+	}
+
+	upvalue := &object.Upvalue{Location: &vm.stack[slot]}
+	vm.openUpvalues[slot] = upvalue
+
+	return upvalue
+}
+
+// closeUpvalues closes every upvalue that points at or above the given
+// stack slot, so that closures keep the variables of a returning frame.
+func (vm *VM) closeUpvalues(from int) {
+	for slot, upvalue := range vm.openUpvalues {
+		if slot >= from {
+			upvalue.Close()
+			delete(vm.openUpvalues, slot)
+		}
+	}
+}
+
+func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
+	hash := object.NewHash()
+
+	for i := startIndex; i < endIndex; i += 2 {
+		key := vm.stack[i]
+		value := vm.stack[i+1]
+
+		hashKey, ok := key.(object.Hashable)
+		if !ok {
+			return nil, vm.newError("unusable as hash key: %s", key.Type())
+		}
+
+		hash.Set(hashKey, value)
+	}
+
+	return hash, nil
+}
+
+func (vm *VM) currentFrame() *Frame {
+	return vm.frames[vm.framesIndex-1]
+}
+
+func (vm *VM) pushFrame(f *Frame) {
+	vm.frames[vm.framesIndex] = f
+	vm.framesIndex++
+}
+
+func (vm *VM) popFrame() *Frame {
+	vm.framesIndex--
+	return vm.frames[vm.framesIndex]
+}
+
+func (vm *VM) push(o object.Object) error {
+	vm.growStack(vm.sp + 1)
+
+	vm.stack[vm.sp] = o
+	vm.sp++
+
+	return nil
+}
+
+// pushResult pushes the result of an operation, or returns it if it is an
+// error. The VM's tokens carry no text, so errors made from them are given
+// the length of the instruction's token here.
+func (vm *VM) pushResult(o object.Object) error {
+	if errObj, ok := o.(*object.Error); ok {
+		if errObj.Span == 0 {
+			errObj.Span = vm.currentPosition().Span
+		}
+		return errObj
+	}
+
+	return vm.push(o)
+}
+
+func (vm *VM) pop() object.Object {
+	o := vm.stack[vm.sp-1]
+	vm.sp--
+	return o
+}
+
+// currentPosition returns the source position of the instruction being run.
+func (vm *VM) currentPosition() code.Position {
+	frame := vm.currentFrame()
+	return frame.cl.Fn.Positions.Entry(frame.ip)
+}
+
+// currentToken returns the source position of the instruction being run as
+// a token, for the evaluator's operations.
+func (vm *VM) currentToken() token.Token {
+	pos := vm.currentPosition()
+	return token.Token{LineNo: pos.LineNo, Position: pos.Position}
+}
+
+func (vm *VM) newError(format string, a ...interface{}) *object.Error {
+	pos := vm.currentPosition()
+
+	err := object.NewError(fmt.Sprintf(format, a...), pos.LineNo, pos.Position)
+	err.Span = pos.Span
+	return err
+}
+
+// iterator walks the values of a for-in loop. It only ever lives in the
+// loop's hidden variable.
+type iterator struct {
+	items []object.Object
+	next  int
+}
+
+func (it *iterator) Type() object.ObjectType {
+	return "ITERATOR"
+}
+
+func (it *iterator) Inspect() string {
+	return "iterator"
+}
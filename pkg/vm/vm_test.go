@@ -0,0 +1,502 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hculpan/kabkey/pkg/ast"
+	"github.com/hculpan/kabkey/pkg/code"
+	"github.com/hculpan/kabkey/pkg/compiler"
+	"github.com/hculpan/kabkey/pkg/lexer"
+	"github.com/hculpan/kabkey/pkg/object"
+	"github.com/hculpan/kabkey/pkg/parser"
+)
+
+type vmTestCase struct {
+	input    string
+	expected interface{}
+}
+
+// vmError is the expected outcome of a program that fails at runtime.
+type vmError struct {
+	message  string
+	lineNo   int
+	position int
+}
+
+func TestIntegerArithmetic(t *testing.T) {
+	tests := []vmTestCase{
+		{"1", 1},
+		{"1 + 2", 3},
+		{"50 / 2 * 2 + 10 - 5", 55},
+		{"-5 + 10", 5},
+		{"7 % 3", 1},
+		{"let a = 1; a += 4; a", 5},
+		{"let a = 1; a++ + a", 3},
+		{"let a = 1; --a", 0},
+		{"1.5 * 2", 3.0},
+		{"-2.5", -2.5},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBooleanExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"true", true},
+		{"1 < 2", true},
+		{"1 >= 2", false},
+		{"true != false", true},
+		{`"a" == "a"`, true},
+		{`"a" != "a"`, false},
+		{`"a" != "b"`, true},
+		{"!5", false},
+		{"!0", true},
+		{"!!rest([])", false},
+		{"1 && 0", false},
+		{"0 || 2", true},
+		{"false && undefined", false},
+		{"true || undefined", true},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestConditionals(t *testing.T) {
+	tests := []vmTestCase{
+		{"if (true) { 10 }", 10},
+		{"if (false) { 10 }", nil},
+		{"if (1 > 2) { 10 } else { 20 }", 20},
+		{"if (true) { let a = 5; }", nil},
+		{"if (1 > 2) { 10 } else if (2 > 1) { 20 } else { 30 }", 20},
+		{"if (1 > 2) { 10 } else if (2 > 3) { 20 }", nil},
+		{"match (2) { 1 => 10, 2, 3 => 20, _ => 30 }", 20},
+		{"match (5) { 1 => 10, _ => 30 }", 30},
+		{"match (5) { 1 => 10 }", nil},
+		{"match (1) { 1 => 10, 1 => 20 }", 10},
+		{"let x = 1; match (x) { 1 => { let y = x + 1; y } }", 2},
+		{"fn(x) { match (x) { 1 => 10, _ => 20 } }(1)", 10},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestGlobals(t *testing.T) {
+	tests := []vmTestCase{
+		{"let one = 1; one", 1},
+		{"let one = 1; let two = one + one; one + two", 3},
+		{"let a = 1; let a = a + 1; a", 2},
+		{"let a = 1; a = 5; a", 5},
+		{"let a = 1;", nil},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestLoops(t *testing.T) {
+	tests := []vmTestCase{
+		{"let i = 0; while (i < 5) { i++ }; i", 5},
+		{"let i = 0; while (i < 5) { i += 1 }", 5},
+		{"while (false) { 1 }", nil},
+		{"let i = 0; while (true) { i++; if (i == 3) { break } }; i", 3},
+		{"let s = 0; let i = 0; while (i < 5) { i++; if (i % 2 == 0) { continue }; s += i }; s", 9},
+		{"let s = 0; for (let i = 0; i < 4; i++) { s += i }; s", 6},
+		{"for (let i = 0; i < 3; i++) { i * 10 }", 20},
+		{"let s = 0; for (x in [1, 2, 3]) { s += x }; s", 6},
+		{`let s = ""; for (c in "abc") { s = c + s }; s`, "cba"},
+		{`let s = 0; for (k in {"a": 1, "b": 2}) { s += 1 }; s`, 2},
+		{"for (x in []) { x }", nil},
+		{"let r = []; for (x in [1, 2]) { for (y in [3, 4]) { r = push(r, x * y) } }; r", []int{3, 4, 6, 8}},
+		{"while (true) { let a = 1 + if (true) { break } else { 0 } }", nil},
+		{"let r = []; for (x in [1, 2, 3]) { r = push(r, if (x == 2) { continue } else { x }) }; r", []int{1, 3}},
+		{`let n = 0; for (x in [1, 2, 3]) { n += {"a": [x, if (x == 2) { continue } else { x }][1]}["a"] }; n`, 4},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestCollections(t *testing.T) {
+	tests := []vmTestCase{
+		{"[1, 2 + 3][1]", 5},
+		{"[]", []int{}},
+		{"[1, 2, 3]", []int{1, 2, 3}},
+		{`{"a": 1, "b": 2}["b"]`, 2},
+		{`{"a": 1}["c"]`, nil},
+		{`len({1: 1, 2: 2})`, 2},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{"let f = fn() { 5 + 10 }; f()", 15},
+		{"let f = fn(a, b) { a + b }; f(1, 2)", 3},
+		{"let f = fn() { return 1; 2 }; f()", 1},
+		{"let f = fn() { }; f()", nil},
+		{"let f = fn() { let a = 1; }; f()", nil},
+		{"let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } }; fib(15)", 610},
+		{"let f = fn() { while (true) { return 7 } }; f()", 7},
+		{"fn fact(n) { if (n < 2) { 1 } else { n * fact(n - 1) } }; fact(5)", 120},
+		{"fn isEven(n) { if (n == 0) { true } else { isOdd(n - 1) } }; fn isOdd(n) { if (n == 0) { false } else { isEven(n - 1) } }; isOdd(7)", true},
+		{"let f = fn(n) { fn even(n) { if (n == 0) { 1 } else { odd(n - 1) } }; fn odd(n) { if (n == 0) { 0 } else { even(n - 1) } }; even(n) }; f(6) + f(3)", 1},
+		{"let g = fn() { h() }; let h = fn() { 3 }; g()", 3},
+		{"return 5; 6", 5},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{"let f = fn(n, acc) { if (n == 0) { acc } else { f(n - 1, acc + 1) } }; f(100000, 0)", 100000},
+		{"let f = fn(n) { match (n) { 0 => { 7 }, _ => { return f(n - 1) } } }; f(100000)", 7},
+		{"let f = fn(n) { while (true) { return if (n == 0) { 1 } else { f(n - 1) } } }; f(100000)", 1},
+		{"let f = fn(n) { if (n == 0) { len([1, 2]) } else { f(n - 1) } }; f(3)", 2},
+		{"let f = fn(n) { let g = fn() { n }; if (n == 0) { g } else { f(n - 1) } }; f(3)()", 0},
+		{"let f = fn(n) { if (n == 0) { fn() { n } } else { let g = fn() { n }; f(n - 1); } }; f(2)()", 0},
+		{"let f = fn(a) { a }; let g = fn() { f() }; g()", vmError{"wrong number of arguments: want=1, got=0", 1, 38}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestClosures(t *testing.T) {
+	tests := []vmTestCase{
+		{"let adder = fn(a) { fn(b) { a + b } }; adder(2)(3)", 5},
+		{`
+		let counter = fn() {
+			let n = 0;
+			fn() { n++; n }
+		};
+		let c = counter();
+		c(); c(); c()
+		`, 3},
+		{`
+		let f = fn() {
+			let n = 1;
+			let get = fn() { n };
+			n = 10;
+			get()
+		};
+		f()
+		`, 10},
+		{`
+		let make = fn() {
+			let n = 0;
+			let inc = fn() { n += 1 };
+			let get = fn() { n };
+			[inc, get]
+		};
+		let p = make();
+		p[0](); p[0]();
+		p[1]()
+		`, 2},
+		{`
+		let outer = fn(a) { fn() { fn() { a * 2 } } };
+		outer(21)()()
+		`, 42},
+		{`
+		let f = fn() {
+			let isEven = fn(n) { if (n == 0) { true } else { isOdd(n - 1) } };
+			let isOdd = fn(n) { if (n == 0) { false } else { isEven(n - 1) } };
+			isEven(10)
+		};
+		f()
+		`, true},
+		{`
+		let fs = [];
+		let f = fn() {
+			for (let i = 0; i < 3; i++) {
+				fs = push(fs, fn() { i })
+			}
+		};
+		f();
+		fs[0]()
+		`, 3},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		{`len("hello")`, 5},
+		{`first([7, 8])`, 7},
+		{`rest([])`, nil},
+		{`push([1], 2)`, []int{1, 2}},
+		{`type(1)`, "INTEGER"},
+		{`type(fn() {})`, "FUNCTION"},
+		{`let f = len; f("ab")`, 2},
+		{`print("")`, nil},
+		{`first(1)`, vmError{"parameter to 'first' must be ARRAY, got INTEGER", 1, 6}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	tests := []vmTestCase{
+		{"foobar", vmError{"identifier not found: foobar", 1, 1}},
+		{"5 + true;", vmError{"unsupported operation: INTEGER + BOOLEAN", 1, 3}},
+		{"-true", vmError{"unknown operator: -BOOLEAN", 1, 2}},
+		{`"a" - "b"`, vmError{"unknown operator: STRING - STRING", 1, 5}},
+		{"x = 1", vmError{"assignment to undeclared variable: x", 1, 1}},
+		{"let f = fn() { y }; f()", vmError{"identifier not found: y", 1, 16}},
+		{"[1, 2][5]", vmError{"index out of bounds: 5 (length 2)", 1, 8}},
+		{"1[0]", vmError{"index operator not supported: INTEGER[INTEGER]", 1, 3}},
+		{"5()", vmError{"not a function: INTEGER", 1, 2}},
+		{"fn(a) { a }()", vmError{"wrong number of arguments: want=1, got=0", 1, 12}},
+		{"for (x in 5) { x }", vmError{"cannot iterate over INTEGER", 1, 11}},
+		{"{[1]: 2}", vmError{"unusable as hash key: ARRAY", 1, 1}},
+		{"let f = fn() { f() + 1 }; f()", vmError{"stack overflow: more than 10000 nested calls", 1, 17}},
+		{"len(1, 2)", vmError{"too many parameters in call to 'len'", 1, 4}},
+		{"let a = [];\nlet b = 1 + push(a)", vmError{"incorrect number of parameters to 'push': expected 2, got 1", 2, 17}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRunLoadedExecutable(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse("let f = fn(a) { fn() { a * 2 } }; f(21)()")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := compiler.WriteExecutable(&buf, comp.Bytecode()); err != nil {
+		t.Fatalf("WriteExecutable failed: %s", err)
+	}
+
+	bytecode, err := compiler.ReadExecutable(&buf)
+	if err != nil {
+		t.Fatalf("ReadExecutable failed: %s", err)
+	}
+
+	vm := New(bytecode)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	testExpectedObject(t, "loaded executable", 42, vm.LastPoppedStackElem())
+}
+
+func TestClosureInspect(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"fn(x) { x }", "fn(x) {\nx\n}"},
+		{"fn add(a, b) { let c = a + b; c }; add", "fn add(a, b) {\nlet c = (a + b);c\n}"},
+		{"let add = fn(a, b) { a + b }; let plus = add; plus", "fn add(a, b) {\n(a + b)\n}"},
+		{"len", "builtin function len"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		if inspected := vm.LastPoppedStackElem().Inspect(); inspected != tt.expected {
+			t.Errorf("%q: wrong inspect. want=%q, got=%q", tt.input, tt.expected, inspected)
+		}
+	}
+}
+
+// TestBuiltinsByRecordedName runs bytecode whose builtin table differs from
+// the current one, as in an executable written before builtins were added.
+func TestBuiltinsByRecordedName(t *testing.T) {
+	bytecode := &compiler.Bytecode{
+		Instructions: concatInstructions([]code.Instructions{
+			code.Make(code.OpGetBuiltin, 1),
+			code.Make(code.OpConstant, 0),
+			code.Make(code.OpCall, 1),
+			code.Make(code.OpPop),
+		}),
+		Constants:    []object.Object{&object.String{Value: "abc"}},
+		BuiltinNames: []string{"first", "len"},
+	}
+
+	vm := New(bytecode)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	testExpectedObject(t, "recorded builtins", 3, vm.LastPoppedStackElem())
+}
+
+func TestInvalidBytecode(t *testing.T) {
+	tests := [][]code.Instructions{
+		{code.Make(code.OpConstant, 5)},
+		{code.Make(code.OpGetGlobal, 0), code.Make(code.OpCall, 0)},
+		{code.Make(code.OpGetFree, 3)},
+		{code.Make(code.OpConstant, 0)[:2]},
+	}
+
+	for _, tt := range tests {
+		vm := New(&compiler.Bytecode{Instructions: concatInstructions(tt)})
+
+		err := vm.Run()
+		if err == nil || !strings.HasPrefix(err.(*object.Error).Message, "invalid bytecode: ") {
+			t.Errorf("%s: expected invalid bytecode error, got=%v", concatInstructions(tt), err)
+		}
+	}
+}
+
+func TestErrorRender(t *testing.T) {
+	input := "let divide = fn(a, b) { a / b };\n" +
+		"let average = fn(xs) { divide(xs[0], len(xs) - 1) + 0 };\n" +
+		"average([7])"
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err := New(comp.Bytecode()).Run()
+	errObj, ok := err.(*object.Error)
+	if !ok {
+		t.Fatalf("expected runtime error, got=%v", err)
+	}
+
+	expected := "1:27: error: division by zero\n" +
+		"    1 | let divide = fn(a, b) { a / b };\n" +
+		"      |                           ^\n" +
+		"\tin divide called from [2:30]\n" +
+		"\tin average called from [3:8]\n"
+	if errObj.Render(input) != expected {
+		t.Errorf("wrong rendering. want=\n%s\ngot=\n%s", expected, errObj.Render(input))
+	}
+}
+
+func concatInstructions(s []code.Instructions) code.Instructions {
+	out := code.Instructions{}
+	for _, ins := range s {
+		out = append(out, ins...)
+	}
+
+	return out
+}
+
+func parse(input string) *ast.Program {
+	l := lexer.NewLexer(input)
+	p := parser.NewParser(l)
+	return p.ParseProgram()
+}
+
+func runVmTests(t *testing.T, tests []vmTestCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+
+		if expected, ok := tt.expected.(vmError); ok {
+			testRuntimeError(t, tt.input, expected, err)
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: vm error: %s", tt.input, err)
+		}
+
+		stackElem := vm.LastPoppedStackElem()
+
+		testExpectedObject(t, tt.input, tt.expected, stackElem)
+	}
+}
+
+func testRuntimeError(t *testing.T, input string, expected vmError, err error) {
+	t.Helper()
+
+	errObj, ok := err.(*object.Error)
+	if !ok {
+		t.Errorf("%s: expected runtime error, got=%v", input, err)
+		return
+	}
+
+	if errObj.Message != expected.message {
+		t.Errorf("%s: wrong error message. want=%q, got=%q", input, expected.message, errObj.Message)
+	}
+
+	if errObj.LineNo != expected.lineNo || errObj.Position != expected.position {
+		t.Errorf("%s: wrong error position. want=%d:%d, got=%d:%d",
+			input, expected.lineNo, expected.position, errObj.LineNo, errObj.Position)
+	}
+}
+
+func testExpectedObject(t *testing.T, input string, expected interface{}, actual object.Object) {
+	t.Helper()
+
+	switch expected := expected.(type) {
+	case int:
+		if err := testIntegerObject(int64(expected), actual); err != nil {
+			t.Errorf("%s: testIntegerObject failed: %s", input, err)
+		}
+	case float64:
+		result, ok := actual.(*object.Float)
+		if !ok || result.Value != expected {
+			t.Errorf("%s: object is not Float %f. got=%T (%+v)", input, expected, actual, actual)
+		}
+	case bool:
+		result, ok := actual.(*object.Boolean)
+		if !ok || result.Value != expected {
+			t.Errorf("%s: object is not Boolean %t. got=%T (%+v)", input, expected, actual, actual)
+		}
+	case string:
+		result, ok := actual.(*object.String)
+		if !ok || result.Value != expected {
+			t.Errorf("%s: object is not String %q. got=%T (%+v)", input, expected, actual, actual)
+		}
+	case []int:
+		array, ok := actual.(*object.Array)
+		if !ok {
+			t.Errorf("%s: object is not Array. got=%T (%+v)", input, actual, actual)
+			return
+		}
+
+		if len(array.Elements) != len(expected) {
+			t.Errorf("%s: wrong num of elements. want=%d, got=%d", input, len(expected), len(array.Elements))
+			return
+		}
+
+		for i, expectedElem := range expected {
+			if err := testIntegerObject(int64(expectedElem), array.Elements[i]); err != nil {
+				t.Errorf("%s: testIntegerObject failed: %s", input, err)
+			}
+		}
+	case nil:
+		if actual != NULL {
+			t.Errorf("%s: object is not NULL: %T (%+v)", input, actual, actual)
+		}
+	}
+}
+
+func testIntegerObject(expected int64, actual object.Object) error {
+	result, ok := actual.(*object.Integer)
+	if !ok {
+		return fmt.Errorf("object is not Integer. got=%T (%+v)", actual, actual)
+	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%d, want=%d", result.Value, expected)
+	}
+
+	return nil
+}